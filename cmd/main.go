@@ -18,25 +18,22 @@ import (
 	"github.com/ElisaOyj/openshift-lb-controller/pkg/common"
 	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
 
-	"github.com/getsentry/raven-go"
 	"k8s.io/client-go/kubernetes"
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
 	// lb providers
+	_ "github.com/ElisaOyj/openshift-lb-controller/pkg/controller/providers/envoy"
+	_ "github.com/ElisaOyj/openshift-lb-controller/pkg/controller/providers/external"
 	_ "github.com/ElisaOyj/openshift-lb-controller/pkg/controller/providers/f5"
+	_ "github.com/ElisaOyj/openshift-lb-controller/pkg/controller/providers/file"
+	_ "github.com/ElisaOyj/openshift-lb-controller/pkg/controller/providers/haproxy"
+	_ "github.com/ElisaOyj/openshift-lb-controller/pkg/controller/providers/webhook"
 )
 
-func init() {
-	sentry := os.Getenv("SENTRY_DSN")
-	if len(sentry) != 0 {
-		raven.SetDSN(sentry)
-		log.Printf("Using sentry dsn %s", sentry)
-	}
-}
-
 func main() {
 	log.SetOutput(os.Stdout)
+	reporter := common.NewErrorReporter()
 
 	sigs := make(chan os.Signal, 1)
 	stop := make(chan struct{})
@@ -50,13 +47,11 @@ func main() {
 	clientset, config, err := newClientSet(*runOutsideCluster)
 
 	if err != nil {
-		if common.SentryEnabled() {
-			raven.CaptureErrorAndWait(err, nil)
-		}
+		reporter.CaptureErrorAndWait(err, nil)
 		panic(err.Error())
 	}
 
-	go controller.NewRouteController(clientset, config).Run(stop, wg)
+	go controller.NewRouteController(clientset, config, reporter).Run(stop, wg)
 
 	<-sigs
 	log.Printf("Shutting down...")
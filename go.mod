@@ -6,16 +6,15 @@ require (
 	github.com/PuerkitoBio/purell v1.1.1 // indirect
 	github.com/certifi/gocertifi v0.0.0-20180118203423-deb3ae2ef261 // indirect
 	github.com/emicklei/go-restful v1.1.4-0.20170410110728-ff4f55a20633 // indirect
+	github.com/envoyproxy/go-control-plane v0.9.9
 	github.com/getsentry/raven-go v0.2.0
-	github.com/ghodss/yaml v0.0.0-20150909031657-73d445a93680 // indirect
 	github.com/go-openapi/jsonpointer v0.19.0 // indirect
 	github.com/go-openapi/jsonreference v0.19.0 // indirect
 	github.com/go-openapi/spec v0.0.0-20170914061247-7abd5745472f // indirect
 	github.com/go-openapi/swag v0.19.0 // indirect
 	github.com/gogo/protobuf v0.0.0-20170330071051-c0656edd0d9e // indirect
-	github.com/golang/glog v0.0.0-20141105023935-44145f04b68c // indirect
 	github.com/golang/groupcache v0.0.0-20200121045136-8c9f03a8e57e // indirect
-	github.com/golang/protobuf v0.0.0-20171021043952-1643683e1b54 // indirect
+	github.com/golang/protobuf v1.4.3
 	github.com/google/btree v1.0.0 // indirect
 	github.com/google/gofuzz v0.0.0-20161122191042-44d81051d367 // indirect
 	github.com/googleapis/gnostic v0.0.0-20170729233727-0c5108395e2d // indirect
@@ -26,18 +25,16 @@ require (
 	github.com/json-iterator/go v0.0.0-20170829155851-36b14963da70 // indirect
 	github.com/juju/ratelimit v0.0.0-20170523012141-5b9ff8664717 // indirect
 	github.com/mailru/easyjson v0.0.0-20190312143242-1de009706dbe // indirect
+	github.com/miekg/dns v1.1.43
 	github.com/openshift/api v0.0.0-20180801171038-322a19404e37
 	github.com/openshift/client-go v3.9.0+incompatible
 	github.com/peterbourgon/diskv v2.0.1+incompatible // indirect
 	github.com/pkg/errors v0.8.1 // indirect
 	github.com/scottdware/go-bigip v0.0.0-20210208194607-e46d557fd6e6
 	github.com/spf13/pflag v0.0.0-20170130214245-9ff6c6923cff // indirect
-	golang.org/x/net v0.0.0-20201021035429-f5854403a974 // indirect
-	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a // indirect
-	golang.org/x/sys v0.0.0-20210119212857-b64e53b001e4 // indirect
+	google.golang.org/grpc v1.36.0
 	gopkg.in/inf.v0 v0.9.0 // indirect
 	gopkg.in/yaml.v1 v1.0.0-20140924161607-9f9df34309c0 // indirect
-	gopkg.in/yaml.v2 v2.2.2 // indirect
 	k8s.io/api v0.0.0-20180103015100-006a217681ae
 	k8s.io/apimachinery v0.0.0-20180103014849-68f9c3a1feb3
 	k8s.io/client-go v6.0.1-0.20180103015815-9389c055a838+incompatible
@@ -0,0 +1,30 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package common
+
+import (
+	"reflect"
+)
+
+// MemberSettings are settings of the pool member of this cluster
+type MemberSettings struct {
+	// Ratio is the weight of the member with ratio load balancing methods, 0 uses the default of the lb
+	Ratio int `json:"ratio,omitempty"`
+	// ConnectionLimit is the maximum number of concurrent connections to the member, 0 is unlimited
+	ConnectionLimit int `json:"connectionLimit,omitempty"`
+	// SlowRampTime is the time in seconds during which traffic to a member coming up is increased
+	// gradually, nil uses the default of the lb
+	SlowRampTime *int `json:"slowRampTime,omitempty"`
+	// Backup is true if the role of the member has lower priority than the greatest role priority,
+	// it is used by lbs which do not have priority groups
+	Backup bool `json:"backup,omitempty"`
+}
+
+// Equal returns true if settings are identical
+func (s MemberSettings) Equal(other MemberSettings) bool {
+	return reflect.DeepEqual(s, other)
+}
@@ -0,0 +1,201 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package common
+
+import (
+	"log"
+	"os"
+	"sync"
+
+	"github.com/getsentry/raven-go"
+)
+
+// ErrorReporter is an abstract, pluggable interface for reporting errors.
+type ErrorReporter interface {
+	// CaptureError reports error with tags
+	CaptureError(err error, tags map[string]string)
+	// CaptureErrorAndWait reports error with tags and waits until it is delivered
+	CaptureErrorAndWait(err error, tags map[string]string)
+	// CaptureMessage reports message with tags
+	CaptureMessage(msg string, tags map[string]string)
+}
+
+// NewErrorReporter returns sentry reporter if SENTRY_DSN is set, otherwise log reporter
+func NewErrorReporter() ErrorReporter {
+	if SentryEnabled() {
+		return NewSentryReporter(os.Getenv("SENTRY_DSN"))
+	}
+	return NewLogReporter()
+}
+
+// LogReporter writes errors to log only
+type LogReporter struct{}
+
+// NewLogReporter returns new log reporter
+func NewLogReporter() *LogReporter {
+	return &LogReporter{}
+}
+
+// CaptureError writes error to log
+func (r *LogReporter) CaptureError(err error, tags map[string]string) {
+	log.Println(err)
+}
+
+// CaptureErrorAndWait writes error to log
+func (r *LogReporter) CaptureErrorAndWait(err error, tags map[string]string) {
+	log.Println(err)
+}
+
+// CaptureMessage writes message to log
+func (r *LogReporter) CaptureMessage(msg string, tags map[string]string) {
+	log.Println(msg)
+}
+
+// SentryReporter writes errors to log and sends them to sentry
+type SentryReporter struct {
+	LogReporter
+}
+
+// NewSentryReporter returns new sentry reporter using dsn
+func NewSentryReporter(dsn string) *SentryReporter {
+	err := raven.SetDSN(dsn)
+	if err != nil {
+		log.Printf("error setting sentry dsn %v", err)
+	} else {
+		log.Printf("Using sentry dsn %s", dsn)
+	}
+	return &SentryReporter{}
+}
+
+// CaptureError writes error to log and sends it to sentry
+func (r *SentryReporter) CaptureError(err error, tags map[string]string) {
+	r.LogReporter.CaptureError(err, tags)
+	raven.CaptureError(err, tags)
+}
+
+// CaptureErrorAndWait writes error to log and sends it to sentry, waiting for the delivery
+func (r *SentryReporter) CaptureErrorAndWait(err error, tags map[string]string) {
+	r.LogReporter.CaptureErrorAndWait(err, tags)
+	raven.CaptureErrorAndWait(err, tags)
+}
+
+// CaptureMessage writes message to log and sends it to sentry
+func (r *SentryReporter) CaptureMessage(msg string, tags map[string]string) {
+	r.LogReporter.CaptureMessage(msg, tags)
+	raven.CaptureMessage(msg, tags)
+}
+
+// NopReporter drops all errors
+type NopReporter struct{}
+
+// NewNopReporter returns new reporter which does nothing
+func NewNopReporter() *NopReporter {
+	return &NopReporter{}
+}
+
+// CaptureError does nothing
+func (r *NopReporter) CaptureError(err error, tags map[string]string) {}
+
+// CaptureErrorAndWait does nothing
+func (r *NopReporter) CaptureErrorAndWait(err error, tags map[string]string) {}
+
+// CaptureMessage does nothing
+func (r *NopReporter) CaptureMessage(msg string, tags map[string]string) {}
+
+// Report is single error or message captured by RecordingReporter
+type Report struct {
+	Message string
+	Tags    map[string]string
+}
+
+// RecordingReporter stores reported errors in memory, it is meant for testing
+type RecordingReporter struct {
+	reports []Report
+	lock    sync.Mutex
+}
+
+// NewRecordingReporter returns new recording reporter for testing purposes
+func NewRecordingReporter() *RecordingReporter {
+	return &RecordingReporter{
+		reports: []Report{},
+	}
+}
+
+func (r *RecordingReporter) add(msg string, tags map[string]string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.reports = append(r.reports, Report{Message: msg, Tags: tags})
+}
+
+// CaptureError records error
+func (r *RecordingReporter) CaptureError(err error, tags map[string]string) {
+	r.add(err.Error(), tags)
+}
+
+// CaptureErrorAndWait records error
+func (r *RecordingReporter) CaptureErrorAndWait(err error, tags map[string]string) {
+	r.add(err.Error(), tags)
+}
+
+// CaptureMessage records message
+func (r *RecordingReporter) CaptureMessage(msg string, tags map[string]string) {
+	r.add(msg, tags)
+}
+
+// Reports returns list of recorded reports
+func (r *RecordingReporter) Reports() []Report {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Report{}, r.reports...)
+}
+
+// CleanReports cleans recorded reports
+func (r *RecordingReporter) CleanReports() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.reports = []Report{}
+}
+
+// taggedReporter adds static tags to every report
+type taggedReporter struct {
+	reporter ErrorReporter
+	tags     map[string]string
+}
+
+// WithTags returns reporter which adds tags to every report, tags given in call override these
+func WithTags(reporter ErrorReporter, tags map[string]string) ErrorReporter {
+	return &taggedReporter{
+		reporter: reporter,
+		tags:     tags,
+	}
+}
+
+func (r *taggedReporter) merge(tags map[string]string) map[string]string {
+	merged := make(map[string]string, len(r.tags)+len(tags))
+	for key, value := range r.tags {
+		merged[key] = value
+	}
+	for key, value := range tags {
+		merged[key] = value
+	}
+	return merged
+}
+
+// CaptureError reports error with merged tags
+func (r *taggedReporter) CaptureError(err error, tags map[string]string) {
+	r.reporter.CaptureError(err, r.merge(tags))
+}
+
+// CaptureErrorAndWait reports error with merged tags
+func (r *taggedReporter) CaptureErrorAndWait(err error, tags map[string]string) {
+	r.reporter.CaptureErrorAndWait(err, r.merge(tags))
+}
+
+// CaptureMessage reports message with merged tags
+func (r *taggedReporter) CaptureMessage(msg string, tags map[string]string) {
+	r.reporter.CaptureMessage(msg, r.merge(tags))
+}
@@ -0,0 +1,260 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package controller
+
+import (
+	"context"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/common"
+	v1 "github.com/openshift/api/route/v1"
+)
+
+// contextAdapter makes ProviderInterface usable as ContextProviderInterface
+type contextAdapter struct {
+	provider ProviderInterface
+}
+
+// NewContextAdapter wraps provider which does not support contexts. When context is done the caller
+// is released immediately, but the wrapped call keeps running in background until the provider returns.
+func NewContextAdapter(provider ProviderInterface) ContextProviderInterface {
+	return &contextAdapter{provider: provider}
+}
+
+func (a *contextAdapter) run(ctx context.Context, call func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Initialize initilizes wrapped provider
+func (a *contextAdapter) Initialize() {
+	a.provider.Initialize()
+}
+
+// SetReporter sets error reporter to wrapped provider
+func (a *contextAdapter) SetReporter(reporter common.ErrorReporter) {
+	a.provider.SetReporter(reporter)
+}
+
+// CreatePool creates new loadbalancer pool
+func (a *contextAdapter) CreatePool(ctx context.Context, name string, port string) error {
+	return a.run(ctx, func() error {
+		return a.provider.CreatePool(name, port)
+	})
+}
+
+// AddPoolMember adds new member to pool
+func (a *contextAdapter) AddPoolMember(ctx context.Context, membername string, name string, port string) error {
+	return a.run(ctx, func() error {
+		return a.provider.AddPoolMember(membername, name, port)
+	})
+}
+
+// ModifyPool modifies loadbalancer pool
+func (a *contextAdapter) ModifyPool(ctx context.Context, name string, port string, loadBalancingMethod string, pga int, maintenance bool, prio int, role string, settings MemberSettings) error {
+	return a.run(ctx, func() error {
+		return a.provider.ModifyPool(name, port, loadBalancingMethod, pga, maintenance, prio, role, settings)
+	})
+}
+
+// CreateMonitor creates new monitor
+func (a *contextAdapter) CreateMonitor(ctx context.Context, host string, port string, uri string, httpMethod string, interval int, timeout int) error {
+	return a.run(ctx, func() error {
+		return a.provider.CreateMonitor(host, port, uri, httpMethod, interval, timeout)
+	})
+}
+
+// ModifyMonitor modifies monitor
+func (a *contextAdapter) ModifyMonitor(ctx context.Context, host string, port string, uri string, httpMethod string, interval int, timeout int) error {
+	return a.run(ctx, func() error {
+		return a.provider.ModifyMonitor(host, port, uri, httpMethod, interval, timeout)
+	})
+}
+
+// AddMonitorToPool adds monitor to pool
+func (a *contextAdapter) AddMonitorToPool(ctx context.Context, name string, port string) error {
+	return a.run(ctx, func() error {
+		return a.provider.AddMonitorToPool(name, port)
+	})
+}
+
+// DeletePoolMember delete pool member
+func (a *contextAdapter) DeletePoolMember(ctx context.Context, membername string, name string, port string) error {
+	return a.run(ctx, func() error {
+		return a.provider.DeletePoolMember(membername, name, port)
+	})
+}
+
+// CheckAndClean checks pool members and if 0 members left in pool, delete monitor and delete pool
+func (a *contextAdapter) CheckAndClean(ctx context.Context, name string, port string) error {
+	return a.run(ctx, func() error {
+		return a.provider.CheckAndClean(name, port)
+	})
+}
+
+// PreUpdate is executed before updating anything
+func (a *contextAdapter) PreUpdate(ctx context.Context) error {
+	return a.run(ctx, func() error {
+		return a.provider.PreUpdate()
+	})
+}
+
+// PostUpdate is executed after updating
+func (a *contextAdapter) PostUpdate(ctx context.Context) error {
+	return a.run(ctx, func() error {
+		return a.provider.PostUpdate()
+	})
+}
+
+// CheckPools returns hosts which should be removed
+func (a *contextAdapter) CheckPools(ctx context.Context, routes []v1.Route, hosttowatch string, membername string) (map[string]bool, error) {
+	var hosts map[string]bool
+	err := a.run(ctx, func() error {
+		var err error
+		hosts, err = a.provider.CheckPools(routes, hosttowatch, membername)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// Calls returns list of methodcalls of wrapped provider
+func (a *contextAdapter) Calls() []string {
+	return a.provider.Calls()
+}
+
+// CleanCalls cleans calls of wrapped provider
+func (a *contextAdapter) CleanCalls() {
+	a.provider.CleanCalls()
+}
+
+// declarativeAdapter makes ContextProviderInterface usable as DeclarativeProviderInterface, so that
+// providers of both kinds can be combined in declarative composite provider
+type declarativeAdapter struct {
+	provider ContextProviderInterface
+}
+
+// NewDeclarativeAdapter wraps provider which receives single operations. Apply executes the operations
+// which create and modify pools, member and monitors of each port, Remove deletes the member and
+// cleans pools without members.
+func NewDeclarativeAdapter(provider ContextProviderInterface) DeclarativeProviderInterface {
+	return &declarativeAdapter{provider: provider}
+}
+
+// Initialize initilizes wrapped provider
+func (a *declarativeAdapter) Initialize() {
+	a.provider.Initialize()
+}
+
+// SetReporter sets error reporter to wrapped provider
+func (a *declarativeAdapter) SetReporter(reporter common.ErrorReporter) {
+	a.provider.SetReporter(reporter)
+}
+
+// Apply makes pools, member and monitors of the host to match state
+func (a *declarativeAdapter) Apply(ctx context.Context, state HostState) error {
+	for _, port := range state.Ports {
+		calls := []func() error{
+			func() error { return a.provider.CreatePool(ctx, state.Host, port) },
+			func() error { return a.provider.AddPoolMember(ctx, state.Member, state.Host, port) },
+			func() error {
+				return a.provider.ModifyPool(ctx, state.Host, port, state.LoadBalancingMethod, state.PGA, state.Maintenance, state.Prio, state.Role, state.MemberSettings)
+			},
+			func() error {
+				return a.provider.CreateMonitor(ctx, state.Host, port, state.Monitor.Path, state.Monitor.Method, state.Monitor.Interval, state.Monitor.Timeout)
+			},
+			func() error {
+				return a.provider.ModifyMonitor(ctx, state.Host, port, state.Monitor.Path, state.Monitor.Method, state.Monitor.Interval, state.Monitor.Timeout)
+			},
+			func() error { return a.provider.AddMonitorToPool(ctx, state.Host, port) },
+		}
+		for _, call := range calls {
+			if err := call(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Remove deletes member from pools of the host and cleans pools without members. All calls are
+// executed even if some of them fail, the first error is returned
+func (a *declarativeAdapter) Remove(ctx context.Context, host string, membername string) error {
+	var first error
+	for _, port := range Ports {
+		if err := a.provider.DeletePoolMember(ctx, membername, host, port); err != nil && first == nil {
+			first = err
+		}
+	}
+	for _, port := range Ports {
+		if err := a.provider.CheckAndClean(ctx, host, port); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// ListHosts returns hosts which have membername as member. Without routes CheckPools returns all of them
+func (a *declarativeAdapter) ListHosts(ctx context.Context, membername string) ([]string, error) {
+	result, err := a.provider.CheckPools(ctx, nil, "", membername)
+	if err != nil {
+		return nil, err
+	}
+	hosts := []string{}
+	for host, found := range result {
+		if found {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, nil
+}
+
+// PreUpdate executes PreUpdate of wrapped provider
+func (a *declarativeAdapter) PreUpdate(ctx context.Context) error {
+	return a.provider.PreUpdate(ctx)
+}
+
+// PostUpdate executes PostUpdate of wrapped provider
+func (a *declarativeAdapter) PostUpdate(ctx context.Context) error {
+	return a.provider.PostUpdate(ctx)
+}
+
+// Calls returns list of methodcalls of wrapped provider
+func (a *declarativeAdapter) Calls() []string {
+	return a.provider.Calls()
+}
+
+// CleanCalls cleans calls of wrapped provider
+func (a *declarativeAdapter) CleanCalls() {
+	a.provider.CleanCalls()
+}
+
+// unwrap returns provider which is wrapped by adapters, so that its optional interfaces can be found
+func unwrap(provider interface{}) interface{} {
+	for {
+		switch adapter := provider.(type) {
+		case *contextAdapter:
+			provider = adapter.provider
+		case *declarativeAdapter:
+			provider = adapter.provider
+		default:
+			return provider
+		}
+	}
+}
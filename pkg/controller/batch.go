@@ -0,0 +1,236 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBatchWindow = time.Second
+	// batch is executed at the latest after this many windows even if changes keep coming
+	maxBatchWindows = 10
+	// changes which were not executed because PreUpdate failed are retried after this delay,
+	// which is doubled on each failure up to maxRequeueDelay
+	defaultRequeueDelay = 5 * time.Second
+	maxRequeueDelay     = 5 * time.Minute
+)
+
+// change is a pending lb change of a host
+type change struct {
+	host string
+	fn   func()
+	// barrier is executed after other changes of the batch
+	barrier bool
+}
+
+// batch collects changes which arrive within the batch window, so that all of them share
+// one PreUpdate and one PostUpdate
+type batch struct {
+	window  time.Duration
+	lock    sync.Mutex
+	pending []change
+	started time.Time
+	timer   *time.Timer
+	// workers is the number of hosts which are updated in parallel
+	workers int
+	// execLock makes sure that only one batch is executed at a time
+	execLock sync.Mutex
+	// requeued contains changes of failed batches, they are executed before pending changes
+	requeued     []change
+	requeueDelay time.Duration
+	failures     int
+	requeueTimer *time.Timer
+}
+
+// enqueue adds change of host to the current batch. Without batch window the change is executed immediately
+func (c *RouteController) enqueue(host string, fn func()) {
+	c.enqueueChange(change{host: host, fn: fn})
+}
+
+// enqueueBarrier adds change which is executed after the changes queued before it
+func (c *RouteController) enqueueBarrier(name string, fn func()) {
+	c.enqueueChange(change{host: name, fn: fn, barrier: true})
+}
+
+func (c *RouteController) enqueueChange(ch change) {
+	if c.batch.window <= 0 {
+		c.batch.lock.Lock()
+		changes := append(c.batch.requeued, ch)
+		c.batch.requeued = nil
+		c.batch.lock.Unlock()
+		c.executeBatch(changes)
+		return
+	}
+	c.batch.lock.Lock()
+	defer c.batch.lock.Unlock()
+	now := time.Now()
+	if len(c.batch.pending) == 0 {
+		c.batch.started = now
+	}
+	c.batch.pending = append(c.batch.pending, ch)
+	delay := c.batch.window
+	if deadline := c.batch.started.Add(maxBatchWindows * c.batch.window); now.Add(delay).After(deadline) {
+		delay = deadline.Sub(now)
+	}
+	if c.batch.timer == nil {
+		c.batch.timer = time.AfterFunc(delay, c.flush)
+	} else {
+		c.batch.timer.Reset(delay)
+	}
+}
+
+// flush executes pending changes
+func (c *RouteController) flush() {
+	c.batch.lock.Lock()
+	changes := append(c.batch.requeued, c.batch.pending...)
+	c.batch.requeued = nil
+	c.batch.pending = nil
+	if c.batch.timer != nil {
+		c.batch.timer.Stop()
+	}
+	c.batch.lock.Unlock()
+	if len(changes) > 0 {
+		c.executeBatch(changes)
+	}
+}
+
+func (c *RouteController) executeBatch(changes []change) {
+	c.batch.execLock.Lock()
+	defer c.batch.execLock.Unlock()
+	name := changes[0].host
+	if len(changes) > 1 {
+		name = fmt.Sprintf("%d changes", len(changes))
+		log.Printf("executing batch of %d lb changes", len(changes))
+	}
+	if err := c.preUpdate(name); err != nil {
+		c.requeue(changes)
+		return
+	}
+	c.batch.lock.Lock()
+	c.batch.failures = 0
+	c.batch.lock.Unlock()
+	c.executeChanges(changes)
+	c.postUpdate(name)
+}
+
+// requeue executes changes again with backoff, before changes which arrive after them. The changes
+// are kept in order, so that an old change of a host never overrides a newer one.
+func (c *RouteController) requeue(changes []change) {
+	c.batch.lock.Lock()
+	defer c.batch.lock.Unlock()
+	c.batch.requeued = append(changes, c.batch.requeued...)
+	delay := c.batch.requeueDelay
+	if delay <= 0 {
+		delay = defaultRequeueDelay
+	}
+	for i := 0; i < c.batch.failures && delay < maxRequeueDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRequeueDelay {
+		delay = maxRequeueDelay
+	}
+	c.batch.failures++
+	log.Printf("pre update failed, retrying %d lb changes in %v", len(changes), delay)
+	if c.batch.requeueTimer != nil {
+		c.batch.requeueTimer.Stop()
+	}
+	c.batch.requeueTimer = time.AfterFunc(delay, func() {
+		if c.ctx != nil && c.ctx.Err() != nil {
+			return
+		}
+		c.flush()
+	})
+}
+
+// executeChanges executes changes using batch workers. Changes of one host are executed
+// in order by the same worker, different hosts are executed in parallel. Barriers are executed last.
+func (c *RouteController) executeChanges(changes []change) {
+	hosts := []string{}
+	byHost := map[string][]change{}
+	barriers := []change{}
+	defer func() {
+		for _, change := range barriers {
+			change.fn()
+		}
+	}()
+	for _, change := range changes {
+		if change.barrier {
+			barriers = append(barriers, change)
+			continue
+		}
+		if _, ok := byHost[change.host]; !ok {
+			hosts = append(hosts, change.host)
+		}
+		byHost[change.host] = append(byHost[change.host], change)
+	}
+	workers := c.batch.workers
+	if workers > len(hosts) {
+		workers = len(hosts)
+	}
+	if workers <= 1 {
+		for _, change := range changes {
+			if !change.barrier {
+				change.fn()
+			}
+		}
+		return
+	}
+	queue := make(chan []change)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for hostChanges := range queue {
+				for _, change := range hostChanges {
+					change.fn()
+				}
+			}
+		}()
+	}
+	for _, host := range hosts {
+		queue <- byHost[host]
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// preUpdate executes PreUpdate of the provider, if error is returned nothing should be written to the lb
+func (c *RouteController) preUpdate(name string) error {
+	if c.declarative != nil {
+		hooks, ok := c.declarative.(UpdateHooks)
+		if !ok {
+			return nil
+		}
+		return c.call("PreUpdate", name, func(ctx context.Context) error {
+			return hooks.PreUpdate(ctx)
+		})
+	}
+	return c.call("PreUpdate", name, func(ctx context.Context) error {
+		return c.provider.PreUpdate(ctx)
+	})
+}
+
+// postUpdate executes PostUpdate of the provider
+func (c *RouteController) postUpdate(name string) {
+	if c.declarative != nil {
+		if hooks, ok := c.declarative.(UpdateHooks); ok {
+			c.call("PostUpdate", name, func(ctx context.Context) error {
+				return hooks.PostUpdate(ctx)
+			})
+		}
+		return
+	}
+	c.call("PostUpdate", name, func(ctx context.Context) error {
+		return c.provider.PostUpdate(ctx)
+	})
+}
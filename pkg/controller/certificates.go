@@ -0,0 +1,168 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	v1r "github.com/openshift/api/route/v1"
+	"k8s.io/api/core/v1"
+)
+
+// tlsSecretAnnotation is annotation which contains name of kubernetes.io/tls secret in the namespace of
+// the route, it overrides certificate of the route
+const tlsSecretAnnotation = "route.elisa.fi/tlssecret"
+
+// Certificate is the TLS certificate of a host in PEM format
+type Certificate struct {
+	Certificate   string `json:"certificate"`
+	Key           string `json:"key"`
+	CACertificate string `json:"caCertificate,omitempty"`
+}
+
+// Fingerprint returns sha256 of the certificate, key and ca certificate
+func (c Certificate) Fingerprint() string {
+	sum := sha256.Sum256([]byte(c.Certificate + c.Key + c.CACertificate))
+	return hex.EncodeToString(sum[:])
+}
+
+// CertificateHandler can be implemented by providers to install TLS certificates of custom hosts to the lb
+type CertificateHandler interface {
+	// installs certificate of the host or replaces the existing one, must be idempotent
+	SetCertificate(ctx context.Context, host string, certificate Certificate) error
+	// removes certificate of the host
+	DeleteCertificate(ctx context.Context, host string) error
+}
+
+// certificateHandler returns CertificateHandler of the provider, nil if the provider does not handle certificates
+func certificateHandler(provider interface{}) CertificateHandler {
+	handler, _ := unwrap(provider).(CertificateHandler)
+	return handler
+}
+
+// certificates contains fingerprints of installed certificates by host
+type certificates struct {
+	lock         sync.Mutex
+	fingerprints map[string]string
+}
+
+// changed stores fingerprint of the host, returns true if it is not same as before
+func (c *certificates) changed(host string, fingerprint string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.fingerprints == nil {
+		c.fingerprints = map[string]string{}
+	}
+	if c.fingerprints[host] == fingerprint {
+		return false
+	}
+	c.fingerprints[host] = fingerprint
+	return true
+}
+
+func (c *certificates) forget(host string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.fingerprints, host)
+}
+
+// certificateHandler returns CertificateHandler of the current provider
+func (c *RouteController) certificateHandler() CertificateHandler {
+	if c.declarative != nil {
+		return certificateHandler(c.declarative)
+	}
+	return certificateHandler(c.provider)
+}
+
+// routeCertificate returns certificate of the route from the secret of tls secret annotation or
+// from the route itself, nil if the route does not have certificate
+func (c *RouteController) routeCertificate(route *v1r.Route) (*Certificate, error) {
+	if name, ok := route.Annotations[tlsSecretAnnotation]; ok {
+		if c.getSecret == nil {
+			return nil, fmt.Errorf("cannot read secret %s/%s", route.Namespace, name)
+		}
+		secret, err := c.getSecret(route.Namespace, name)
+		if err != nil {
+			return nil, fmt.Errorf("error reading secret %s/%s %v", route.Namespace, name, err)
+		}
+		certificate := &Certificate{
+			Certificate:   string(secret.Data[v1.TLSCertKey]),
+			Key:           string(secret.Data[v1.TLSPrivateKeyKey]),
+			CACertificate: string(secret.Data["ca.crt"]),
+		}
+		if len(certificate.Certificate) == 0 || len(certificate.Key) == 0 {
+			return nil, fmt.Errorf("secret %s/%s does not contain %s and %s", route.Namespace, name, v1.TLSCertKey, v1.TLSPrivateKeyKey)
+		}
+		return certificate, nil
+	}
+	if route.Spec.TLS == nil || len(route.Spec.TLS.Certificate) == 0 || len(route.Spec.TLS.Key) == 0 {
+		return nil, nil
+	}
+	return &Certificate{
+		Certificate:   route.Spec.TLS.Certificate,
+		Key:           route.Spec.TLS.Key,
+		CACertificate: route.Spec.TLS.CACertificate,
+	}, nil
+}
+
+// syncCertificate installs certificate of custom host to the lb if it has changed, or removes it if
+// the route does not have certificate anymore. Host must be the same which is used for the pools.
+func (c *RouteController) syncCertificate(host string, route *v1r.Route) {
+	handler := c.certificateHandler()
+	if handler == nil || strings.HasSuffix(host, c.hosttowatch) {
+		return
+	}
+	certificate, err := c.routeCertificate(route)
+	if err != nil {
+		c.reporter.CaptureError(err, map[string]string{"route": route.Namespace + "/" + route.Name})
+		return
+	}
+	fingerprint := ""
+	if certificate != nil {
+		fingerprint = certificate.Fingerprint()
+	}
+	if !c.certificates.changed(host, fingerprint) {
+		return
+	}
+	c.enqueue(host, func() {
+		if certificate == nil {
+			c.call("DeleteCertificate", host, func(ctx context.Context) error {
+				return handler.DeleteCertificate(ctx, host)
+			})
+			return
+		}
+		err := c.call("SetCertificate", host, func(ctx context.Context) error {
+			return handler.SetCertificate(ctx, host, *certificate)
+		})
+		if err != nil {
+			// installed again on next update of the route
+			c.certificates.forget(host)
+			return
+		}
+		log.Printf("set certificate host: %s", host)
+	})
+}
+
+// removeCertificate removes certificate of custom host from the lb
+func (c *RouteController) removeCertificate(host string) {
+	handler := c.certificateHandler()
+	if handler == nil || strings.HasSuffix(host, c.hosttowatch) {
+		return
+	}
+	c.certificates.forget(host)
+	c.enqueue(host, func() {
+		c.call("DeleteCertificate", host, func(ctx context.Context) error {
+			return handler.DeleteCertificate(ctx, host)
+		})
+	})
+}
@@ -0,0 +1,425 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/common"
+	v1 "github.com/openshift/api/route/v1"
+)
+
+// compositeMember is a provider of composite provider
+type compositeMember struct {
+	name     string
+	provider ContextProviderInterface
+	// declarative is set instead of provider in declarative composite provider
+	declarative DeclarativeProviderInterface
+	// required members fail the operation, errors of best effort members are only reported
+	required bool
+}
+
+// compositeProvider forwards every operation to several providers in order
+type compositeProvider struct {
+	members  []compositeMember
+	reporter common.ErrorReporter
+	// lock protects skipped
+	lock sync.Mutex
+	// skipped contains best effort members whose PreUpdate failed, they are skipped until next PreUpdate
+	skipped map[string]bool
+}
+
+// NewCompositeProvider returns provider which forwards operations to providers by name. Errors of
+// best effort providers are reported but they do not fail the operation.
+func NewCompositeProvider(names []string, bestEffort []string) (ContextProviderInterface, error) {
+	return newCompositeProvider(names, bestEffort, func(m *compositeMember) bool {
+		m.provider = getProvider(m.name)
+		return m.provider != nil
+	})
+}
+
+// newCompositeProvider returns composite provider whose members are looked up by name using find
+func newCompositeProvider(names []string, bestEffort []string, find func(m *compositeMember) bool) (*compositeProvider, error) {
+	optional := map[string]bool{}
+	for _, name := range bestEffort {
+		optional[strings.TrimSpace(name)] = true
+	}
+	c := &compositeProvider{
+		reporter: common.NewLogReporter(),
+		skipped:  map[string]bool{},
+	}
+	for _, name := range names {
+		m := compositeMember{name: strings.TrimSpace(name), required: !optional[strings.TrimSpace(name)]}
+		if !find(&m) {
+			return nil, fmt.Errorf("provider %q not found", m.name)
+		}
+		c.members = append(c.members, m)
+	}
+	return c, nil
+}
+
+// each executes fn for every member in order. Errors of required members are returned
+func (c *compositeProvider) each(operation string, fn func(m compositeMember) error) error {
+	c.lock.Lock()
+	skipped := c.skipped
+	c.lock.Unlock()
+	errs := []string{}
+	// combined error is permanent only if all errors are permanent
+	permanent := true
+	for _, m := range c.members {
+		if skipped[m.name] {
+			continue
+		}
+		err := fn(m)
+		if err == nil {
+			continue
+		}
+		if m.required {
+			errs = append(errs, fmt.Sprintf("%s: %v", m.name, err))
+			permanent = permanent && IsPermanent(err)
+			continue
+		}
+		log.Printf("best effort provider %s %s failed: %v", m.name, operation, err)
+		c.reporter.CaptureError(err, map[string]string{"provider": m.name, "operation": operation})
+	}
+	if len(errs) > 0 {
+		err := fmt.Errorf("%s", strings.Join(errs, ", "))
+		if permanent {
+			return Permanent(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// Initialize initilizes all providers
+func (c *compositeProvider) Initialize() {
+	for _, m := range c.members {
+		m.provider.Initialize()
+	}
+}
+
+// SetReporter sets error reporter to all providers
+func (c *compositeProvider) SetReporter(reporter common.ErrorReporter) {
+	c.reporter = reporter
+	for _, m := range c.members {
+		m.provider.SetReporter(common.WithTags(reporter, map[string]string{"provider": m.name}))
+	}
+}
+
+// CreatePool creates new loadbalancer pool
+func (c *compositeProvider) CreatePool(ctx context.Context, name string, port string) error {
+	return c.each("CreatePool", func(m compositeMember) error {
+		return m.provider.CreatePool(ctx, name, port)
+	})
+}
+
+// AddPoolMember adds new member to pool
+func (c *compositeProvider) AddPoolMember(ctx context.Context, membername string, name string, port string) error {
+	return c.each("AddPoolMember", func(m compositeMember) error {
+		return m.provider.AddPoolMember(ctx, membername, name, port)
+	})
+}
+
+// ModifyPool modifies loadbalancer pool
+func (c *compositeProvider) ModifyPool(ctx context.Context, name string, port string, loadBalancingMethod string, pga int, maintenance bool, prio int, role string, settings MemberSettings) error {
+	return c.each("ModifyPool", func(m compositeMember) error {
+		return m.provider.ModifyPool(ctx, name, port, loadBalancingMethod, pga, maintenance, prio, role, settings)
+	})
+}
+
+// CreateMonitor creates new monitor
+func (c *compositeProvider) CreateMonitor(ctx context.Context, host string, port string, uri string, httpMethod string, interval int, timeout int) error {
+	return c.each("CreateMonitor", func(m compositeMember) error {
+		return m.provider.CreateMonitor(ctx, host, port, uri, httpMethod, interval, timeout)
+	})
+}
+
+// ModifyMonitor modifies monitor
+func (c *compositeProvider) ModifyMonitor(ctx context.Context, host string, port string, uri string, httpMethod string, interval int, timeout int) error {
+	return c.each("ModifyMonitor", func(m compositeMember) error {
+		return m.provider.ModifyMonitor(ctx, host, port, uri, httpMethod, interval, timeout)
+	})
+}
+
+// AddMonitorToPool adds monitor to pool
+func (c *compositeProvider) AddMonitorToPool(ctx context.Context, name string, port string) error {
+	return c.each("AddMonitorToPool", func(m compositeMember) error {
+		return m.provider.AddMonitorToPool(ctx, name, port)
+	})
+}
+
+// DeletePoolMember deletes pool member
+func (c *compositeProvider) DeletePoolMember(ctx context.Context, membername string, name string, port string) error {
+	return c.each("DeletePoolMember", func(m compositeMember) error {
+		return m.provider.DeletePoolMember(ctx, membername, name, port)
+	})
+}
+
+// CheckAndClean checks pool members and if 0 members left in pool, delete monitor and delete pool
+func (c *compositeProvider) CheckAndClean(ctx context.Context, name string, port string) error {
+	return c.each("CheckAndClean", func(m compositeMember) error {
+		return m.provider.CheckAndClean(ctx, name, port)
+	})
+}
+
+// PreUpdate executes PreUpdate of all providers. Best effort providers which fail are skipped until next PreUpdate
+func (c *compositeProvider) PreUpdate(ctx context.Context) error {
+	return c.preUpdate(func(m compositeMember) error {
+		return m.provider.PreUpdate(ctx)
+	})
+}
+
+// preUpdate executes fn for all members, best effort members which fail are skipped until next preUpdate
+func (c *compositeProvider) preUpdate(fn func(m compositeMember) error) error {
+	c.lock.Lock()
+	c.skipped = map[string]bool{}
+	c.lock.Unlock()
+	skipped := map[string]bool{}
+	err := c.each("PreUpdate", func(m compositeMember) error {
+		err := fn(m)
+		if err != nil && !m.required {
+			skipped[m.name] = true
+		}
+		return err
+	})
+	c.lock.Lock()
+	c.skipped = skipped
+	c.lock.Unlock()
+	return err
+}
+
+// PostUpdate executes PostUpdate of all providers
+func (c *compositeProvider) PostUpdate(ctx context.Context) error {
+	return c.each("PostUpdate", func(m compositeMember) error {
+		return m.provider.PostUpdate(ctx)
+	})
+}
+
+// CheckPools returns hosts which should be removed from any of the providers
+func (c *compositeProvider) CheckPools(ctx context.Context, routes []v1.Route, hosttowatch string, membername string) (map[string]bool, error) {
+	var lock sync.Mutex
+	hosts := map[string]bool{}
+	err := c.each("CheckPools", func(m compositeMember) error {
+		result, err := m.provider.CheckPools(ctx, routes, hosttowatch, membername)
+		lock.Lock()
+		defer lock.Unlock()
+		for host, remove := range result {
+			if remove {
+				hosts[host] = true
+			}
+		}
+		return err
+	})
+	return hosts, err
+}
+
+// SetCertificate installs certificate to providers which handle certificates
+func (c *compositeProvider) SetCertificate(ctx context.Context, host string, certificate Certificate) error {
+	return c.each("SetCertificate", func(m compositeMember) error {
+		if handler := certificateHandler(m.provider); handler != nil {
+			return handler.SetCertificate(ctx, host, certificate)
+		}
+		return nil
+	})
+}
+
+// DeleteCertificate removes certificate from providers which handle certificates
+func (c *compositeProvider) DeleteCertificate(ctx context.Context, host string) error {
+	return c.each("DeleteCertificate", func(m compositeMember) error {
+		if handler := certificateHandler(m.provider); handler != nil {
+			return handler.DeleteCertificate(ctx, host)
+		}
+		return nil
+	})
+}
+
+// SetMemberAddresses sets router addresses to providers which manage members
+func (c *compositeProvider) SetMemberAddresses(ctx context.Context, membername string, addresses []string) error {
+	return c.each("SetMemberAddresses", func(m compositeMember) error {
+		if handler := memberHandler(m.provider); handler != nil {
+			return handler.SetMemberAddresses(ctx, membername, addresses)
+		}
+		return nil
+	})
+}
+
+// Synced notifies providers which wait for the initial routes
+func (c *compositeProvider) Synced(ctx context.Context) error {
+	return c.each("Synced", func(m compositeMember) error {
+		if handler := syncHandler(m.provider); handler != nil {
+			return handler.Synced(ctx)
+		}
+		return nil
+	})
+}
+
+// Calls returns method calls of all providers
+func (c *compositeProvider) Calls() []string {
+	calls := []string{}
+	for _, m := range c.members {
+		calls = append(calls, m.provider.Calls()...)
+	}
+	return calls
+}
+
+// CleanCalls cleans calls of all providers
+func (c *compositeProvider) CleanCalls() {
+	for _, m := range c.members {
+		m.provider.CleanCalls()
+	}
+}
+
+// declarativeComposite forwards desired state of hosts to several providers in order. Providers which
+// receive single operations are wrapped with declarativeAdapter.
+type declarativeComposite struct {
+	composite *compositeProvider
+}
+
+// NewDeclarativeCompositeProvider returns declarative provider which forwards operations to declarative
+// and other providers by name. Errors of best effort providers are reported but they do not fail the operation.
+func NewDeclarativeCompositeProvider(names []string, bestEffort []string) (DeclarativeProviderInterface, error) {
+	composite, err := newCompositeProvider(names, bestEffort, func(m *compositeMember) bool {
+		if declarative := getDeclarativeProvider(m.name); declarative != nil {
+			m.declarative = declarative
+		} else if provider := getProvider(m.name); provider != nil {
+			m.declarative = NewDeclarativeAdapter(provider)
+		}
+		return m.declarative != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &declarativeComposite{composite: composite}, nil
+}
+
+// Initialize initilizes all providers
+func (d *declarativeComposite) Initialize() {
+	for _, m := range d.composite.members {
+		m.declarative.Initialize()
+	}
+}
+
+// SetReporter sets error reporter to all providers
+func (d *declarativeComposite) SetReporter(reporter common.ErrorReporter) {
+	d.composite.reporter = reporter
+	for _, m := range d.composite.members {
+		m.declarative.SetReporter(common.WithTags(reporter, map[string]string{"provider": m.name}))
+	}
+}
+
+// Apply makes lb configuration of the host to match state in all providers
+func (d *declarativeComposite) Apply(ctx context.Context, state HostState) error {
+	return d.composite.each("Apply", func(m compositeMember) error {
+		return m.declarative.Apply(ctx, state)
+	})
+}
+
+// Remove removes member from the host in all providers
+func (d *declarativeComposite) Remove(ctx context.Context, host string, membername string) error {
+	return d.composite.each("Remove", func(m compositeMember) error {
+		return m.declarative.Remove(ctx, host, membername)
+	})
+}
+
+// ListHosts returns hosts which have membername as member in any of the providers
+func (d *declarativeComposite) ListHosts(ctx context.Context, membername string) ([]string, error) {
+	found := map[string]bool{}
+	hosts := []string{}
+	err := d.composite.each("ListHosts", func(m compositeMember) error {
+		result, err := m.declarative.ListHosts(ctx, membername)
+		for _, host := range result {
+			if !found[host] {
+				found[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+		return err
+	})
+	return hosts, err
+}
+
+// PreUpdate executes PreUpdate of providers which implement UpdateHooks. Best effort providers which
+// fail are skipped until next PreUpdate
+func (d *declarativeComposite) PreUpdate(ctx context.Context) error {
+	return d.composite.preUpdate(func(m compositeMember) error {
+		if hooks, ok := m.declarative.(UpdateHooks); ok {
+			return hooks.PreUpdate(ctx)
+		}
+		return nil
+	})
+}
+
+// PostUpdate executes PostUpdate of providers which implement UpdateHooks
+func (d *declarativeComposite) PostUpdate(ctx context.Context) error {
+	return d.composite.each("PostUpdate", func(m compositeMember) error {
+		if hooks, ok := m.declarative.(UpdateHooks); ok {
+			return hooks.PostUpdate(ctx)
+		}
+		return nil
+	})
+}
+
+// SetCertificate installs certificate to providers which handle certificates
+func (d *declarativeComposite) SetCertificate(ctx context.Context, host string, certificate Certificate) error {
+	return d.composite.each("SetCertificate", func(m compositeMember) error {
+		if handler := certificateHandler(m.declarative); handler != nil {
+			return handler.SetCertificate(ctx, host, certificate)
+		}
+		return nil
+	})
+}
+
+// DeleteCertificate removes certificate from providers which handle certificates
+func (d *declarativeComposite) DeleteCertificate(ctx context.Context, host string) error {
+	return d.composite.each("DeleteCertificate", func(m compositeMember) error {
+		if handler := certificateHandler(m.declarative); handler != nil {
+			return handler.DeleteCertificate(ctx, host)
+		}
+		return nil
+	})
+}
+
+// SetMemberAddresses sets router addresses to providers which manage members
+func (d *declarativeComposite) SetMemberAddresses(ctx context.Context, membername string, addresses []string) error {
+	return d.composite.each("SetMemberAddresses", func(m compositeMember) error {
+		if handler := memberHandler(m.declarative); handler != nil {
+			return handler.SetMemberAddresses(ctx, membername, addresses)
+		}
+		return nil
+	})
+}
+
+// Synced notifies providers which wait for the initial routes
+func (d *declarativeComposite) Synced(ctx context.Context) error {
+	return d.composite.each("Synced", func(m compositeMember) error {
+		if handler := syncHandler(m.declarative); handler != nil {
+			return handler.Synced(ctx)
+		}
+		return nil
+	})
+}
+
+// Calls returns method calls of all providers
+func (d *declarativeComposite) Calls() []string {
+	calls := []string{}
+	for _, m := range d.composite.members {
+		calls = append(calls, m.declarative.Calls()...)
+	}
+	return calls
+}
+
+// CleanCalls cleans calls of all providers
+func (d *declarativeComposite) CleanCalls() {
+	for _, m := range d.composite.members {
+		m.declarative.CleanCalls()
+	}
+}
@@ -7,6 +7,7 @@ SPDX-License-Identifier: Apache-2.0
 package controller
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -14,10 +15,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ElisaOyj/openshift-lb-controller/pkg/common"
-	"github.com/getsentry/raven-go"
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/dnsupdate"
 	v1r "github.com/openshift/api/route/v1"
 	routev1 "github.com/openshift/client-go/route/clientset/versioned/typed/route/v1"
 	"k8s.io/api/core/v1"
@@ -40,6 +42,14 @@ const (
 	CustomHostAnnotation = "route.elisa.fi/lbenabled"
 
 	maintenanceAnnotation = "route.elisa.fi/maintenance"
+
+	ratioAnnotation           = "route.elisa.fi/ratio"
+	connectionLimitAnnotation = "route.elisa.fi/connectionlimit"
+	slowRampAnnotation        = "route.elisa.fi/slowramp"
+
+	defaultPrio          = 1
+	defaultRetries       = 2
+	defaultRetryInterval = 2 * time.Second
 )
 
 // RouteController watches the kubernetes api for changes to routes
@@ -49,8 +59,28 @@ type RouteController struct {
 	routeclient   *routev1.RouteV1Client
 	hosttowatch   string
 	clusteralias  string
-	provider      ProviderInterface
-	partition     string
+	provider      ContextProviderInterface
+	declarative   DeclarativeProviderInterface
+	dns           DNSInterface
+	getSecret     func(namespace string, name string) (*v1.Secret, error)
+	certificates  certificates
+	routers       routers
+	// routerInformer watches endpoints of ROUTER_SERVICE, nil if it is not set
+	routerInformer cache.SharedIndexInformer
+	// routerAddresses are set to the lb at startup if ROUTER_SERVICE is not set
+	routerAddresses []string
+	partition       string
+	clusterPrio     int
+	routeRoles      Roles
+	reporter        common.ErrorReporter
+	timeouts        Timeouts
+	retries         int
+	retryInterval   time.Duration
+	ctx             context.Context
+	cancel          context.CancelFunc
+	batch           batch
+	// routesAdded counts add events of routes, it is used to detect when initial routes are processed
+	routesAdded int64
 }
 
 // Run starts the process for listening for route changes and acting upon those changes.
@@ -60,14 +90,29 @@ func (c *RouteController) Run(stopCh <-chan struct{}, wg *sync.WaitGroup) {
 
 	// Execute go function
 	go c.routeInformer.Run(stopCh)
+	if handler := c.syncHandler(); handler != nil {
+		go c.notifySynced(stopCh, handler)
+	}
+	if c.routerInformer != nil {
+		go c.routerInformer.Run(stopCh)
+	} else if len(c.routerAddresses) > 0 {
+		c.setRouterAddresses(c.routerAddresses)
+	}
 
 	// Wait till we receive a stop signal
 	<-stopCh
+	// execute changes which are still waiting for the batch window
+	c.flush()
+	// cancel provider operations which are still running
+	c.cancel()
 }
 
 // NewRouteController creates a new RouteController
-func NewRouteController(kclient *kubernetes.Clientset, config *restclient.Config) *RouteController {
-	routeWatcher := &RouteController{}
+func NewRouteController(kclient *kubernetes.Clientset, config *restclient.Config, reporter common.ErrorReporter) *RouteController {
+	routeWatcher := &RouteController{
+		reporter: reporter,
+	}
+	routeWatcher.ctx, routeWatcher.cancel = context.WithCancel(context.Background())
 
 	routeV1Client, err := routev1.NewForConfig(config)
 	if err != nil {
@@ -95,33 +140,95 @@ func NewRouteController(kclient *kubernetes.Clientset, config *restclient.Config
 	})
 
 	routeWatcher.kclient = kclient
+	routeWatcher.getSecret = func(namespace string, name string) (*v1.Secret, error) {
+		return kclient.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	}
 	routeWatcher.routeclient = routeV1Client
 	routeWatcher.routeInformer = routeInformer
 
 	host := os.Getenv("SUFFIXHOST")
 	if len(host) == 0 {
 		err := errors.New("SUFFIXHOST environment variable needed")
-		if common.SentryEnabled() {
-			raven.CaptureErrorAndWait(err, nil)
-		}
+		routeWatcher.reporter.CaptureErrorAndWait(err, nil)
 		panic(err)
 	}
 	routeWatcher.hosttowatch = host
 	clustername := os.Getenv("CLUSTERALIAS")
 	if len(clustername) == 0 {
 		err := errors.New("CLUSTERALIAS environment variable needed")
-		if common.SentryEnabled() {
-			raven.CaptureErrorAndWait(err, nil)
-		}
+		routeWatcher.reporter.CaptureErrorAndWait(err, nil)
 		panic(err)
 	}
 	routeWatcher.clusteralias = clustername
+	timeouts, err := ParseTimeouts(os.Getenv("PROVIDER_TIMEOUT"), os.Getenv("PROVIDER_OPERATION_TIMEOUTS"))
+	if err != nil {
+		routeWatcher.reporter.CaptureErrorAndWait(err, nil)
+		panic(err)
+	}
+	routeWatcher.timeouts = timeouts
+	routeWatcher.retries = defaultRetries
+	if value := os.Getenv("PROVIDER_RETRIES"); len(value) > 0 {
+		retries, err := strconv.Atoi(value)
+		if err != nil {
+			err = fmt.Errorf("invalid PROVIDER_RETRIES %q: %v", value, err)
+			routeWatcher.reporter.CaptureErrorAndWait(err, nil)
+			panic(err)
+		}
+		routeWatcher.retries = retries
+	}
+	routeWatcher.retryInterval = defaultRetryInterval
+	routeWatcher.batch.window = defaultBatchWindow
+	if value := os.Getenv("PROVIDER_BATCH_WINDOW"); len(value) > 0 {
+		window, err := time.ParseDuration(value)
+		if err != nil {
+			err = fmt.Errorf("invalid PROVIDER_BATCH_WINDOW %q: %v", value, err)
+			routeWatcher.reporter.CaptureErrorAndWait(err, nil)
+			panic(err)
+		}
+		routeWatcher.batch.window = window
+	}
+	routeWatcher.batch.workers = 1
+	if value := os.Getenv("PROVIDER_WORKERS"); len(value) > 0 {
+		workers, err := strconv.Atoi(value)
+		if err != nil || workers < 1 {
+			err = fmt.Errorf("invalid PROVIDER_WORKERS %q, expected positive integer", value)
+			routeWatcher.reporter.CaptureErrorAndWait(err, nil)
+			panic(err)
+		}
+		routeWatcher.batch.workers = workers
+	}
+	if value := os.Getenv("CLUSTER_PRIO"); len(value) > 0 {
+		prio, err := strconv.Atoi(value)
+		if err != nil || prio < 1 {
+			err = fmt.Errorf("invalid CLUSTER_PRIO %q, expected positive integer", value)
+			routeWatcher.reporter.CaptureErrorAndWait(err, nil)
+			panic(err)
+		}
+		routeWatcher.clusterPrio = prio
+	}
+	routeWatcher.routeRoles, err = ParseRoles(os.Getenv("ROLES"))
+	if err != nil {
+		routeWatcher.reporter.CaptureErrorAndWait(err, nil)
+		panic(err)
+	}
+	if service := os.Getenv("ROUTER_SERVICE"); len(service) > 0 {
+		routeWatcher.routerInformer, err = routeWatcher.newRouterInformer(service)
+		if err != nil {
+			routeWatcher.reporter.CaptureErrorAndWait(err, nil)
+			panic(err)
+		}
+	} else if value := os.Getenv("ROUTER_ADDRESSES"); len(value) > 0 {
+		routeWatcher.routerAddresses, err = parseRouterAddresses(value)
+		if err != nil {
+			routeWatcher.reporter.CaptureErrorAndWait(err, nil)
+			panic(err)
+		}
+	}
 	provider := routeWatcher.InitProvider()
-	if provider == nil {
+	declarative := routeWatcher.InitDeclarativeProvider()
+	if provider == nil && declarative == nil {
 		err := errors.New("Could not find working LB provider")
-		if common.SentryEnabled() {
-			raven.CaptureErrorAndWait(err, nil)
-		}
+		routeWatcher.reporter.CaptureErrorAndWait(err, nil)
 		panic(err)
 	}
 
@@ -129,8 +236,30 @@ func NewRouteController(kclient *kubernetes.Clientset, config *restclient.Config
 	if len(partition) > 0 {
 		routeWatcher.partition = partition
 	}
-	routeWatcher.provider = provider
-	routeWatcher.provider.Initialize()
+	routeWatcher.reporter = common.WithTags(reporter, map[string]string{
+		"clusteralias": routeWatcher.clusteralias,
+		"partition":    routeWatcher.partition,
+	})
+	providerReporter := common.WithTags(routeWatcher.reporter, map[string]string{
+		"provider": strings.ToLower(os.Getenv("PROVIDER")),
+	})
+	if declarative != nil {
+		routeWatcher.declarative = declarative
+		routeWatcher.declarative.SetReporter(providerReporter)
+		routeWatcher.declarative.Initialize()
+	} else {
+		routeWatcher.provider = provider
+		routeWatcher.provider.SetReporter(providerReporter)
+		routeWatcher.provider.Initialize()
+	}
+	if len(os.Getenv("DNS_SERVER")) > 0 {
+		updater, err := dnsupdate.NewFromEnv()
+		if err != nil {
+			routeWatcher.reporter.CaptureErrorAndWait(err, nil)
+			panic(err)
+		}
+		routeWatcher.dns = updater
+	}
 	routeWatcher.cleanUp()
 	return routeWatcher
 }
@@ -144,128 +273,180 @@ func (c *RouteController) cleanUp() {
 		log.Printf("error fetching routes %v", err)
 		return
 	}
-	poolsToBeRemoved := c.provider.CheckPools(routes.Items, c.hosttowatch, c.clusteralias)
+	if c.declarative != nil {
+		hostsToBeRemoved, err := c.declarativeHostsToBeRemoved(routes.Items)
+		if err != nil {
+			c.reportError("ListHosts", "", err)
+			return
+		}
+		for host := range hostsToBeRemoved {
+			c.removeHost(host)
+		}
+		return
+	}
+	ctx, cancel := c.operationContext("CheckPools")
+	defer cancel()
+	poolsToBeRemoved, err := c.provider.CheckPools(ctx, routes.Items, c.hosttowatch, c.clusteralias)
+	if err != nil {
+		c.reportError("CheckPools", "", err)
+		return
+	}
 	for host := range poolsToBeRemoved {
 		c.checkExternalLBDoesNotExists(host)
 	}
 }
 
-func (c *RouteController) checkExternalLBDoesExists(host string, uri string, httpMethod string, loadBalancingMethod string, pga int, maintenance bool, prio int, role string) {
-	c.provider.PreUpdate()
-	err := c.provider.CreatePool(host, "80")
-	if err != nil {
-		msg := fmt.Sprintf("Error in CreatePool %s: %v", host, err)
-		if common.SentryEnabled() {
-			raven.CaptureMessage(msg, map[string]string{"host": host})
-		}
-		log.Printf(msg)
-	}
-	err = c.provider.CreatePool(host, "443")
-	if err != nil {
-		msg := fmt.Sprintf("Error in CreatePool %s: %v", host, err)
-		if common.SentryEnabled() {
-			raven.CaptureMessage(msg, map[string]string{"host": host})
-		}
-		log.Printf(msg)
-	}
+// reportError reports failed provider operation for host
+func (c *RouteController) reportError(operation string, host string, err error) {
+	msg := fmt.Sprintf("Error in %s %s: %v", operation, host, err)
+	c.reporter.CaptureMessage(msg, map[string]string{"host": host, "operation": operation})
+}
 
-	err = c.provider.AddPoolMember(c.clusteralias, host, "80")
+// call executes provider operation using operation timeout. Failed operation is retried with
+// increasing interval and same OperationID, unless the error is permanent. The error is reported if
+// all attempts fail
+func (c *RouteController) call(operation string, host string, fn func(ctx context.Context) error) error {
+	id, err := newOperationID()
 	if err != nil {
-		msg := fmt.Sprintf("Error in AddPoolMember %s: %v", host, err)
-		if common.SentryEnabled() {
-			raven.CaptureMessage(msg, map[string]string{"host": host})
+		// provider generates own id
+		log.Printf("%v", err)
+	}
+	err = c.callOnce(id, operation, fn)
+	interval := c.retryInterval
+	for attempt := 1; err != nil && !IsPermanent(err) && attempt <= c.retries; attempt++ {
+		log.Printf("retrying %s %s in %v, attempt %d/%d: %v", operation, host, interval, attempt, c.retries, err)
+		if !c.wait(interval) {
+			break
 		}
-		log.Printf(msg)
+		err = c.callOnce(id, operation, fn)
+		interval *= 2
 	}
-	err = c.provider.AddPoolMember(c.clusteralias, host, "443")
 	if err != nil {
-		msg := fmt.Sprintf("Error in AddPoolMember %s: %v", host, err)
-		if common.SentryEnabled() {
-			raven.CaptureMessage(msg, map[string]string{"host": host})
-		}
-		log.Printf(msg)
+		c.reportError(operation, host, err)
 	}
+	return err
+}
 
-	err = c.provider.ModifyPool(host, "80", loadBalancingMethod, pga, maintenance, prio, role)
-	if err != nil {
-		msg := fmt.Sprintf("Error in ModifyPool %s: %v", host, err)
-		if common.SentryEnabled() {
-			raven.CaptureMessage(msg, map[string]string{"host": host})
-		}
-		log.Printf(msg)
+func (c *RouteController) callOnce(id string, operation string, fn func(ctx context.Context) error) error {
+	ctx, cancel := c.operationContext(operation)
+	defer cancel()
+	return fn(WithOperationID(ctx, id))
+}
+
+// wait sleeps given duration, returns false if the controller is stopped before that
+func (c *RouteController) wait(duration time.Duration) bool {
+	if c.ctx == nil {
+		time.Sleep(duration)
+		return true
 	}
-	err = c.provider.ModifyPool(host, "443", loadBalancingMethod, pga, maintenance, prio, role)
-	if err != nil {
-		msg := fmt.Sprintf("Error in ModifyPool %s: %v", host, err)
-		if common.SentryEnabled() {
-			raven.CaptureMessage(msg, map[string]string{"host": host})
-		}
-		log.Printf(msg)
+	select {
+	case <-time.After(duration):
+		return true
+	case <-c.ctx.Done():
+		return false
 	}
+}
 
-	err = c.provider.CreateMonitor(host, "80", uri, httpMethod, 3, 10)
-	if err != nil {
-		msg := fmt.Sprintf("Error in CreateMonitor %s: %v", host, err)
-		if common.SentryEnabled() {
-			raven.CaptureMessage(msg, map[string]string{"host": host})
-		}
-		log.Printf(msg)
+func (c *RouteController) checkExternalLBDoesExists(host string, uri string, httpMethod string, loadBalancingMethod string, pga int, maintenance bool, prio int, role string, settings MemberSettings) {
+	if c.declarative != nil {
+		c.applyHost(c.newHostState(host, uri, httpMethod, loadBalancingMethod, pga, maintenance, prio, role, settings))
+		c.addDNS(host)
+		return
 	}
-	err = c.provider.CreateMonitor(host, "443", uri, httpMethod, 3, 10)
-	if err != nil {
-		msg := fmt.Sprintf("Error in CreateMonitor %s: %v", host, err)
-		if common.SentryEnabled() {
-			raven.CaptureMessage(msg, map[string]string{"host": host})
-		}
-		log.Printf(msg)
+	c.enqueue(host, func() {
+		c.call("CreatePool", host, func(ctx context.Context) error {
+			return c.provider.CreatePool(ctx, host, "80")
+		})
+		c.call("CreatePool", host, func(ctx context.Context) error {
+			return c.provider.CreatePool(ctx, host, "443")
+		})
+
+		c.call("AddPoolMember", host, func(ctx context.Context) error {
+			return c.provider.AddPoolMember(ctx, c.clusteralias, host, "80")
+		})
+		c.call("AddPoolMember", host, func(ctx context.Context) error {
+			return c.provider.AddPoolMember(ctx, c.clusteralias, host, "443")
+		})
+
+		c.call("ModifyPool", host, func(ctx context.Context) error {
+			return c.provider.ModifyPool(ctx, host, "80", loadBalancingMethod, pga, maintenance, prio, role, settings)
+		})
+		c.call("ModifyPool", host, func(ctx context.Context) error {
+			return c.provider.ModifyPool(ctx, host, "443", loadBalancingMethod, pga, maintenance, prio, role, settings)
+		})
+
+		c.call("CreateMonitor", host, func(ctx context.Context) error {
+			return c.provider.CreateMonitor(ctx, host, "80", uri, httpMethod, 3, 10)
+		})
+		c.call("CreateMonitor", host, func(ctx context.Context) error {
+			return c.provider.CreateMonitor(ctx, host, "443", uri, httpMethod, 3, 10)
+		})
+
+		c.call("AddMonitorToPool", host, func(ctx context.Context) error {
+			return c.provider.AddMonitorToPool(ctx, host, "80")
+		})
+		c.call("AddMonitorToPool", host, func(ctx context.Context) error {
+			return c.provider.AddMonitorToPool(ctx, host, "443")
+		})
+		log.Printf("add external lb configuration host: %s to clusteralias: %s", host, c.clusteralias)
+	})
+	c.addDNS(host)
+}
+
+func (c *RouteController) checkExternalLBDoesNotExists(host string) {
+	c.removeDNS(host)
+	c.removeCertificate(host)
+	if c.declarative != nil {
+		c.removeHost(host)
+		return
 	}
+	c.enqueue(host, func() {
+		c.call("DeletePoolMember", host, func(ctx context.Context) error {
+			return c.provider.DeletePoolMember(ctx, c.clusteralias, host, "80")
+		})
+		c.call("DeletePoolMember", host, func(ctx context.Context) error {
+			return c.provider.DeletePoolMember(ctx, c.clusteralias, host, "443")
+		})
+
+		// if 0 members left in pool, cleanup monitor and delete pool
+		c.call("CheckAndClean", host, func(ctx context.Context) error {
+			return c.provider.CheckAndClean(ctx, host, "80")
+		})
+		c.call("CheckAndClean", host, func(ctx context.Context) error {
+			return c.provider.CheckAndClean(ctx, host, "443")
+		})
+		log.Printf("delete external lb configuration host: %s from clusteralias: %s", host, c.clusteralias)
+	})
+}
 
-	err = c.provider.AddMonitorToPool(host, "80")
-	if err != nil {
-		msg := fmt.Sprintf("Error in AddMonitorToPool %s: %v", host, err)
-		if common.SentryEnabled() {
-			raven.CaptureMessage(msg, map[string]string{"host": host})
-		}
-		log.Printf(msg)
+// addDNS points dns records of custom host to the lb after lb configuration
+func (c *RouteController) addDNS(host string) {
+	if c.dns == nil || strings.HasSuffix(host, c.hosttowatch) {
+		return
 	}
-	err = c.provider.AddMonitorToPool(host, "443")
-	if err != nil {
-		msg := fmt.Sprintf("Error in AddMonitorToPool %s: %v", host, err)
-		if common.SentryEnabled() {
-			raven.CaptureMessage(msg, map[string]string{"host": host})
+	c.enqueue(host, func() {
+		err := c.call("AddDNS", host, func(ctx context.Context) error {
+			return c.dns.AddHost(ctx, host, c.clusteralias)
+		})
+		if err == nil {
+			log.Printf("add dns records host: %s to clusteralias: %s", host, c.clusteralias)
 		}
-		log.Printf(msg)
-	}
-
-	c.provider.PostUpdate()
-	log.Printf("add external lb configuration host: %s to clusteralias: %s", host, c.clusteralias)
+	})
 }
 
-func (c *RouteController) checkExternalLBDoesNotExists(host string) {
-	c.provider.PreUpdate()
-	err := c.provider.DeletePoolMember(c.clusteralias, host, "80")
-	if err != nil {
-		msg := fmt.Sprintf("Error in DeletePoolMember %s: %v", host, err)
-		if common.SentryEnabled() {
-			raven.CaptureMessage(msg, map[string]string{"host": host})
-		}
-		log.Printf(msg)
+// removeDNS removes dns records of custom host before removing lb configuration
+func (c *RouteController) removeDNS(host string) {
+	if c.dns == nil || strings.HasSuffix(host, c.hosttowatch) {
+		return
 	}
-	err = c.provider.DeletePoolMember(c.clusteralias, host, "443")
-	if err != nil {
-		msg := fmt.Sprintf("Error in DeletePoolMember %s: %v", host, err)
-		if common.SentryEnabled() {
-			raven.CaptureMessage(msg, map[string]string{"host": host})
+	c.enqueue(host, func() {
+		err := c.call("RemoveDNS", host, func(ctx context.Context) error {
+			return c.dns.RemoveHost(ctx, host, c.clusteralias)
+		})
+		if err == nil {
+			log.Printf("delete dns records host: %s from clusteralias: %s", host, c.clusteralias)
 		}
-		log.Printf(msg)
-	}
-
-	// if 0 members left in pool, cleanup monitor and delete pool
-	c.provider.CheckAndClean(host, "80")
-	c.provider.CheckAndClean(host, "443")
-
-	c.provider.PostUpdate()
-	log.Printf("delete external lb configuration host: %s from clusteralias: %s", host, c.clusteralias)
+	})
 }
 
 func (c *RouteController) matchCustomAnnotation(dict map[string]string, key string) bool {
@@ -287,60 +468,48 @@ func (c *RouteController) updateRoute(old interface{}, obj interface{}) {
 		// if old did not have and now it has
 		if (!strings.HasSuffix(routeold.Status.Ingress[0].Host, c.hosttowatch) && strings.HasSuffix(route.Status.Ingress[0].Host, c.hosttowatch)) || (!foundold && found) {
 			// read healthcheck path
-			healthCheckPath, healthCheckMethod, loadBalancingMethod, pga, maintenance, prio, role := overrideWithAnnotation(route)
-			c.checkExternalLBDoesExists(route.Status.Ingress[0].Host, healthCheckPath, healthCheckMethod, loadBalancingMethod, pga, maintenance, prio, role)
+			healthCheckPath, healthCheckMethod, loadBalancingMethod, pga, maintenance, prio, role, settings := c.overrideWithAnnotation(route)
+			c.syncCertificate(route.Status.Ingress[0].Host, route)
+			c.checkExternalLBDoesExists(route.Status.Ingress[0].Host, healthCheckPath, healthCheckMethod, loadBalancingMethod, pga, maintenance, prio, role, settings)
 			// if old have and now it does not have
 		} else if (strings.HasSuffix(routeold.Status.Ingress[0].Host, c.hosttowatch) && !strings.HasSuffix(route.Status.Ingress[0].Host, c.hosttowatch)) || (!found && foundold) {
 			c.checkExternalLBDoesNotExists(routeold.Status.Ingress[0].Host)
 			// check annotation changes here
 		} else if strings.HasSuffix(route.Status.Ingress[0].Host, c.hosttowatch) || found {
-			healthCheckPathold, healthCheckMethodold, loadBalancingMethodold, pgaold, maintenanceold, prioold, roleold := overrideWithAnnotation(routeold)
-			healthCheckPath, healthCheckMethod, loadBalancingMethod, pga, maintenance, prio, role := overrideWithAnnotation(route)
+			c.syncCertificate(route.Status.Ingress[0].Host, route)
+			healthCheckPathold, healthCheckMethodold, loadBalancingMethodold, pgaold, maintenanceold, prioold, roleold, settingsold := c.overrideWithAnnotation(routeold)
+			healthCheckPath, healthCheckMethod, loadBalancingMethod, pga, maintenance, prio, role, settings := c.overrideWithAnnotation(route)
 			host := route.Status.Ingress[0].Host
-			update := false
-			if loadBalancingMethodold != loadBalancingMethod || pgaold != pga || roleold != role || prioold != prio || maintenanceold != maintenance || healthCheckPathold != healthCheckPath || healthCheckMethodold != healthCheckMethod {
-				c.provider.PreUpdate()
-				update = true
-			}
-			if loadBalancingMethodold != loadBalancingMethod || pgaold != pga || roleold != role || prioold != prio || maintenanceold != maintenance {
-				err := c.provider.ModifyPool(host, "80", loadBalancingMethod, pga, maintenance, prio, role)
-				if err != nil {
-					msg := fmt.Sprintf("Error in ModifyPool %s: %v", host, err)
-					if common.SentryEnabled() {
-						raven.CaptureMessage(msg, map[string]string{"host": host})
-					}
-					log.Printf(msg)
-				}
-				err = c.provider.ModifyPool(host, "443", loadBalancingMethod, pga, maintenance, prio, role)
-				if err != nil {
-					msg := fmt.Sprintf("Error in ModifyPool %s: %v", host, err)
-					if common.SentryEnabled() {
-						raven.CaptureMessage(msg, map[string]string{"host": host})
-					}
-					log.Printf(msg)
+			if c.declarative != nil {
+				state := c.newHostState(host, healthCheckPath, healthCheckMethod, loadBalancingMethod, pga, maintenance, prio, role, settings)
+				if !c.newHostState(host, healthCheckPathold, healthCheckMethodold, loadBalancingMethodold, pgaold, maintenanceold, prioold, roleold, settingsold).Equal(state) {
+					c.applyHost(state)
 				}
+				return
+			}
+			poolChanged := loadBalancingMethodold != loadBalancingMethod || pgaold != pga || roleold != role || prioold != prio || maintenanceold != maintenance || !settingsold.Equal(settings)
+			monitorChanged := healthCheckPathold != healthCheckPath || healthCheckMethodold != healthCheckMethod
+			if !poolChanged && !monitorChanged {
+				return
 			}
-			if healthCheckPathold != healthCheckPath || healthCheckMethodold != healthCheckMethod {
-				err := c.provider.ModifyMonitor(host, "80", healthCheckPath, healthCheckMethod, 3, 10)
-				if err != nil {
-					msg := fmt.Sprintf("Error in ModifyMonitor %s: %v", host, err)
-					if common.SentryEnabled() {
-						raven.CaptureMessage(msg, map[string]string{"host": host})
-					}
-					log.Printf(msg)
+			c.enqueue(host, func() {
+				if poolChanged {
+					c.call("ModifyPool", host, func(ctx context.Context) error {
+						return c.provider.ModifyPool(ctx, host, "80", loadBalancingMethod, pga, maintenance, prio, role, settings)
+					})
+					c.call("ModifyPool", host, func(ctx context.Context) error {
+						return c.provider.ModifyPool(ctx, host, "443", loadBalancingMethod, pga, maintenance, prio, role, settings)
+					})
 				}
-				err = c.provider.ModifyMonitor(host, "443", healthCheckPath, healthCheckMethod, 3, 10)
-				if err != nil {
-					msg := fmt.Sprintf("Error in ModifyMonitor %s: %v", host, err)
-					if common.SentryEnabled() {
-						raven.CaptureMessage(msg, map[string]string{"host": host})
-					}
-					log.Printf(msg)
+				if monitorChanged {
+					c.call("ModifyMonitor", host, func(ctx context.Context) error {
+						return c.provider.ModifyMonitor(ctx, host, "80", healthCheckPath, healthCheckMethod, 3, 10)
+					})
+					c.call("ModifyMonitor", host, func(ctx context.Context) error {
+						return c.provider.ModifyMonitor(ctx, host, "443", healthCheckPath, healthCheckMethod, 3, 10)
+					})
 				}
-			}
-			if update {
-				c.provider.PostUpdate()
-			}
+			})
 		}
 	}
 }
@@ -354,23 +523,29 @@ func (c *RouteController) deleteRoute(obj interface{}) {
 	}
 }
 func (c *RouteController) createRoute(obj interface{}) {
+	defer atomic.AddInt64(&c.routesAdded, 1)
 	route := obj.(*v1r.Route)
 	found := c.matchCustomAnnotation(route.Annotations, CustomHostAnnotation)
 	// has suffix what we are interested, skip others
 	if strings.HasSuffix(route.Spec.Host, c.hosttowatch) || found {
 		// read healthcheck path
-		healthCheckPath, healthCheckMethod, loadBalancingMethod, pga, maintenance, prio, role := overrideWithAnnotation(route)
-		c.checkExternalLBDoesExists(route.Spec.Host, healthCheckPath, healthCheckMethod, loadBalancingMethod, pga, maintenance, prio, role)
+		healthCheckPath, healthCheckMethod, loadBalancingMethod, pga, maintenance, prio, role, settings := c.overrideWithAnnotation(route)
+		c.syncCertificate(route.Spec.Host, route)
+		c.checkExternalLBDoesExists(route.Spec.Host, healthCheckPath, healthCheckMethod, loadBalancingMethod, pga, maintenance, prio, role, settings)
 	}
 }
 
-func overrideWithAnnotation(route *v1r.Route) (string, string, string, int, bool, int, string) {
+func (c *RouteController) overrideWithAnnotation(route *v1r.Route) (string, string, string, int, bool, int, string, MemberSettings) {
 	path := "/"
 	method := "GET"
 	lbmethod := ""
 	maintenance := false
 	pga := 0
-	prio := 1
+	// route annotation overrides priority of the cluster, role overrides both
+	prio := defaultPrio
+	if c.clusterPrio > 0 {
+		prio = c.clusterPrio
+	}
 	role := ""
 	if annotationValue, ok := route.Annotations[healthCheckPathAnnotation]; ok {
 		path = annotationValue
@@ -384,10 +559,7 @@ func overrideWithAnnotation(route *v1r.Route) (string, string, string, int, bool
 	if annotationValue, ok := route.Annotations[poolPGARouteMethodAnnotation]; ok {
 		i, err := strconv.Atoi(annotationValue)
 		if err != nil {
-			if common.SentryEnabled() {
-				raven.CaptureError(err, nil)
-			}
-			log.Println(err)
+			c.reporter.CaptureError(err, map[string]string{"route": route.Namespace + "/" + route.Name})
 		} else {
 			pga = i
 		}
@@ -398,10 +570,7 @@ func overrideWithAnnotation(route *v1r.Route) (string, string, string, int, bool
 	if annotationValue, ok := route.Annotations[overridePriorityGrpAnnotation]; ok {
 		i, err := strconv.Atoi(annotationValue)
 		if err != nil {
-			if common.SentryEnabled() {
-				raven.CaptureError(err, nil)
-			}
-			log.Println(err)
+			c.reporter.CaptureError(err, map[string]string{"route": route.Namespace + "/" + route.Name})
 		} else {
 			prio = i
 		}
@@ -409,5 +578,43 @@ func overrideWithAnnotation(route *v1r.Route) (string, string, string, int, bool
 	if annotationValue, ok := route.Annotations[roleAnnotation]; ok {
 		role = annotationValue
 	}
-	return path, method, lbmethod, pga, maintenance, prio, role
+	settings := MemberSettings{}
+	if i, ok := c.nonNegativeAnnotation(route, ratioAnnotation); ok {
+		settings.Ratio = i
+	}
+	if i, ok := c.nonNegativeAnnotation(route, connectionLimitAnnotation); ok {
+		settings.ConnectionLimit = i
+	}
+	if i, ok := c.nonNegativeAnnotation(route, slowRampAnnotation); ok {
+		settings.SlowRampTime = &i
+	}
+	if len(role) > 0 {
+		roles := c.roles()
+		if r, ok := roles.Get(role); ok {
+			prio = r.Prio
+			pga = r.PGA
+			if settings.SlowRampTime == nil {
+				slowRamp := r.SlowRampTime
+				settings.SlowRampTime = &slowRamp
+			}
+			settings.Backup = roles.Backup(r)
+		} else {
+			c.reporter.CaptureError(fmt.Errorf("unknown role %q", role), map[string]string{"route": route.Namespace + "/" + route.Name})
+		}
+	}
+	return path, method, lbmethod, pga, maintenance, prio, role, settings
+}
+
+// nonNegativeAnnotation returns value of integer annotation, false if it is not set or it is invalid. Invalid values are reported
+func (c *RouteController) nonNegativeAnnotation(route *v1r.Route, annotation string) (int, bool) {
+	annotationValue, ok := route.Annotations[annotation]
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.Atoi(annotationValue)
+	if err != nil || i < 0 {
+		c.reporter.CaptureError(fmt.Errorf("invalid %s %q, expected non-negative integer", annotation, annotationValue), map[string]string{"route": route.Namespace + "/" + route.Name})
+		return 0, false
+	}
+	return i, true
 }
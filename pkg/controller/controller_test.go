@@ -7,10 +7,19 @@ SPDX-License-Identifier: Apache-2.0
 package controller
 
 import (
+	"context"
+	"errors"
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/common"
 	fake "github.com/ElisaOyj/openshift-lb-controller/pkg/controller/providers/fakeprovider"
 	v1 "github.com/openshift/api/route/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCreate(t *testing.T) {
@@ -20,7 +29,7 @@ func TestCreate(t *testing.T) {
 	fakeRouteController.partition = "ext"
 
 	newfake := fake.NewFakeProvider()
-	fakeRouteController.provider = ProviderInterface(newfake)
+	fakeRouteController.provider = NewContextAdapter(newfake)
 
 	obj := &v1.Route{
 		Spec: v1.RouteSpec{
@@ -120,7 +129,7 @@ func TestDelete(t *testing.T) {
 	fakeRouteController.partition = "ext"
 
 	newfake := fake.NewFakeProvider()
-	fakeRouteController.provider = ProviderInterface(newfake)
+	fakeRouteController.provider = NewContextAdapter(newfake)
 
 	obj := &v1.Route{
 		Spec: v1.RouteSpec{
@@ -220,7 +229,7 @@ func TestUpdate(t *testing.T) {
 	fakeRouteController.partition = "ext"
 
 	newfake := fake.NewFakeProvider()
-	fakeRouteController.provider = ProviderInterface(newfake)
+	fakeRouteController.provider = NewContextAdapter(newfake)
 
 	obj := &v1.Route{
 		Spec: v1.RouteSpec{
@@ -545,7 +554,7 @@ func TestUpdateAnnotation(t *testing.T) {
 	fakeRouteController.partition = "ext"
 
 	newfake := fake.NewFakeProvider()
-	fakeRouteController.provider = ProviderInterface(newfake)
+	fakeRouteController.provider = NewContextAdapter(newfake)
 
 	obj := &v1.Route{
 		ObjectMeta: metav1.ObjectMeta{
@@ -829,3 +838,958 @@ func TestUpdateAnnotation(t *testing.T) {
 		t.Errorf("excepted to update maintenance")
 	}
 }
+
+func TestReportErrors(t *testing.T) {
+	fakeRouteController := &RouteController{}
+	fakeRouteController.hosttowatch = "test.com"
+	fakeRouteController.clusteralias = "dc1"
+	fakeRouteController.partition = "ext"
+
+	reporter := common.NewRecordingReporter()
+	fakeRouteController.reporter = common.WithTags(reporter, map[string]string{"clusteralias": "dc1"})
+
+	newfake := fake.NewFakeProvider()
+	newfake.FailOn("CreatePool", errors.New("pool failure"))
+	fakeRouteController.provider = NewContextAdapter(newfake)
+
+	obj := &v1.Route{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				poolPGARouteMethodAnnotation: "foo",
+			},
+		},
+		Spec: v1.RouteSpec{
+			Host: "foo.test.com",
+			To:   v1.RouteTargetReference{Name: "other"},
+			TLS:  &v1.TLSConfig{},
+		},
+		Status: v1.RouteStatus{
+			Ingress: []v1.RouteIngress{{}},
+		},
+	}
+
+	fakeRouteController.createRoute(obj)
+
+	reports := reporter.Reports()
+	if len(reports) != 3 {
+		t.Fatalf("excepted 3 reports, got %d", len(reports))
+	}
+	if reports[1].Tags["operation"] != "CreatePool" || reports[1].Tags["host"] != "foo.test.com" {
+		t.Errorf("excepted CreatePool report for host, got %v", reports[1].Tags)
+	}
+	if reports[1].Tags["clusteralias"] != "dc1" {
+		t.Errorf("excepted clusteralias tag, got %v", reports[1].Tags)
+	}
+
+	reporter.CleanReports()
+	newfake.FailOn("CreatePool", nil)
+	fakeRouteController.createRoute(obj)
+	if len(reporter.Reports()) != 1 {
+		t.Errorf("excepted only annotation report, got %v", reporter.Reports())
+	}
+}
+
+func TestOperationTimeout(t *testing.T) {
+	timeouts, err := ParseTimeouts("10ms", "PostUpdate=1s, CreatePool=20ms")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if timeouts.Get("PostUpdate") != time.Second || timeouts.Get("CreatePool") != 20*time.Millisecond || timeouts.Get("ModifyPool") != 10*time.Millisecond {
+		t.Errorf("unexpected timeouts %v", timeouts)
+	}
+	_, err = ParseTimeouts("", "PostUpdate")
+	if err == nil {
+		t.Errorf("excepted error from invalid operation timeout")
+	}
+
+	fakeRouteController := &RouteController{}
+	fakeRouteController.hosttowatch = "test.com"
+	fakeRouteController.clusteralias = "dc1"
+	fakeRouteController.partition = "ext"
+	fakeRouteController.timeouts = Timeouts{Default: 10 * time.Millisecond}
+
+	reporter := common.NewRecordingReporter()
+	fakeRouteController.reporter = reporter
+
+	newfake := fake.NewFakeProvider()
+	newfake.SetDelay(200 * time.Millisecond)
+	fakeRouteController.provider = NewContextAdapter(newfake)
+
+	obj := &v1.Route{
+		Spec: v1.RouteSpec{
+			Host: "foo.test.com",
+			To:   v1.RouteTargetReference{Name: "other"},
+		},
+	}
+
+	start := time.Now()
+	fakeRouteController.deleteRoute(obj)
+	if time.Since(start) > 150*time.Millisecond {
+		t.Errorf("excepted calls to time out")
+	}
+	// pre update times out and nothing else should be executed
+	reports := reporter.Reports()
+	if len(reports) != 1 {
+		t.Fatalf("excepted 1 report, got %d", len(reports))
+	}
+	for _, report := range reports {
+		if !strings.Contains(report.Message, context.DeadlineExceeded.Error()) {
+			t.Errorf("excepted deadline exceeded, got %s", report.Message)
+		}
+	}
+}
+
+func TestPreUpdateFailure(t *testing.T) {
+	fakeRouteController := &RouteController{}
+	fakeRouteController.hosttowatch = "test.com"
+	fakeRouteController.clusteralias = "dc1"
+	fakeRouteController.partition = "ext"
+	fakeRouteController.retries = 2
+	fakeRouteController.retryInterval = time.Millisecond
+
+	reporter := common.NewRecordingReporter()
+	fakeRouteController.reporter = reporter
+
+	newfake := fake.NewFakeProvider()
+	newfake.FailOn("PreUpdate", errors.New("no active device"))
+	fakeRouteController.provider = NewContextAdapter(newfake)
+
+	obj := &v1.Route{
+		Spec: v1.RouteSpec{
+			Host: "foo.test.com",
+			To:   v1.RouteTargetReference{Name: "other"},
+		},
+	}
+
+	fakeRouteController.batch.requeueDelay = time.Hour
+	fakeRouteController.createRoute(obj)
+	calls := fakeRouteController.provider.Calls()
+	if len(calls) != 3 {
+		t.Fatalf("excepted 3 PreUpdate calls, got %v", calls)
+	}
+	for _, call := range calls {
+		if call != "PreUpdate" {
+			t.Errorf("excepted only PreUpdate calls, got %v", calls)
+		}
+	}
+	if len(reporter.Reports()) != 1 {
+		t.Errorf("excepted 1 report, got %v", reporter.Reports())
+	}
+	fakeRouteController.provider.CleanCalls()
+	reporter.CleanReports()
+
+	// changes of the failed batch are executed before the next change
+	newfake.FailOn("PreUpdate", nil)
+	fakeRouteController.createRoute(&v1.Route{Spec: v1.RouteSpec{Host: "bar.test.com"}})
+	calls = fakeRouteController.provider.Calls()
+	if len(calls) != 22 || calls[0] != "PreUpdate" || calls[len(calls)-1] != "PostUpdate" {
+		t.Errorf("excepted both hosts in one batch, got %v", calls)
+	}
+	fakeRouteController.provider.CleanCalls()
+
+	// changes are retried with backoff when nothing else arrives
+	newfake.FailOn("PreUpdate", errors.New("no active device"))
+	fakeRouteController.batch.requeueDelay = 10 * time.Millisecond
+	fakeRouteController.retries = 0
+	fakeRouteController.createRoute(&v1.Route{Spec: v1.RouteSpec{Host: "baz.test.com"}})
+	time.Sleep(50 * time.Millisecond)
+	newfake.FailOn("PreUpdate", nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		calls = fakeRouteController.provider.Calls()
+		if len(calls) > 0 && calls[len(calls)-1] == "PostUpdate" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	calls = fakeRouteController.provider.Calls()
+	if len(calls) < 12 || calls[len(calls)-11] != "CreatePool" || calls[len(calls)-1] != "PostUpdate" {
+		t.Errorf("excepted requeued change to be executed, got %v", calls)
+	}
+	fakeRouteController.provider.CleanCalls()
+	reporter.CleanReports()
+	fakeRouteController.retries = 2
+
+	// failing clean is retried and reported, but does not prevent post update
+	newfake.FailOn("PreUpdate", nil)
+	newfake.FailOn("CheckAndClean", errors.New("pool delete failed"))
+	fakeRouteController.deleteRoute(obj)
+	calls = fakeRouteController.provider.Calls()
+	if len(calls) != 10 || calls[len(calls)-1] != "PostUpdate" {
+		t.Errorf("excepted CheckAndClean retries and PostUpdate, got %v", calls)
+	}
+	if len(reporter.Reports()) != 2 {
+		t.Errorf("excepted 2 reports, got %v", reporter.Reports())
+	}
+}
+
+func TestBatch(t *testing.T) {
+	fakeRouteController := &RouteController{}
+	fakeRouteController.hosttowatch = "test.com"
+	fakeRouteController.clusteralias = "dc1"
+	fakeRouteController.partition = "ext"
+	fakeRouteController.reporter = common.NewRecordingReporter()
+	fakeRouteController.batch.window = time.Hour
+
+	newfake := fake.NewFakeProvider()
+	fakeRouteController.provider = NewContextAdapter(newfake)
+
+	for _, host := range []string{"foo.test.com", "bar.test.com", "baz.test.com"} {
+		fakeRouteController.createRoute(&v1.Route{
+			Spec: v1.RouteSpec{
+				Host: host,
+				To:   v1.RouteTargetReference{Name: "other"},
+			},
+		})
+	}
+	if calls := newfake.Calls(); len(calls) != 0 {
+		t.Fatalf("excepted no calls before batch window ends, got %v", calls)
+	}
+
+	fakeRouteController.flush()
+	calls := newfake.Calls()
+	if len(calls) != 32 || calls[0] != "PreUpdate" || calls[31] != "PostUpdate" {
+		t.Errorf("excepted one PreUpdate and PostUpdate for the batch, got %v", calls)
+	}
+	newfake.CleanCalls()
+
+	// batch is executed when the window ends
+	fakeRouteController.batch.window = 10 * time.Millisecond
+	fakeRouteController.deleteRoute(&v1.Route{
+		Spec: v1.RouteSpec{
+			Host: "foo.test.com",
+			To:   v1.RouteTargetReference{Name: "other"},
+		},
+	})
+	time.Sleep(200 * time.Millisecond)
+	calls = newfake.Calls()
+	if len(calls) != 6 || calls[0] != "PreUpdate" || calls[5] != "PostUpdate" {
+		t.Errorf("excepted batch to be executed, got %v", calls)
+	}
+}
+
+func TestBatchWorkers(t *testing.T) {
+	fakeRouteController := &RouteController{}
+	fakeRouteController.hosttowatch = "test.com"
+	fakeRouteController.clusteralias = "dc1"
+	fakeRouteController.partition = "ext"
+	fakeRouteController.reporter = common.NewRecordingReporter()
+	fakeRouteController.batch.window = time.Hour
+	fakeRouteController.batch.workers = 4
+
+	newfake := fake.NewFakeProvider()
+	newfake.SetDelay(20 * time.Millisecond)
+	fakeRouteController.provider = NewContextAdapter(newfake)
+
+	for _, host := range []string{"a.test.com", "b.test.com", "c.test.com", "d.test.com"} {
+		fakeRouteController.createRoute(&v1.Route{
+			Spec: v1.RouteSpec{
+				Host: host,
+				To:   v1.RouteTargetReference{Name: "other"},
+			},
+		})
+	}
+
+	start := time.Now()
+	fakeRouteController.flush()
+	elapsed := time.Since(start)
+	calls := newfake.Calls()
+	if len(calls) != 42 || calls[0] != "PreUpdate" || calls[41] != "PostUpdate" {
+		t.Errorf("excepted one PreUpdate and PostUpdate for the batch, got %v", calls)
+	}
+	// sequentially 42 calls take 840ms, in parallel 12 calls
+	if elapsed > 600*time.Millisecond {
+		t.Errorf("excepted hosts to be updated in parallel, took %v", elapsed)
+	}
+}
+
+// fakeDeclarativeProvider stores applied host states in memory
+type fakeDeclarativeProvider struct {
+	calls  []string
+	states map[string]HostState
+}
+
+func newFakeDeclarativeProvider() *fakeDeclarativeProvider {
+	return &fakeDeclarativeProvider{
+		calls:  []string{},
+		states: map[string]HostState{},
+	}
+}
+
+func (f *fakeDeclarativeProvider) Initialize() {
+	f.calls = append(f.calls, "Initialize")
+}
+
+func (f *fakeDeclarativeProvider) SetReporter(reporter common.ErrorReporter) {}
+
+func (f *fakeDeclarativeProvider) Apply(ctx context.Context, state HostState) error {
+	f.calls = append(f.calls, "Apply")
+	f.states[state.Host+"/"+state.Member] = state
+	return nil
+}
+
+func (f *fakeDeclarativeProvider) Remove(ctx context.Context, host string, membername string) error {
+	f.calls = append(f.calls, "Remove")
+	delete(f.states, host+"/"+membername)
+	return nil
+}
+
+func (f *fakeDeclarativeProvider) ListHosts(ctx context.Context, membername string) ([]string, error) {
+	f.calls = append(f.calls, "ListHosts")
+	hosts := []string{}
+	for _, state := range f.states {
+		if state.Member == membername {
+			hosts = append(hosts, state.Host)
+		}
+	}
+	return hosts, nil
+}
+
+func (f *fakeDeclarativeProvider) Calls() []string {
+	return f.calls
+}
+
+func (f *fakeDeclarativeProvider) CleanCalls() {
+	f.calls = []string{}
+}
+
+func TestDeclarative(t *testing.T) {
+	fakeRouteController := &RouteController{}
+	fakeRouteController.hosttowatch = "test.com"
+	fakeRouteController.clusteralias = "dc1"
+	fakeRouteController.partition = "ext"
+
+	newfake := newFakeDeclarativeProvider()
+	fakeRouteController.declarative = newfake
+
+	obj := &v1.Route{
+		Spec: v1.RouteSpec{
+			Host: "foo.test.com",
+			To:   v1.RouteTargetReference{Name: "other"},
+		},
+		Status: v1.RouteStatus{
+			Ingress: []v1.RouteIngress{{Host: "foo.test.com"}},
+		},
+	}
+	fakeRouteController.createRoute(obj)
+	state, ok := newfake.states["foo.test.com/dc1"]
+	if !ok {
+		t.Fatalf("excepted state to be applied, got %v", newfake.calls)
+	}
+	if state.Monitor.Path != "/" || state.Monitor.Method != "GET" || state.Prio != 1 || len(state.Ports) != 2 {
+		t.Errorf("unexpected default state %v", state)
+	}
+	newfake.CleanCalls()
+
+	// nothing changed
+	fakeRouteController.updateRoute(obj, obj)
+	if len(newfake.Calls()) != 0 {
+		t.Errorf("excepted no calls, got %v", newfake.Calls())
+	}
+
+	obj2 := obj.DeepCopy()
+	obj2.Annotations = map[string]string{
+		healthCheckPathAnnotation: "/health",
+		roleAnnotation:            "active",
+	}
+	fakeRouteController.updateRoute(obj, obj2)
+	if len(newfake.Calls()) != 1 || newfake.Calls()[0] != "Apply" {
+		t.Errorf("excepted single apply, got %v", newfake.Calls())
+	}
+	state = newfake.states["foo.test.com/dc1"]
+	if state.Monitor.Path != "/health" || state.Role != "active" {
+		t.Errorf("excepted updated state, got %v", state)
+	}
+	newfake.CleanCalls()
+
+	// route removed while controller was down
+	newfake.states["bar.test.com/dc1"] = HostState{Host: "bar.test.com", Member: "dc1"}
+	newfake.states["bar.test.com/dc2"] = HostState{Host: "bar.test.com", Member: "dc2"}
+	hosts, err := fakeRouteController.declarativeHostsToBeRemoved([]v1.Route{*obj2})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(hosts) != 1 || !hosts["bar.test.com"] {
+		t.Errorf("excepted bar.test.com to be removed, got %v", hosts)
+	}
+
+	fakeRouteController.deleteRoute(obj2)
+	if _, ok := newfake.states["foo.test.com/dc1"]; ok {
+		t.Errorf("excepted state to be removed")
+	}
+}
+
+func TestCompositeProvider(t *testing.T) {
+	required := fake.NewFakeProvider()
+	bestEffort := fake.NewFakeProvider()
+	RegisterProvider("composite-required", required)
+	RegisterProvider("composite-besteffort", bestEffort)
+	composite, err := NewCompositeProvider([]string{"composite-required", " composite-besteffort"}, []string{"composite-besteffort"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, err = NewCompositeProvider([]string{"composite-required", "unknown"}, nil)
+	if err == nil {
+		t.Errorf("excepted error from unknown provider")
+	}
+
+	fakeRouteController := &RouteController{}
+	fakeRouteController.hosttowatch = "test.com"
+	fakeRouteController.clusteralias = "dc1"
+	fakeRouteController.partition = "ext"
+
+	reporter := common.NewRecordingReporter()
+	fakeRouteController.reporter = reporter
+	composite.SetReporter(reporter)
+	fakeRouteController.provider = composite
+
+	obj := &v1.Route{
+		Spec: v1.RouteSpec{
+			Host: "foo.test.com",
+			To:   v1.RouteTargetReference{Name: "other"},
+		},
+	}
+
+	// failing best effort provider is reported but other calls are executed
+	bestEffort.FailOn("CreatePool", errors.New("pool failure"))
+	fakeRouteController.createRoute(obj)
+	if len(required.Calls()) == 0 || len(required.Calls()) != len(bestEffort.Calls()) {
+		t.Errorf("excepted same calls to both providers, got %v %v", required.Calls(), bestEffort.Calls())
+	}
+	reports := reporter.Reports()
+	if len(reports) != 2 || reports[0].Tags["provider"] != "composite-besteffort" || reports[0].Tags["operation"] != "CreatePool" {
+		t.Errorf("excepted best effort CreatePool reports, got %v", reports)
+	}
+	bestEffort.FailOn("CreatePool", nil)
+	composite.CleanCalls()
+	reporter.CleanReports()
+
+	// failing required provider fails the call
+	required.FailOn("CreatePool", errors.New("pool failure"))
+	err = composite.CreatePool(context.Background(), "foo.test.com", "80")
+	if err == nil || !strings.Contains(err.Error(), "composite-required") {
+		t.Errorf("excepted error from required provider, got %v", err)
+	}
+	required.FailOn("CreatePool", nil)
+	composite.CleanCalls()
+	reporter.CleanReports()
+
+	// best effort provider is skipped after failing PreUpdate
+	bestEffort.FailOn("PreUpdate", errors.New("no active device"))
+	fakeRouteController.deleteRoute(obj)
+	if len(bestEffort.Calls()) != 1 || len(required.Calls()) < 2 {
+		t.Errorf("excepted only PreUpdate of best effort provider, got %v %v", required.Calls(), bestEffort.Calls())
+	}
+	if len(reporter.Reports()) != 1 {
+		t.Errorf("excepted 1 report, got %v", reporter.Reports())
+	}
+}
+
+func TestDeclarativeCompositeProvider(t *testing.T) {
+	declarative := newFakeDeclarativeProvider()
+	imperative := fake.NewFakeProvider()
+	RegisterDeclarativeProvider("composite-declarative", declarative)
+	RegisterProvider("composite-imperative", imperative)
+	if !hasDeclarativeProvider([]string{"composite-imperative", " composite-declarative"}) || hasDeclarativeProvider([]string{"composite-imperative"}) {
+		t.Errorf("excepted only list with declarative provider to be declarative")
+	}
+	composite, err := NewDeclarativeCompositeProvider([]string{"composite-declarative", " composite-imperative"}, []string{"composite-imperative"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, err = NewDeclarativeCompositeProvider([]string{"composite-declarative", "unknown"}, nil)
+	if err == nil {
+		t.Errorf("excepted error from unknown provider")
+	}
+
+	fakeRouteController := &RouteController{}
+	fakeRouteController.hosttowatch = "test.com"
+	fakeRouteController.clusteralias = "dc1"
+	fakeRouteController.partition = "ext"
+	reporter := common.NewRecordingReporter()
+	fakeRouteController.reporter = reporter
+	composite.SetReporter(reporter)
+	fakeRouteController.declarative = composite
+
+	obj := &v1.Route{
+		Spec: v1.RouteSpec{
+			Host: "foo.test.com",
+			To:   v1.RouteTargetReference{Name: "other"},
+		},
+	}
+	fakeRouteController.createRoute(obj)
+	if _, ok := declarative.states["foo.test.com/dc1"]; !ok {
+		t.Errorf("excepted state to be applied, got %v", declarative.Calls())
+	}
+	calls := imperative.Calls()
+	if len(calls) != 14 || calls[0] != "PreUpdate" || calls[1] != "CreatePool" || calls[5] != "ModifyMonitor" || calls[13] != "PostUpdate" {
+		t.Errorf("excepted operations of both ports, got %v", calls)
+	}
+	composite.CleanCalls()
+
+	// failing best effort provider stops its own operations but does not fail the call
+	imperative.FailOn("CreatePool", errors.New("pool failure"))
+	err = composite.Apply(context.Background(), fakeRouteController.newHostState("bar.test.com", "/", "GET", "", 0, false, 1, "", MemberSettings{}))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if len(imperative.Calls()) != 1 || len(reporter.Reports()) != 1 {
+		t.Errorf("excepted single failed call to be reported, got %v %v", imperative.Calls(), reporter.Reports())
+	}
+	imperative.FailOn("CreatePool", nil)
+	composite.CleanCalls()
+
+	hosts, err := composite.ListHosts(context.Background(), "dc1")
+	if err != nil || len(hosts) != 2 {
+		t.Errorf("excepted hosts of declarative provider, got %v %v", hosts, err)
+	}
+
+	fakeRouteController.deleteRoute(obj)
+	if _, ok := declarative.states["foo.test.com/dc1"]; ok {
+		t.Errorf("excepted state to be removed")
+	}
+	calls = imperative.Calls()
+	if len(calls) != 7 || calls[2] != "DeletePoolMember" || calls[4] != "CheckAndClean" {
+		t.Errorf("excepted member to be deleted from both ports, got %v", calls)
+	}
+}
+
+type fakeDNS struct {
+	hosts map[string]bool
+	calls []string
+}
+
+func (f *fakeDNS) AddHost(ctx context.Context, host string, membername string) error {
+	f.calls = append(f.calls, "AddHost")
+	f.hosts[host+"/"+membername] = true
+	return nil
+}
+
+func (f *fakeDNS) RemoveHost(ctx context.Context, host string, membername string) error {
+	f.calls = append(f.calls, "RemoveHost")
+	delete(f.hosts, host+"/"+membername)
+	return nil
+}
+
+func TestCustomHostDNS(t *testing.T) {
+	fakeRouteController := &RouteController{}
+	fakeRouteController.hosttowatch = "test.com"
+	fakeRouteController.clusteralias = "dc1"
+	fakeRouteController.partition = "ext"
+	fakeRouteController.reporter = common.NewNopReporter()
+	fakeRouteController.provider = NewContextAdapter(fake.NewFakeProvider())
+	dns := &fakeDNS{hosts: map[string]bool{}}
+	fakeRouteController.dns = dns
+
+	// suffix hosts are covered by the wildcard record
+	fakeRouteController.createRoute(&v1.Route{
+		Spec: v1.RouteSpec{
+			Host: "foo.test.com",
+			To:   v1.RouteTargetReference{Name: "other"},
+		},
+	})
+	if len(dns.calls) != 0 {
+		t.Errorf("excepted no dns calls, got %v", dns.calls)
+	}
+
+	obj := &v1.Route{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				CustomHostAnnotation: "ext",
+			},
+		},
+		Spec: v1.RouteSpec{
+			Host: "fooext.fi",
+			To:   v1.RouteTargetReference{Name: "other"},
+		},
+		Status: v1.RouteStatus{
+			Ingress: []v1.RouteIngress{{Host: "fooext.fi"}},
+		},
+	}
+	fakeRouteController.createRoute(obj)
+	if !dns.hosts["fooext.fi/dc1"] {
+		t.Errorf("excepted dns records of fooext.fi, got %v", dns.calls)
+	}
+	calls := fakeRouteController.provider.Calls()
+	if calls[len(calls)-1] != "PostUpdate" {
+		t.Errorf("excepted dns update within the batch, got %v", calls)
+	}
+
+	// custom annotation removed
+	obj2 := obj.DeepCopy()
+	obj2.Annotations = map[string]string{}
+	fakeRouteController.updateRoute(obj, obj2)
+	if len(dns.hosts) != 0 || len(dns.calls) != 2 {
+		t.Errorf("excepted dns records to be removed, got %v", dns.calls)
+	}
+}
+
+type fakeCertificateProvider struct {
+	ContextProviderInterface
+	certificates map[string]Certificate
+	calls        []string
+}
+
+func (f *fakeCertificateProvider) SetCertificate(ctx context.Context, host string, certificate Certificate) error {
+	f.calls = append(f.calls, "SetCertificate")
+	f.certificates[host] = certificate
+	return nil
+}
+
+func (f *fakeCertificateProvider) DeleteCertificate(ctx context.Context, host string) error {
+	f.calls = append(f.calls, "DeleteCertificate")
+	delete(f.certificates, host)
+	return nil
+}
+
+func TestCertificates(t *testing.T) {
+	fakeRouteController := &RouteController{}
+	fakeRouteController.hosttowatch = "test.com"
+	fakeRouteController.clusteralias = "dc1"
+	fakeRouteController.partition = "ext"
+	reporter := common.NewRecordingReporter()
+	fakeRouteController.reporter = reporter
+	provider := &fakeCertificateProvider{
+		ContextProviderInterface: NewContextAdapter(fake.NewFakeProvider()),
+		certificates:             map[string]Certificate{},
+	}
+	fakeRouteController.provider = provider
+	fakeRouteController.getSecret = func(namespace string, name string) (*corev1.Secret, error) {
+		if namespace != "demo" || name != "fooext-tls" {
+			return nil, errors.New("not found")
+		}
+		return &corev1.Secret{Data: map[string][]byte{
+			corev1.TLSCertKey:       []byte("secret cert"),
+			corev1.TLSPrivateKeyKey: []byte("secret key"),
+		}}, nil
+	}
+
+	obj := &v1.Route{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "demo",
+			Annotations: map[string]string{
+				CustomHostAnnotation: "ext",
+			},
+		},
+		Spec: v1.RouteSpec{
+			Host: "fooext.fi",
+			To:   v1.RouteTargetReference{Name: "other"},
+			TLS:  &v1.TLSConfig{Termination: v1.TLSTerminationEdge, Certificate: "cert", Key: "key"},
+		},
+		Status: v1.RouteStatus{
+			Ingress: []v1.RouteIngress{{Host: "fooext.fi"}},
+		},
+	}
+	fakeRouteController.createRoute(obj)
+	if provider.certificates["fooext.fi"].Certificate != "cert" {
+		t.Errorf("excepted certificate of the route, got %v", provider.calls)
+	}
+
+	// nothing changed, for instance resync
+	fakeRouteController.updateRoute(obj, obj)
+	if len(provider.calls) != 1 {
+		t.Errorf("excepted single call, got %v", provider.calls)
+	}
+
+	// certificate from secret
+	obj2 := obj.DeepCopy()
+	obj2.Annotations[tlsSecretAnnotation] = "fooext-tls"
+	fakeRouteController.updateRoute(obj, obj2)
+	if provider.certificates["fooext.fi"].Key != "secret key" {
+		t.Errorf("excepted certificate of the secret, got %v", provider.certificates)
+	}
+
+	obj3 := obj2.DeepCopy()
+	obj3.Annotations[tlsSecretAnnotation] = "missing"
+	fakeRouteController.updateRoute(obj2, obj3)
+	if len(provider.calls) != 2 || len(reporter.Reports()) != 1 {
+		t.Errorf("excepted missing secret to be reported, got %v %v", provider.calls, reporter.Reports())
+	}
+
+	// suffix hosts use the certificate of the virtual server
+	suffix := obj.DeepCopy()
+	suffix.Annotations = nil
+	suffix.Spec.Host = "foo.test.com"
+	fakeRouteController.createRoute(suffix)
+	if len(provider.calls) != 2 {
+		t.Errorf("excepted no certificate of suffix host, got %v", provider.calls)
+	}
+
+	fakeRouteController.deleteRoute(obj2)
+	if len(provider.certificates) != 0 {
+		t.Errorf("excepted certificate to be removed, got %v", provider.calls)
+	}
+
+	// certificate uses the host of the pools, which is the host of the ingress on update
+	ingress := obj.DeepCopy()
+	ingress.Status.Ingress[0].Host = "www.fooext.fi"
+	fakeRouteController.updateRoute(obj, ingress)
+	if _, ok := provider.certificates["www.fooext.fi"]; !ok || len(provider.certificates) != 1 {
+		t.Errorf("excepted certificate of ingress host, got %v", provider.certificates)
+	}
+	fakeRouteController.checkExternalLBDoesNotExists("www.fooext.fi")
+	if len(provider.certificates) != 0 {
+		t.Errorf("excepted certificate to be removed with the pools, got %v", provider.certificates)
+	}
+}
+
+type fakeMemberProvider struct {
+	ContextProviderInterface
+	addresses map[string][]string
+	calls     int
+}
+
+func (f *fakeMemberProvider) SetMemberAddresses(ctx context.Context, membername string, addresses []string) error {
+	f.calls++
+	f.addresses[membername] = addresses
+	return nil
+}
+
+func TestRouterAddresses(t *testing.T) {
+	fakeRouteController := &RouteController{}
+	fakeRouteController.clusteralias = "dc1"
+	fakeRouteController.reporter = common.NewRecordingReporter()
+	provider := &fakeMemberProvider{
+		ContextProviderInterface: NewContextAdapter(fake.NewFakeProvider()),
+		addresses:                map[string][]string{},
+	}
+	fakeRouteController.provider = provider
+
+	endpoints := &corev1.Endpoints{Subsets: []corev1.EndpointSubset{
+		{
+			Addresses:         []corev1.EndpointAddress{{IP: "10.0.0.2"}, {IP: "10.0.0.1"}},
+			NotReadyAddresses: []corev1.EndpointAddress{{IP: "10.0.0.3"}},
+		},
+		{Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}}},
+	}}
+	addresses := endpointAddresses(endpoints)
+	if strings.Join(addresses, ",") != "10.0.0.1,10.0.0.2" {
+		t.Errorf("excepted ready addresses in order, got %v", addresses)
+	}
+
+	fakeRouteController.setRouterAddresses(addresses)
+	if provider.calls != 1 || len(provider.addresses["dc1"]) != 2 {
+		t.Errorf("excepted addresses of dc1, got %v", provider.addresses)
+	}
+	// resync without changes
+	fakeRouteController.setRouterAddresses(endpointAddresses(endpoints))
+	// no ready routers
+	fakeRouteController.setRouterAddresses(nil)
+	if provider.calls != 1 {
+		t.Errorf("excepted single call, got %d", provider.calls)
+	}
+	fakeRouteController.setRouterAddresses([]string{"10.0.0.5"})
+	if provider.calls != 2 || provider.addresses["dc1"][0] != "10.0.0.5" {
+		t.Errorf("excepted changed addresses, got %v", provider.addresses)
+	}
+
+	if _, err := parseRouterAddresses("10.0.0.1, 10.0.0.2"); err != nil {
+		t.Errorf("%v", err)
+	}
+	if _, err := parseRouterAddresses("router"); err == nil {
+		t.Errorf("excepted error from invalid address")
+	}
+}
+
+func TestMemberSettingsAnnotations(t *testing.T) {
+	fakeRouteController := &RouteController{}
+	reporter := common.NewRecordingReporter()
+	fakeRouteController.reporter = reporter
+
+	route := &v1.Route{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				ratioAnnotation:           "3",
+				connectionLimitAnnotation: "-1",
+				slowRampAnnotation:        "0",
+			},
+		},
+	}
+	_, _, _, _, _, _, _, settings := fakeRouteController.overrideWithAnnotation(route)
+	if settings.Ratio != 3 || settings.ConnectionLimit != 0 || settings.SlowRampTime == nil || *settings.SlowRampTime != 0 {
+		t.Errorf("excepted ratio 3 and slow ramp 0, got %v", settings)
+	}
+	if len(reporter.Reports()) != 1 {
+		t.Errorf("excepted report of invalid connection limit, got %v", reporter.Reports())
+	}
+
+	_, _, _, _, _, _, _, defaults := fakeRouteController.overrideWithAnnotation(&v1.Route{})
+	if defaults.SlowRampTime != nil || defaults.Equal(settings) {
+		t.Errorf("excepted default settings, got %v", defaults)
+	}
+}
+
+func TestClusterPrio(t *testing.T) {
+	fakeRouteController := &RouteController{}
+	fakeRouteController.reporter = common.NewRecordingReporter()
+
+	route := &v1.Route{}
+	if _, _, _, _, _, prio, _, _ := fakeRouteController.overrideWithAnnotation(route); prio != defaultPrio {
+		t.Errorf("excepted default prio %d, got %d", defaultPrio, prio)
+	}
+	fakeRouteController.clusterPrio = 5
+	if _, _, _, _, _, prio, _, _ := fakeRouteController.overrideWithAnnotation(route); prio != 5 {
+		t.Errorf("excepted cluster prio 5, got %d", prio)
+	}
+	route.Annotations = map[string]string{overridePriorityGrpAnnotation: "7"}
+	if _, _, _, _, _, prio, _, _ := fakeRouteController.overrideWithAnnotation(route); prio != 7 {
+		t.Errorf("excepted route prio 7, got %d", prio)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	fakeRouteController := &RouteController{}
+	reporter := common.NewRecordingReporter()
+	fakeRouteController.reporter = reporter
+	roles, err := ParseRoles(`{"Primary":{"prio":30},"secondary":{"prio":20,"slowRampTime":30},"disaster":{"prio":5,"pga":2,"persist":false}}`)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	fakeRouteController.routeRoles = roles
+	if _, ok := roles.Get("standby"); !ok || len(roles) != 5 {
+		t.Errorf("excepted default roles and three new roles, got %v", roles)
+	}
+	if prios := roles.NonPersistentPrios(); len(prios) != 2 || prios[0] != 15 || prios[1] != 5 {
+		t.Errorf("excepted standby and disaster without persistence, got %v", prios)
+	}
+
+	route := &v1.Route{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		roleAnnotation:                "primary",
+		overridePriorityGrpAnnotation: "7",
+	}}}
+	_, _, _, pga, _, prio, _, settings := fakeRouteController.overrideWithAnnotation(route)
+	if prio != 30 || pga != 1 || settings.Backup || settings.SlowRampTime == nil || *settings.SlowRampTime != 0 {
+		t.Errorf("excepted primary prio 30 and pga 1, got %d %d %v", prio, pga, settings)
+	}
+	route.Annotations[roleAnnotation] = "disaster"
+	route.Annotations[slowRampAnnotation] = "60"
+	_, _, _, pga, _, prio, _, settings = fakeRouteController.overrideWithAnnotation(route)
+	if prio != 5 || pga != 2 || !settings.Backup || *settings.SlowRampTime != 60 {
+		t.Errorf("excepted disaster backup with slow ramp of the annotation, got %d %d %v", prio, pga, settings)
+	}
+
+	route.Annotations = map[string]string{roleAnnotation: "unknown"}
+	_, _, _, _, _, prio, _, _ = fakeRouteController.overrideWithAnnotation(route)
+	if prio != defaultPrio || len(reporter.Reports()) != 1 {
+		t.Errorf("excepted default prio and report of unknown role, got %d %v", prio, reporter.Reports())
+	}
+
+	for _, value := range []string{`{"primary":{"prio":-1}}`, `{"primary":20}`, `primary=20`} {
+		if _, err := ParseRoles(value); err == nil {
+			t.Errorf("excepted error for %s", value)
+		}
+	}
+}
+
+type fakeSyncProvider struct {
+	ContextProviderInterface
+	synced chan []string
+}
+
+func (f *fakeSyncProvider) Synced(ctx context.Context) error {
+	f.synced <- f.Calls()
+	return nil
+}
+
+func TestSynced(t *testing.T) {
+	fakeRouteController := &RouteController{}
+	fakeRouteController.hosttowatch = "test.com"
+	fakeRouteController.clusteralias = "dc1"
+	fakeRouteController.partition = "ext"
+	fakeRouteController.reporter = common.NewRecordingReporter()
+	fakeRouteController.batch.window = 10 * time.Millisecond
+	provider := &fakeSyncProvider{
+		ContextProviderInterface: NewContextAdapter(fake.NewFakeProvider()),
+		synced:                   make(chan []string, 1),
+	}
+	fakeRouteController.provider = provider
+
+	routes := &v1.RouteList{ListMeta: metav1.ListMeta{ResourceVersion: "1"}}
+	for _, host := range []string{"foo.test.com", "bar.test.com"} {
+		routes.Items = append(routes.Items, v1.Route{
+			ObjectMeta: metav1.ObjectMeta{Name: host, Namespace: "demo"},
+			Spec: v1.RouteSpec{
+				Host: host,
+				To:   v1.RouteTargetReference{Name: "other"},
+			},
+		})
+	}
+	fakeRouteController.routeInformer = cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return routes, nil
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return watch.NewFake(), nil
+			},
+		},
+		&v1.Route{},
+		0,
+		cache.Indexers{},
+	)
+	fakeRouteController.routeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: fakeRouteController.createRoute,
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go fakeRouteController.routeInformer.Run(stopCh)
+	go fakeRouteController.notifySynced(stopCh, fakeRouteController.syncHandler())
+
+	select {
+	case calls := <-provider.synced:
+		monitors := 0
+		for _, call := range calls {
+			if call == "AddMonitorToPool" {
+				monitors++
+			}
+		}
+		if monitors != 4 {
+			t.Errorf("excepted initial routes to be created before sync, got %v", calls)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("excepted provider to be synced")
+	}
+}
+
+type fakeOperationProvider struct {
+	ContextProviderInterface
+	ids []string
+	err error
+}
+
+func (f *fakeOperationProvider) CreatePool(ctx context.Context, name string, port string) error {
+	f.ids = append(f.ids, OperationID(ctx))
+	return f.err
+}
+
+func TestPermanentErrors(t *testing.T) {
+	fakeRouteController := &RouteController{}
+	fakeRouteController.reporter = common.NewRecordingReporter()
+	fakeRouteController.retries = 2
+	fakeRouteController.retryInterval = time.Millisecond
+	provider := &fakeOperationProvider{
+		ContextProviderInterface: NewContextAdapter(fake.NewFakeProvider()),
+		err:                      errors.New("busy"),
+	}
+	fakeRouteController.provider = provider
+
+	// retries have same operation id
+	err := fakeRouteController.call("CreatePool", "foo.test.com", func(ctx context.Context) error {
+		return provider.CreatePool(ctx, "foo.test.com", "80")
+	})
+	if err == nil || len(provider.ids) != 3 || len(provider.ids[0]) == 0 || provider.ids[0] != provider.ids[2] {
+		t.Errorf("excepted 3 attempts with same operation id, got %v %v", provider.ids, err)
+	}
+	first := provider.ids[0]
+
+	// permanent errors are not retried
+	provider.ids = nil
+	provider.err = Permanent(errors.New("invalid pool name"))
+	err = fakeRouteController.call("CreatePool", "foo.test.com", func(ctx context.Context) error {
+		return provider.CreatePool(ctx, "foo.test.com", "80")
+	})
+	if !IsPermanent(err) || len(provider.ids) != 1 || provider.ids[0] == first {
+		t.Errorf("excepted single attempt with new operation id, got %v %v", provider.ids, err)
+	}
+}
@@ -7,11 +7,13 @@ SPDX-License-Identifier: Apache-2.0
 package controller
 
 import (
+	"context"
 	"log"
 	"os"
 	"strings"
 	"sync"
 
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/common"
 	v1 "github.com/openshift/api/route/v1"
 )
 
@@ -19,12 +21,14 @@ import (
 type ProviderInterface interface {
 	// Initialize initilizes new provider
 	Initialize()
+	// sets reporter which is used for reporting errors
+	SetReporter(reporter common.ErrorReporter)
 	// creates new loadbalancer pool
 	CreatePool(name string, port string) error
 	// adds new member to pool
 	AddPoolMember(membername string, name string, port string) error
 	// modifies loadbalancer pool
-	ModifyPool(name string, port string, loadBalancingMethod string, pga int, maintenance bool, prio int, role string) error
+	ModifyPool(name string, port string, loadBalancingMethod string, pga int, maintenance bool, prio int, role string, settings MemberSettings) error
 	// creates new monitor
 	CreateMonitor(host string, port string, uri string, httpMethod string, interval int, timeout int) error
 	// modifies monitor
@@ -34,32 +38,122 @@ type ProviderInterface interface {
 	// delete pool member
 	DeletePoolMember(membername string, name string, port string) error
 	// checks pool members and if 0 members left in pool, delete monitor and delete pool
-	CheckAndClean(name string, port string)
-	// executed before something is updated. Can be used for instance to checking active member of the HA lb
-	PreUpdate()
+	CheckAndClean(name string, port string) error
+	// executed before something is updated. Can be used for instance to checking active member of the HA lb.
+	// If error is returned, nothing is written to the lb
+	PreUpdate() error
 	// executed after something is updated. Can be used for instance to configuration sync
-	PostUpdate()
+	PostUpdate() error
 	// returns hosts which should be removed
-	CheckPools(routes []v1.Route, hosttowatch string, membername string) map[string]bool
+	CheckPools(routes []v1.Route, hosttowatch string, membername string) (map[string]bool, error)
 	// testing purposes
 	Calls() []string
 	CleanCalls()
 }
 
+// ContextProviderInterface is a context aware version of ProviderInterface. Each call receives context
+// which is cancelled when the operation times out or the controller is shutting down.
+type ContextProviderInterface interface {
+	// Initialize initilizes new provider
+	Initialize()
+	// sets reporter which is used for reporting errors
+	SetReporter(reporter common.ErrorReporter)
+	// creates new loadbalancer pool
+	CreatePool(ctx context.Context, name string, port string) error
+	// adds new member to pool
+	AddPoolMember(ctx context.Context, membername string, name string, port string) error
+	// modifies loadbalancer pool
+	ModifyPool(ctx context.Context, name string, port string, loadBalancingMethod string, pga int, maintenance bool, prio int, role string, settings MemberSettings) error
+	// creates new monitor
+	CreateMonitor(ctx context.Context, host string, port string, uri string, httpMethod string, interval int, timeout int) error
+	// modifies monitor
+	ModifyMonitor(ctx context.Context, host string, port string, uri string, httpMethod string, interval int, timeout int) error
+	// adds monitor to pool
+	AddMonitorToPool(ctx context.Context, name string, port string) error
+	// delete pool member
+	DeletePoolMember(ctx context.Context, membername string, name string, port string) error
+	// checks pool members and if 0 members left in pool, delete monitor and delete pool
+	CheckAndClean(ctx context.Context, name string, port string) error
+	// executed before something is updated. Can be used for instance to checking active member of the HA lb.
+	// If error is returned, nothing is written to the lb
+	PreUpdate(ctx context.Context) error
+	// executed after something is updated. Can be used for instance to configuration sync
+	PostUpdate(ctx context.Context) error
+	// returns hosts which should be removed
+	CheckPools(ctx context.Context, routes []v1.Route, hosttowatch string, membername string) (map[string]bool, error)
+	// testing purposes
+	Calls() []string
+	CleanCalls()
+}
+
+// DeclarativeProviderInterface is an alternative to ContextProviderInterface. Instead of single operations
+// the provider receives complete desired state of a host and is responsible for computing and executing
+// the changes needed to reach it.
+type DeclarativeProviderInterface interface {
+	// Initialize initilizes new provider
+	Initialize()
+	// sets reporter which is used for reporting errors
+	SetReporter(reporter common.ErrorReporter)
+	// makes lb configuration of the host to match state, must be idempotent
+	Apply(ctx context.Context, state HostState) error
+	// removes member from the host, and the host when it has no members left
+	Remove(ctx context.Context, host string, membername string) error
+	// returns hosts which have membername as member
+	ListHosts(ctx context.Context, membername string) ([]string, error)
+	// testing purposes
+	Calls() []string
+	CleanCalls()
+}
+
+// UpdateHooks can be implemented by DeclarativeProviderInterface to execute something before and after
+// changes, for instance checking active member of the HA lb and configuration sync
+type UpdateHooks interface {
+	// executed before something is updated. If error is returned, nothing is written to the lb
+	PreUpdate(ctx context.Context) error
+	// executed after something is updated
+	PostUpdate(ctx context.Context) error
+}
+
+// MemberSettings are settings of the pool member of this cluster, the type lives in common so that
+// fakeprovider can implement the provider interfaces without importing controller
+type MemberSettings = common.MemberSettings
+
+// DNSInterface manages dns records of custom hosts, which are not covered by the SUFFIXHOST wildcard
+type DNSInterface interface {
+	// points the host to the lb and marks membername as user of the host
+	AddHost(ctx context.Context, host string, membername string) error
+	// removes membername from users of the host, and the records when it has no users left
+	RemoveHost(ctx context.Context, host string, membername string) error
+}
+
 var (
-	providersMutex sync.Mutex
-	providers      = make(map[string]ProviderInterface)
+	providersMutex       sync.Mutex
+	providers            = make(map[string]ContextProviderInterface)
+	declarativeProviders = make(map[string]DeclarativeProviderInterface)
 )
 
 // RegisterProvider registers new load balancer provider
 func RegisterProvider(name string, cloud ProviderInterface) {
+	RegisterContextProvider(name, NewContextAdapter(cloud))
+}
+
+// RegisterContextProvider registers new context aware load balancer provider
+func RegisterContextProvider(name string, cloud ContextProviderInterface) {
 	providersMutex.Lock()
 	defer providersMutex.Unlock()
 	log.Printf("Registered provider %q", name)
 	providers[name] = cloud
 }
 
-func getProvider(name string) ProviderInterface {
+// RegisterDeclarativeProvider registers new declarative load balancer provider
+func RegisterDeclarativeProvider(name string, cloud DeclarativeProviderInterface) {
+	providersMutex.Lock()
+	defer providersMutex.Unlock()
+	log.Printf("Registered declarative provider %q", name)
+	declarativeProviders[name] = cloud
+}
+
+func getProvider(name string) ContextProviderInterface {
 	providersMutex.Lock()
 	defer providersMutex.Unlock()
 	f, found := providers[name]
@@ -69,10 +163,77 @@ func getProvider(name string) ProviderInterface {
 	return f
 }
 
-// InitProvider returns load balancer providerinterface
-func (c *RouteController) InitProvider() ProviderInterface {
+func getDeclarativeProvider(name string) DeclarativeProviderInterface {
+	providersMutex.Lock()
+	defer providersMutex.Unlock()
+	f, found := declarativeProviders[name]
+	if !found {
+		return nil
+	}
+	return f
+}
+
+// InitProvider returns load balancer providerinterface. Comma separated PROVIDER returns composite
+// provider which forwards calls to each of the providers, PROVIDER_BEST_EFFORT lists providers
+// whose errors do not fail the call. Returns nil if any of the providers is declarative.
+func (c *RouteController) InitProvider() ContextProviderInterface {
 	name := strings.ToLower(os.Getenv("PROVIDER"))
+	if strings.Contains(name, ",") {
+		names := strings.Split(name, ",")
+		if hasDeclarativeProvider(names) {
+			return nil
+		}
+		cloud, err := NewCompositeProvider(names, bestEffortProviders())
+		if err != nil {
+			c.reporter.CaptureErrorAndWait(err, nil)
+			panic(err)
+		}
+		log.Printf("Using providers %s", name)
+		return cloud
+	}
 	cloud := getProvider(name)
 	log.Printf("Using provider %s", name)
 	return cloud
 }
+
+// InitDeclarativeProvider returns declarative load balancer provider, nil if PROVIDER is not declarative.
+// Comma separated PROVIDER which contains declarative providers returns declarative composite provider.
+func (c *RouteController) InitDeclarativeProvider() DeclarativeProviderInterface {
+	name := strings.ToLower(os.Getenv("PROVIDER"))
+	if strings.Contains(name, ",") {
+		names := strings.Split(name, ",")
+		if !hasDeclarativeProvider(names) {
+			return nil
+		}
+		cloud, err := NewDeclarativeCompositeProvider(names, bestEffortProviders())
+		if err != nil {
+			c.reporter.CaptureErrorAndWait(err, nil)
+			panic(err)
+		}
+		log.Printf("Using declarative providers %s", name)
+		return cloud
+	}
+	cloud := getDeclarativeProvider(name)
+	if cloud != nil {
+		log.Printf("Using declarative provider %s", name)
+	}
+	return cloud
+}
+
+// hasDeclarativeProvider returns true if any of the names is declarative provider
+func hasDeclarativeProvider(names []string) bool {
+	for _, name := range names {
+		if getDeclarativeProvider(strings.TrimSpace(name)) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// bestEffortProviders returns providers listed in PROVIDER_BEST_EFFORT
+func bestEffortProviders() []string {
+	if value := strings.ToLower(os.Getenv("PROVIDER_BEST_EFFORT")); len(value) > 0 {
+		return strings.Split(value, ",")
+	}
+	return []string{}
+}
@@ -0,0 +1,331 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package envoy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/common"
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	v1 "github.com/openshift/api/route/v1"
+	"google.golang.org/grpc"
+)
+
+const (
+	providerName      = "envoy"
+	defaultListenAddr = ":18000"
+)
+
+// ProviderEnvoy is an implementation of ProviderInterface which serves pools as Envoy clusters,
+// endpoints and routes over an embedded xDS server. Pools are kept in memory and a new snapshot is
+// published in PostUpdate after the routes which existed at startup have been synced.
+type ProviderEnvoy struct {
+	// lock protects pools, dirty, synced and version
+	lock  sync.Mutex
+	pools map[string]*pool
+	// dirty is true when pools have changed after the snapshot was published
+	dirty bool
+	// synced is true when the initial routes have been added to pools
+	synced  bool
+	version int
+
+	listenAddr    string
+	clusteralias  string
+	partition     string
+	memberAddress string
+	cache         cache.SnapshotCache
+	grpcServer    *grpc.Server
+	reporter      common.ErrorReporter
+}
+
+type pool struct {
+	name                string
+	host                string
+	port                string
+	loadBalancingMethod string
+	pga                 int
+	members             []*member
+	// monitor is nil if pool does not have monitor
+	monitor *monitor
+}
+
+type member struct {
+	name        string
+	address     string
+	prio        int
+	maintenance bool
+	weight      int
+}
+
+// monitor is http health check, Envoy health checks always use GET
+type monitor struct {
+	path     string
+	interval int
+	timeout  int
+}
+
+func init() {
+	controller.RegisterProvider(providerName, NewProviderEnvoy())
+}
+
+// NewProviderEnvoy returns new envoy provider
+func NewProviderEnvoy() *ProviderEnvoy {
+	return &ProviderEnvoy{
+		pools:      map[string]*pool{},
+		dirty:      true,
+		listenAddr: defaultListenAddr,
+		cache:      cache.NewSnapshotCache(true, allNodes{}, nil),
+		reporter:   common.NewLogReporter(),
+	}
+}
+
+// Initialize initilizes new provider and starts xDS server
+func (e *ProviderEnvoy) Initialize() {
+	e.memberAddress = os.Getenv("ENVOY_MEMBER_ADDRESS")
+	if len(e.memberAddress) == 0 {
+		err := errors.New("ENVOY_MEMBER_ADDRESS environment variable needed")
+		e.reporter.CaptureErrorAndWait(err, nil)
+		panic(err)
+	}
+	e.clusteralias = os.Getenv("CLUSTERALIAS")
+	e.partition = os.Getenv("PARTITION")
+	if value := os.Getenv("ENVOY_XDS_ADDR"); len(value) > 0 {
+		e.listenAddr = value
+	}
+	lis, err := net.Listen("tcp", e.listenAddr)
+	if err != nil {
+		err = fmt.Errorf("error starting xds server %v", err)
+		e.reporter.CaptureErrorAndWait(err, nil)
+		panic(err)
+	}
+	e.serve(lis)
+}
+
+// serve serves xDS in lis, Envoy waits for the first snapshot which is published after initial sync
+func (e *ProviderEnvoy) serve(lis net.Listener) {
+	e.grpcServer = grpc.NewServer()
+	registerServer(e.grpcServer, server.NewServer(context.Background(), e.cache, nil))
+	log.Printf("xds server listening %s", lis.Addr())
+	go func() {
+		err := e.grpcServer.Serve(lis)
+		if err != nil {
+			e.reporter.CaptureError(fmt.Errorf("xds server stopped %v", err), nil)
+		}
+	}()
+}
+
+// SetReporter sets error reporter
+func (e *ProviderEnvoy) SetReporter(reporter common.ErrorReporter) {
+	e.reporter = reporter
+}
+
+func poolName(name string, port string) string {
+	return name + "_" + port
+}
+
+func (p *pool) member(membername string) *member {
+	for _, m := range p.members {
+		if m.name == membername {
+			return m
+		}
+	}
+	return nil
+}
+
+// getPool returns pool, it must be called holding the lock
+func (e *ProviderEnvoy) getPool(name string, port string) (*pool, error) {
+	p, ok := e.pools[poolName(name, port)]
+	if !ok {
+		return nil, fmt.Errorf("pool %s does not exist", poolName(name, port))
+	}
+	return p, nil
+}
+
+// CreatePool creates new cluster
+func (e *ProviderEnvoy) CreatePool(name string, port string) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if _, ok := e.pools[poolName(name, port)]; ok {
+		return nil
+	}
+	e.pools[poolName(name, port)] = &pool{
+		name: poolName(name, port),
+		host: name,
+		port: port,
+	}
+	e.dirty = true
+	return nil
+}
+
+// AddPoolMember adds new endpoint to cluster
+func (e *ProviderEnvoy) AddPoolMember(membername string, name string, port string) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	p, err := e.getPool(name, port)
+	if err != nil {
+		return err
+	}
+	if p.member(membername) != nil {
+		return nil
+	}
+	p.members = append(p.members, &member{
+		name:    membername,
+		address: e.memberAddress,
+	})
+	e.dirty = true
+	return nil
+}
+
+// ModifyPool modifies load balancing policy of the cluster and priority and weight of the endpoint of
+// this cluster, connection limit and slow ramp time are not supported
+func (e *ProviderEnvoy) ModifyPool(name string, port string, loadBalancingMethod string, pga int, maintenance bool, prio int, role string, settings controller.MemberSettings) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	p, err := e.getPool(name, port)
+	if err != nil {
+		return err
+	}
+	m := p.member(e.clusteralias)
+	if m == nil {
+		return fmt.Errorf("endpoint %s does not exist in cluster %s", e.clusteralias, p.name)
+	}
+	p.loadBalancingMethod = loadBalancingMethod
+	p.pga = pga
+	m.prio = prio
+	m.maintenance = maintenance
+	m.weight = settings.Ratio
+	e.dirty = true
+	return nil
+}
+
+// CreateMonitor creates active http health check of the cluster
+func (e *ProviderEnvoy) CreateMonitor(host string, port string, uri string, httpMethod string, interval int, timeout int) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	p, err := e.getPool(host, port)
+	if err != nil {
+		return err
+	}
+	p.monitor = &monitor{
+		path:     uri,
+		interval: interval,
+		timeout:  timeout,
+	}
+	e.dirty = true
+	return nil
+}
+
+// ModifyMonitor modifies active http health check of the cluster
+func (e *ProviderEnvoy) ModifyMonitor(host string, port string, uri string, httpMethod string, interval int, timeout int) error {
+	return e.CreateMonitor(host, port, uri, httpMethod, interval, timeout)
+}
+
+// AddMonitorToPool does nothing, health check is created to the cluster
+func (e *ProviderEnvoy) AddMonitorToPool(name string, port string) error {
+	return nil
+}
+
+// DeletePoolMember deletes endpoint from cluster
+func (e *ProviderEnvoy) DeletePoolMember(membername string, name string, port string) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	p, ok := e.pools[poolName(name, port)]
+	if !ok {
+		return nil
+	}
+	for i, m := range p.members {
+		if m.name == membername {
+			p.members = append(p.members[:i], p.members[i+1:]...)
+			e.dirty = true
+			return nil
+		}
+	}
+	return nil
+}
+
+// CheckAndClean deletes cluster if it does not have endpoints
+func (e *ProviderEnvoy) CheckAndClean(name string, port string) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	p, ok := e.pools[poolName(name, port)]
+	if ok && len(p.members) == 0 {
+		delete(e.pools, poolName(name, port))
+		e.dirty = true
+	}
+	return nil
+}
+
+// PreUpdate does nothing
+func (e *ProviderEnvoy) PreUpdate() error {
+	return nil
+}
+
+// Synced publishes the first snapshot when the routes which existed at startup are in pools
+func (e *ProviderEnvoy) Synced(ctx context.Context) error {
+	e.lock.Lock()
+	e.synced = true
+	e.lock.Unlock()
+	return e.PostUpdate()
+}
+
+// PostUpdate publishes new snapshot to Envoy if pools have changed, nothing is published before
+// initial sync so that Envoy does not drop clusters of the routes which are not processed yet
+func (e *ProviderEnvoy) PostUpdate() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if !e.dirty || !e.synced {
+		return nil
+	}
+	snapshot, err := e.snapshot(fmt.Sprintf("%d", e.version+1))
+	if err != nil {
+		return err
+	}
+	err = e.cache.SetSnapshot(allNodes{}.ID(nil), snapshot)
+	if err != nil {
+		return fmt.Errorf("error publishing snapshot %v", err)
+	}
+	e.version++
+	e.dirty = false
+	log.Printf("published xds snapshot version %d with %d clusters", e.version, len(e.pools))
+	return nil
+}
+
+// CheckPools compares current clusters and what routes we have. It returns list of hosts which should be removed
+func (e *ProviderEnvoy) CheckPools(routes []v1.Route, hosttowatch string, membername string) (map[string]bool, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	managed := map[string]bool{}
+	for i := range routes {
+		if controller.ManagedRoute(&routes[i], hosttowatch, e.partition) {
+			managed[routes[i].Spec.Host] = true
+		}
+	}
+	hosts := map[string]bool{}
+	for _, p := range e.pools {
+		if !managed[p.host] && p.member(membername) != nil {
+			hosts[p.host] = true
+		}
+	}
+	return hosts, nil
+}
+
+// Calls returns list of methodcalls, not in use in this provider
+func (e *ProviderEnvoy) Calls() []string {
+	return nil
+}
+
+// CleanCalls cleans calls, not in use in this provider
+func (e *ProviderEnvoy) CleanCalls() {
+}
@@ -0,0 +1,207 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package envoy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/golang/protobuf/ptypes"
+	v1 "github.com/openshift/api/route/v1"
+	"google.golang.org/grpc"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func addHost(t *testing.T, e *ProviderEnvoy, host string, member string, prio int, role string) {
+	for _, port := range controller.Ports {
+		for _, err := range []error{
+			e.CreatePool(host, port),
+			e.AddPoolMember(member, host, port),
+			e.ModifyPool(host, port, "least-connections-member", 1, false, prio, role, controller.MemberSettings{}),
+			e.CreateMonitor(host, port, "/health", "GET", 3, 10),
+		} {
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+	}
+}
+
+func TestEndpointPriorities(t *testing.T) {
+	p := &pool{name: "test_80", port: "80", pga: 1, members: []*member{
+		{name: "dc1", address: "10.0.0.1", prio: 1},
+		{name: "dc2", address: "10.0.0.2", prio: 3},
+		{name: "dc3", address: "10.0.0.3", prio: 1, maintenance: true},
+	}}
+	assignment := makeEndpoints(p)
+	if len(assignment.Endpoints) != 2 || assignment.Endpoints[1].Priority != 1 || len(assignment.Endpoints[1].LbEndpoints) != 2 ||
+		assignment.Endpoints[0].LbEndpoints[0].GetEndpoint().Address.GetSocketAddress().Address != "10.0.0.2" {
+		t.Errorf("excepted dc2 in priority 0 and others in priority 1, got %v", assignment)
+	}
+	if assignment.Endpoints[1].LbEndpoints[1].HealthStatus != core.HealthStatus_DRAINING {
+		t.Errorf("excepted endpoint in maintenance to be draining, got %v", assignment.Endpoints[1].LbEndpoints[1])
+	}
+	if assignment.Endpoints[0].LbEndpoints[0].LoadBalancingWeight != nil {
+		t.Errorf("excepted no weight by default, got %v", assignment.Endpoints[0].LbEndpoints[0])
+	}
+	p.members[1].weight = 5
+	if weight := makeEndpoints(p).Endpoints[0].LbEndpoints[0].LoadBalancingWeight; weight.GetValue() != 5 {
+		t.Errorf("excepted weight 5, got %v", weight)
+	}
+
+	// roles are resolved to priorities by the controller, standby is used only when active members are down
+	p.members[0].prio = 15
+	p.members[1].prio = 20
+	p.members[2].prio = 15
+	assignment = makeEndpoints(p)
+	if len(assignment.Endpoints) != 2 || assignment.Endpoints[0].LbEndpoints[0].GetEndpoint().Address.GetSocketAddress().Address != "10.0.0.2" {
+		t.Errorf("excepted active member in priority 0, got %v", assignment)
+	}
+
+	p.pga = 0
+	if assignment := makeEndpoints(p); len(assignment.Endpoints) != 1 {
+		t.Errorf("excepted one priority without pga, got %v", assignment)
+	}
+}
+
+func TestXDS(t *testing.T) {
+	e := NewProviderEnvoy()
+	e.clusteralias = "dc1"
+	e.memberAddress = "10.0.0.1"
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	e.serve(lis)
+	defer e.grpcServer.Stop()
+
+	// nothing is published before initial routes are synced
+	addHost(t, e, "test", "dc1", 1, "standby")
+	err = e.PostUpdate()
+	if err != nil || e.version != 0 {
+		t.Fatalf("excepted no snapshot before sync, got version %d %v", e.version, err)
+	}
+	err = e.Synced(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, lis.Addr().String(), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	resp, err := clusterservice.NewClusterDiscoveryServiceClient(conn).FetchClusters(ctx, &discovery.DiscoveryRequest{
+		Node:    &core.Node{Id: "edge"},
+		TypeUrl: resource.ClusterType,
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if resp.VersionInfo != "1" || len(resp.Resources) != 2 {
+		t.Fatalf("excepted two clusters in version 1, got %v", resp)
+	}
+	// order of the resources is not defined
+	c := &cluster.Cluster{}
+	for _, r := range resp.Resources {
+		err = ptypes.UnmarshalAny(r, c)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if c.Name == "test_80" {
+			break
+		}
+	}
+	if c.Name != "test_80" || c.LbPolicy != cluster.Cluster_LEAST_REQUEST || c.HealthChecks[0].GetHttpHealthCheck().Path != "/health" ||
+		c.HealthChecks[0].GetHttpHealthCheck().Host != "test" {
+		t.Errorf("unexpected cluster %v", c)
+	}
+
+	snapshot, _ := e.cache.GetSnapshot("")
+	endpoints := snapshot.GetResources(resource.EndpointType)
+	assignment := endpoints["test_443"].(*endpoint.ClusterLoadAssignment)
+	if assignment.Endpoints[0].LbEndpoints[0].GetEndpoint().Address.GetSocketAddress().GetPortValue() != 443 {
+		t.Errorf("unexpected endpoints %v", assignment)
+	}
+	routes := snapshot.GetResources(resource.RouteType)
+	if len(routes) != 2 || routes["routes_80"] == nil {
+		t.Errorf("excepted route configuration per port, got %v", routes)
+	}
+
+	// nothing changed, version is kept
+	e.PostUpdate()
+	for _, port := range controller.Ports {
+		e.DeletePoolMember("dc1", "test", port)
+		e.CheckAndClean("test", port)
+	}
+	e.PostUpdate()
+	if e.version != 2 || len(e.pools) != 0 {
+		t.Errorf("excepted version 2 without clusters, got %d %v", e.version, e.pools)
+	}
+}
+
+func TestCheckPools(t *testing.T) {
+	e := NewProviderEnvoy()
+	e.clusteralias = "dc1"
+	e.memberAddress = "10.0.0.1"
+	e.partition = "ext"
+	addHost(t, e, "test.example.com", "dc1", 1, "")
+	addHost(t, e, "www.fooext.fi", "dc1", 1, "")
+	route := v1.Route{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{controller.CustomHostAnnotation: "other"}},
+		Spec:       v1.RouteSpec{Host: "www.fooext.fi"},
+	}
+	routes := []v1.Route{{Spec: v1.RouteSpec{Host: "test.example.com"}}, route}
+	hosts, err := e.CheckPools(routes, ".example.com", "dc1")
+	if err != nil || len(hosts) != 1 || !hosts["www.fooext.fi"] {
+		t.Errorf("excepted host of other partition to be removed, got %v %v", hosts, err)
+	}
+	route.Annotations[controller.CustomHostAnnotation] = "ext"
+	hosts, err = e.CheckPools(routes, ".example.com", "dc1")
+	if err != nil || len(hosts) != 0 {
+		t.Errorf("excepted hosts to be kept, got %v %v", hosts, err)
+	}
+}
+
+func TestModifyEndpoint(t *testing.T) {
+	e := NewProviderEnvoy()
+	e.clusteralias = "dc1"
+	e.memberAddress = "10.0.0.1"
+	addHost(t, e, "test", "dc1", 1, "")
+	err := e.AddPoolMember("dc2", "test", "80")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = e.ModifyPool("test", "80", "", 1, true, 5, "", controller.MemberSettings{Ratio: 3})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	p := e.pools[poolName("test", "80")]
+	if m := p.member("dc1"); !m.maintenance || m.prio != 5 || m.weight != 3 {
+		t.Errorf("excepted endpoint dc1 to be modified, got %v", m)
+	}
+	if m := p.member("dc2"); m.maintenance || m.prio != 0 || m.weight != 0 {
+		t.Errorf("excepted endpoint of other cluster to be unchanged, got %v", m)
+	}
+
+	e.clusteralias = "dc3"
+	err = e.ModifyPool("test", "80", "", 1, true, 5, "", controller.MemberSettings{})
+	if err == nil {
+		t.Errorf("excepted error from missing endpoint")
+	}
+}
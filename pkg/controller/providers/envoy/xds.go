@@ -0,0 +1,205 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package envoy
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	tls "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	routeservice "github.com/envoyproxy/go-control-plane/envoy/service/route/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/grpc"
+)
+
+const (
+	connectTimeout = 5 * time.Second
+	// routeConfigPrefix is the prefix of route configuration names, port is appended to it
+	routeConfigPrefix = "routes_"
+)
+
+// allNodes uses same snapshot for all Envoy nodes
+type allNodes struct{}
+
+// ID returns same id for all nodes
+func (allNodes) ID(node *core.Node) string {
+	return ""
+}
+
+func registerServer(grpcServer *grpc.Server, srv server.Server) {
+	discoverygrpc.RegisterAggregatedDiscoveryServiceServer(grpcServer, srv)
+	clusterservice.RegisterClusterDiscoveryServiceServer(grpcServer, srv)
+	endpointservice.RegisterEndpointDiscoveryServiceServer(grpcServer, srv)
+	routeservice.RegisterRouteDiscoveryServiceServer(grpcServer, srv)
+}
+
+// snapshot returns clusters, endpoints and routes of the pools, it must be called holding the lock
+func (e *ProviderEnvoy) snapshot(version string) (cache.Snapshot, error) {
+	names := []string{}
+	for name := range e.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	clusters := []types.Resource{}
+	endpoints := []types.Resource{}
+	virtualHosts := map[string][]*route.VirtualHost{}
+	for _, name := range names {
+		p := e.pools[name]
+		c, err := makeCluster(p)
+		if err != nil {
+			return cache.Snapshot{}, err
+		}
+		clusters = append(clusters, c)
+		endpoints = append(endpoints, makeEndpoints(p))
+		virtualHosts[p.port] = append(virtualHosts[p.port], makeVirtualHost(p))
+	}
+	routes := []types.Resource{}
+	for _, port := range controller.Ports {
+		routes = append(routes, &route.RouteConfiguration{
+			Name:         routeConfigPrefix + port,
+			VirtualHosts: virtualHosts[port],
+		})
+	}
+	// listeners are not served, they are in the bootstrap configuration of Envoy
+	return cache.NewSnapshot(version, endpoints, clusters, routes, nil, nil, nil), nil
+}
+
+func lbPolicy(loadBalancingMethod string) cluster.Cluster_LbPolicy {
+	switch loadBalancingMethod {
+	case "least-connections-member", "least-connections-node", "least-sessions":
+		return cluster.Cluster_LEAST_REQUEST
+	}
+	return cluster.Cluster_ROUND_ROBIN
+}
+
+func makeCluster(p *pool) (*cluster.Cluster, error) {
+	c := &cluster.Cluster{
+		Name:                 p.name,
+		ConnectTimeout:       ptypes.DurationProto(connectTimeout),
+		ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_EDS},
+		EdsClusterConfig: &cluster.Cluster_EdsClusterConfig{
+			EdsConfig: &core.ConfigSource{
+				ResourceApiVersion:    resource.DefaultAPIVersion,
+				ConfigSourceSpecifier: &core.ConfigSource_Ads{Ads: &core.AggregatedConfigSource{}},
+			},
+		},
+		LbPolicy: lbPolicy(p.loadBalancingMethod),
+	}
+	if p.monitor != nil {
+		c.HealthChecks = []*core.HealthCheck{{
+			Interval:           ptypes.DurationProto(time.Duration(p.monitor.interval) * time.Second),
+			Timeout:            ptypes.DurationProto(time.Duration(p.monitor.timeout) * time.Second),
+			UnhealthyThreshold: &wrappers.UInt32Value{Value: 3},
+			HealthyThreshold:   &wrappers.UInt32Value{Value: 1},
+			HealthChecker: &core.HealthCheck_HttpHealthCheck_{
+				HttpHealthCheck: &core.HealthCheck_HttpHealthCheck{
+					Host: p.host,
+					Path: p.monitor.path,
+				},
+			},
+		}}
+	}
+	if p.port == "443" {
+		tlsContext, err := ptypes.MarshalAny(&tls.UpstreamTlsContext{Sni: p.host})
+		if err != nil {
+			return nil, err
+		}
+		c.TransportSocket = &core.TransportSocket{
+			Name:       wellknown.TransportSocketTls,
+			ConfigType: &core.TransportSocket_TypedConfig{TypedConfig: tlsContext},
+		}
+	}
+	return c, nil
+}
+
+// memberPrio returns priority of the member, greater priority is used first like in f5. Roles are
+// resolved to priority and pga by the controller.
+func memberPrio(p *pool, m *member) int {
+	if p.pga > 0 {
+		return m.prio
+	}
+	return 0
+}
+
+// makeEndpoints groups endpoints by priority, members with greatest priority get Envoy priority 0
+func makeEndpoints(p *pool) *endpoint.ClusterLoadAssignment {
+	groups := map[int][]*endpoint.LbEndpoint{}
+	prios := []int{}
+	for _, m := range p.members {
+		prio := memberPrio(p, m)
+		if _, ok := groups[prio]; !ok {
+			prios = append(prios, prio)
+		}
+		status := core.HealthStatus_UNKNOWN
+		if m.maintenance {
+			status = core.HealthStatus_DRAINING
+		}
+		port, _ := strconv.Atoi(p.port)
+		var weight *wrappers.UInt32Value
+		if m.weight > 0 {
+			weight = &wrappers.UInt32Value{Value: uint32(m.weight)}
+		}
+		groups[prio] = append(groups[prio], &endpoint.LbEndpoint{
+			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+				Endpoint: &endpoint.Endpoint{
+					Address: &core.Address{
+						Address: &core.Address_SocketAddress{
+							SocketAddress: &core.SocketAddress{
+								Protocol:      core.SocketAddress_TCP,
+								Address:       m.address,
+								PortSpecifier: &core.SocketAddress_PortValue{PortValue: uint32(port)},
+							},
+						},
+					},
+				},
+			},
+			HealthStatus:        status,
+			LoadBalancingWeight: weight,
+		})
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(prios)))
+	assignment := &endpoint.ClusterLoadAssignment{ClusterName: p.name}
+	for i, prio := range prios {
+		assignment.Endpoints = append(assignment.Endpoints, &endpoint.LocalityLbEndpoints{
+			LbEndpoints: groups[prio],
+			Priority:    uint32(i),
+		})
+	}
+	return assignment
+}
+
+func makeVirtualHost(p *pool) *route.VirtualHost {
+	return &route.VirtualHost{
+		Name:    p.name,
+		Domains: []string{p.host, p.host + ":" + p.port},
+		Routes: []*route.Route{{
+			Match: &route.RouteMatch{
+				PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"},
+			},
+			Action: &route.Route_Route{
+				Route: &route.RouteAction{
+					ClusterSpecifier: &route.RouteAction_Cluster{Cluster: p.name},
+				},
+			},
+		}},
+	}
+}
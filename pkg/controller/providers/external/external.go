@@ -0,0 +1,274 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package external
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/common"
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+	v1 "github.com/openshift/api/route/v1"
+)
+
+const (
+	providerName       = "external"
+	defaultDialTimeout = 10 * time.Second
+)
+
+// ProviderExternal is an implementation of ContextProviderInterface which forwards calls to a provider
+// running in another process, for instance in a sidecar container, see protocol.go
+type ProviderExternal struct {
+	network string
+	address string
+	nextID  uint64
+	// lock protects idle
+	lock sync.Mutex
+	// idle contains connections which are not in use
+	idle     []*connection
+	reporter common.ErrorReporter
+}
+
+type connection struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+func init() {
+	controller.RegisterContextProvider(providerName, NewProviderExternal())
+}
+
+// NewProviderExternal returns new external provider
+func NewProviderExternal() *ProviderExternal {
+	return &ProviderExternal{
+		reporter: common.NewLogReporter(),
+	}
+}
+
+// parseAddress returns network and address, unix:// prefix or absolute path means unix socket
+func parseAddress(value string) (string, string) {
+	if strings.HasPrefix(value, "unix://") {
+		return "unix", strings.TrimPrefix(value, "unix://")
+	}
+	if strings.HasPrefix(value, "/") {
+		return "unix", value
+	}
+	return "tcp", strings.TrimPrefix(value, "tcp://")
+}
+
+// Initialize initilizes new provider
+func (e *ProviderExternal) Initialize() {
+	value := os.Getenv("EXTERNAL_PROVIDER_ADDR")
+	if len(value) == 0 {
+		err := errors.New("EXTERNAL_PROVIDER_ADDR environment variable needed")
+		e.reporter.CaptureErrorAndWait(err, nil)
+		panic(err)
+	}
+	e.network, e.address = parseAddress(value)
+}
+
+// SetReporter sets error reporter
+func (e *ProviderExternal) SetReporter(reporter common.ErrorReporter) {
+	e.reporter = reporter
+}
+
+// get returns idle connection or dials new one
+func (e *ProviderExternal) get(ctx context.Context) (*connection, error) {
+	e.lock.Lock()
+	if n := len(e.idle); n > 0 {
+		c := e.idle[n-1]
+		e.idle = e.idle[:n-1]
+		e.lock.Unlock()
+		return c, nil
+	}
+	e.lock.Unlock()
+	dialer := &net.Dialer{Timeout: defaultDialTimeout}
+	conn, err := dialer.DialContext(ctx, e.network, e.address)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting external provider %v", err)
+	}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), maxMessageSize)
+	return &connection{conn: conn, scanner: scanner}, nil
+}
+
+func (e *ProviderExternal) put(c *connection) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.idle = append(e.idle, c)
+}
+
+// call executes method in external provider. Connection is closed if the call fails or context is
+// done, so that a late response is never read as response of another call.
+func (e *ProviderExternal) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	req := &Request{
+		JSONRPC: jsonrpcVersion,
+		ID:      atomic.AddUint64(&e.nextID, 1),
+		Method:  method,
+	}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req.Params = data
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		req.Timeout = time.Until(deadline).Milliseconds()
+		if req.Timeout <= 0 {
+			return context.DeadlineExceeded
+		}
+	}
+	c, err := e.get(ctx)
+	if err != nil {
+		return err
+	}
+	c.conn.SetDeadline(deadline)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// unblock read or write
+			c.conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	resp, err := c.roundTrip(req)
+	close(done)
+	<-stopped
+	if err != nil || ctx.Err() != nil {
+		c.conn.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return fmt.Errorf("external provider %s failed %v", method, err)
+	}
+	e.put(c)
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result != nil && len(resp.Result) > 0 {
+		return json.Unmarshal(resp.Result, result)
+	}
+	return nil
+}
+
+func (c *connection) roundTrip(req *Request) (*Response, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.conn.Write(append(data, '\n'))
+	if err != nil {
+		return nil, err
+	}
+	if !c.scanner.Scan() {
+		if err := c.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("connection closed")
+	}
+	resp := &Response{}
+	err = json.Unmarshal(c.scanner.Bytes(), resp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response %v", err)
+	}
+	if resp.ID != req.ID {
+		return nil, fmt.Errorf("response id %d does not match request id %d", resp.ID, req.ID)
+	}
+	return resp, nil
+}
+
+// CreatePool creates new loadbalancer pool
+func (e *ProviderExternal) CreatePool(ctx context.Context, name string, port string) error {
+	return e.call(ctx, "CreatePool", &PoolParams{Name: name, Port: port}, nil)
+}
+
+// AddPoolMember adds new member to pool
+func (e *ProviderExternal) AddPoolMember(ctx context.Context, membername string, name string, port string) error {
+	return e.call(ctx, "AddPoolMember", &MemberParams{MemberName: membername, Name: name, Port: port}, nil)
+}
+
+// ModifyPool modifies loadbalancer pool
+func (e *ProviderExternal) ModifyPool(ctx context.Context, name string, port string, loadBalancingMethod string, pga int, maintenance bool, prio int, role string, settings controller.MemberSettings) error {
+	return e.call(ctx, "ModifyPool", &ModifyPoolParams{
+		Name:                name,
+		Port:                port,
+		LoadBalancingMethod: loadBalancingMethod,
+		PGA:                 pga,
+		Maintenance:         maintenance,
+		Prio:                prio,
+		Role:                role,
+		MemberSettings:      settings,
+	}, nil)
+}
+
+// CreateMonitor creates new monitor
+func (e *ProviderExternal) CreateMonitor(ctx context.Context, host string, port string, uri string, httpMethod string, interval int, timeout int) error {
+	return e.call(ctx, "CreateMonitor", &MonitorParams{Host: host, Port: port, URI: uri, HTTPMethod: httpMethod, Interval: interval, Timeout: timeout}, nil)
+}
+
+// ModifyMonitor modifies monitor
+func (e *ProviderExternal) ModifyMonitor(ctx context.Context, host string, port string, uri string, httpMethod string, interval int, timeout int) error {
+	return e.call(ctx, "ModifyMonitor", &MonitorParams{Host: host, Port: port, URI: uri, HTTPMethod: httpMethod, Interval: interval, Timeout: timeout}, nil)
+}
+
+// AddMonitorToPool adds monitor to pool
+func (e *ProviderExternal) AddMonitorToPool(ctx context.Context, name string, port string) error {
+	return e.call(ctx, "AddMonitorToPool", &PoolParams{Name: name, Port: port}, nil)
+}
+
+// DeletePoolMember deletes pool member
+func (e *ProviderExternal) DeletePoolMember(ctx context.Context, membername string, name string, port string) error {
+	return e.call(ctx, "DeletePoolMember", &MemberParams{MemberName: membername, Name: name, Port: port}, nil)
+}
+
+// CheckAndClean checks pool members and if 0 members left in pool, delete monitor and delete pool
+func (e *ProviderExternal) CheckAndClean(ctx context.Context, name string, port string) error {
+	return e.call(ctx, "CheckAndClean", &PoolParams{Name: name, Port: port}, nil)
+}
+
+// PreUpdate is executed before updating anything
+func (e *ProviderExternal) PreUpdate(ctx context.Context) error {
+	return e.call(ctx, "PreUpdate", nil, nil)
+}
+
+// PostUpdate is executed after updating
+func (e *ProviderExternal) PostUpdate(ctx context.Context) error {
+	return e.call(ctx, "PostUpdate", nil, nil)
+}
+
+// CheckPools returns hosts which should be removed
+func (e *ProviderExternal) CheckPools(ctx context.Context, routes []v1.Route, hosttowatch string, membername string) (map[string]bool, error) {
+	hosts := map[string]bool{}
+	err := e.call(ctx, "CheckPools", NewCheckPoolsParams(routes, hosttowatch, membername), &hosts)
+	return hosts, err
+}
+
+// Calls returns list of methodcalls, not in use in this provider
+func (e *ProviderExternal) Calls() []string {
+	return nil
+}
+
+// CleanCalls cleans calls, not in use in this provider
+func (e *ProviderExternal) CleanCalls() {
+}
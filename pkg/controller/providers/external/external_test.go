@@ -0,0 +1,137 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package external
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller/providers/fakeprovider"
+	v1 "github.com/openshift/api/route/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestProvider(t *testing.T) (*ProviderExternal, *fakeprovider.Fakeprovider, func()) {
+	dir, err := ioutil.TempDir("", "external-provider")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	socket := filepath.Join(dir, "provider.sock")
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	fake := fakeprovider.NewFakeProvider()
+	go Serve(lis, controller.NewContextAdapter(fake))
+	e := NewProviderExternal()
+	e.network, e.address = parseAddress("unix://" + socket)
+	return e, fake, func() {
+		lis.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestExternal(t *testing.T) {
+	e, fake, cleanup := newTestProvider(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	for _, err := range []error{
+		e.PreUpdate(ctx),
+		e.CreatePool(ctx, "test", "80"),
+		e.AddPoolMember(ctx, "dc1", "test", "80"),
+		e.ModifyPool(ctx, "test", "80", "round-robin", 1, false, 1, "active", controller.MemberSettings{Ratio: 2}),
+		e.CreateMonitor(ctx, "test", "80", "/", "GET", 3, 10),
+		e.ModifyMonitor(ctx, "test", "80", "/", "GET", 3, 10),
+		e.AddMonitorToPool(ctx, "test", "80"),
+		e.DeletePoolMember(ctx, "dc1", "test", "80"),
+		e.CheckAndClean(ctx, "test", "80"),
+		e.PostUpdate(ctx),
+	} {
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	hosts, err := e.CheckPools(ctx, nil, ".example.com", "dc1")
+	if err != nil || len(hosts) != 0 {
+		t.Errorf("excepted no hosts, got %v %v", hosts, err)
+	}
+	expected := []string{"PreUpdate", "CreatePool", "AddPoolMember", "ModifyPool", "CreateMonitor", "ModifyMonitor",
+		"AddMonitorToPool", "DeletePoolMember", "CheckAndClean", "PostUpdate", "CheckPools"}
+	if !reflect.DeepEqual(fake.Calls(), expected) {
+		t.Errorf("excepted calls %v, got %v", expected, fake.Calls())
+	}
+	if len(e.idle) != 1 {
+		t.Errorf("excepted connection to be reused, got %d idle connections", len(e.idle))
+	}
+
+	fake.FailOn("CreatePool", errors.New("pool limit reached"))
+	err = e.CreatePool(ctx, "test", "443")
+	var rpcErr *Error
+	if !errors.As(err, &rpcErr) || rpcErr.Code != CodeProviderError || !strings.Contains(err.Error(), "pool limit reached") {
+		t.Errorf("excepted provider error, got %v", err)
+	}
+	fake.FailOn("CreatePool", nil)
+
+	// timeout is passed to the external provider, next call works after timed out call
+	fake.SetDelay(200 * time.Millisecond)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	err = e.PostUpdate(timeoutCtx)
+	if err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Errorf("excepted deadline exceeded, got %v", err)
+	}
+	fake.SetDelay(0)
+	if err := e.PostUpdate(ctx); err != nil {
+		t.Errorf("%v", err)
+	}
+
+	err = e.call(ctx, "Unknown", nil, nil)
+	if !errors.As(err, &rpcErr) || rpcErr.Code != CodeMethodNotFound {
+		t.Errorf("excepted method not found, got %v", err)
+	}
+}
+
+func TestCheckPoolsParams(t *testing.T) {
+	routes := []v1.Route{{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app",
+			Namespace: "demo",
+			Annotations: map[string]string{
+				controller.CustomHostAnnotation:                    "ext",
+				"kubectl.kubernetes.io/last-applied-configuration": "secret key",
+			},
+		},
+		Spec: v1.RouteSpec{
+			Host: "app.fooext.fi",
+			TLS:  &v1.TLSConfig{Certificate: "cert", Key: "secret key"},
+		},
+	}}
+	data, err := json.Marshal(NewCheckPoolsParams(routes, ".example.com", "dc1"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if strings.Contains(string(data), "secret") || strings.Contains(string(data), "tls") {
+		t.Errorf("excepted tls and other annotations to be dropped, got %s", data)
+	}
+	params := CheckPoolsParams{}
+	err = json.Unmarshal(data, &params)
+	if err != nil || len(params.Routes) != 1 || params.Routes[0].Spec.Host != "app.fooext.fi" || params.Routes[0].Namespace != "demo" ||
+		params.Routes[0].Annotations[controller.CustomHostAnnotation] != "ext" || params.MemberName != "dc1" {
+		t.Errorf("excepted host, namespace and lbenabled annotation, got %v %v", params, err)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package external
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+	v1 "github.com/openshift/api/route/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Protocol is JSON-RPC 2.0 over a stream connection, each message is one line of JSON. Methods and
+// params mirror ProviderInterface, for instance
+//
+//	{"jsonrpc":"2.0","id":1,"method":"CreatePool","params":{"name":"app.example.com","port":"80"},"timeout":60000}
+//	{"jsonrpc":"2.0","id":1,"result":null}
+//
+// Timeout is milliseconds left before the controller gives up the call, zero means no timeout.
+const jsonrpcVersion = "2.0"
+
+// annotationPrefix is prefix of the route annotations which are sent in CheckPools
+const annotationPrefix = "route.elisa.fi/"
+
+// error codes
+const (
+	// CodeParseError is returned when request is not valid JSON
+	CodeParseError = -32700
+	// CodeMethodNotFound is returned for unknown methods
+	CodeMethodNotFound = -32601
+	// CodeInvalidParams is returned when params do not match the method
+	CodeInvalidParams = -32602
+	// CodeProviderError is returned when provider returns error
+	CodeProviderError = -32000
+)
+
+// Request is a JSON-RPC request
+type Request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      uint64          `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Timeout int64           `json:"timeout,omitempty"`
+}
+
+// Response is a JSON-RPC response
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      uint64          `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Error is a JSON-RPC error
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("external provider error %d: %s", e.Code, e.Message)
+}
+
+// PoolParams are params of CreatePool, AddMonitorToPool and CheckAndClean
+type PoolParams struct {
+	Name string `json:"name"`
+	Port string `json:"port"`
+}
+
+// MemberParams are params of AddPoolMember and DeletePoolMember
+type MemberParams struct {
+	MemberName string `json:"membername"`
+	Name       string `json:"name"`
+	Port       string `json:"port"`
+}
+
+// ModifyPoolParams are params of ModifyPool
+type ModifyPoolParams struct {
+	Name                string `json:"name"`
+	Port                string `json:"port"`
+	LoadBalancingMethod string `json:"loadBalancingMethod"`
+	PGA                 int    `json:"pga"`
+	Maintenance         bool   `json:"maintenance"`
+	Prio                int    `json:"prio"`
+	Role                string `json:"role"`
+	controller.MemberSettings
+}
+
+// MonitorParams are params of CreateMonitor and ModifyMonitor
+type MonitorParams struct {
+	Host       string `json:"host"`
+	Port       string `json:"port"`
+	URI        string `json:"uri"`
+	HTTPMethod string `json:"httpMethod"`
+	Interval   int    `json:"interval"`
+	Timeout    int    `json:"timeout"`
+}
+
+// CheckPoolsParams are params of CheckPools, result is map of hosts which should be removed
+type CheckPoolsParams struct {
+	Routes      []v1.Route `json:"routes"`
+	HostToWatch string     `json:"hosttowatch"`
+	MemberName  string     `json:"membername"`
+}
+
+// NewCheckPoolsParams returns params of CheckPools. Routes contain only name, namespace, host and
+// route.elisa.fi annotations, so that certificates and keys of the routes are not sent.
+func NewCheckPoolsParams(routes []v1.Route, hosttowatch string, membername string) *CheckPoolsParams {
+	params := &CheckPoolsParams{
+		Routes:      make([]v1.Route, 0, len(routes)),
+		HostToWatch: hosttowatch,
+		MemberName:  membername,
+	}
+	for _, route := range routes {
+		annotations := map[string]string{}
+		for key, value := range route.Annotations {
+			if strings.HasPrefix(key, annotationPrefix) {
+				annotations[key] = value
+			}
+		}
+		params.Routes = append(params.Routes, v1.Route{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        route.Name,
+				Namespace:   route.Namespace,
+				Annotations: annotations,
+			},
+			Spec: v1.RouteSpec{Host: route.Spec.Host},
+		})
+	}
+	return params
+}
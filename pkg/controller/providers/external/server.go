@@ -0,0 +1,135 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package external
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"time"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+)
+
+// maxMessageSize limits size of single message, CheckPools contains all routes
+const maxMessageSize = 64 * 1024 * 1024
+
+// Serve serves provider in lis until lis is closed. It can be used to implement external providers in
+// Go, providers without context support can be wrapped with controller.NewContextAdapter.
+// Requests of one connection are executed in order, connections are served concurrently.
+func Serve(lis net.Listener, provider controller.ContextProviderInterface) error {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		go serveConn(conn, provider)
+	}
+}
+
+func serveConn(conn net.Conn, provider controller.ContextProviderInterface) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), maxMessageSize)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		resp := handle(scanner.Bytes(), provider)
+		if err := encoder.Encode(resp); err != nil {
+			log.Printf("error writing external provider response %v", err)
+			return
+		}
+	}
+}
+
+func handle(data []byte, provider controller.ContextProviderInterface) *Response {
+	req := &Request{}
+	if err := json.Unmarshal(data, req); err != nil {
+		return &Response{JSONRPC: jsonrpcVersion, Error: &Error{Code: CodeParseError, Message: err.Error()}}
+	}
+	resp := &Response{JSONRPC: jsonrpcVersion, ID: req.ID}
+	ctx := context.Background()
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.Timeout)*time.Millisecond)
+		defer cancel()
+	}
+	result, err := dispatch(ctx, provider, req)
+	if err != nil {
+		if rpcErr, ok := err.(*Error); ok {
+			resp.Error = rpcErr
+		} else {
+			resp.Error = &Error{Code: CodeProviderError, Message: err.Error()}
+		}
+		return resp
+	}
+	resp.Result, err = json.Marshal(result)
+	if err != nil {
+		resp.Error = &Error{Code: CodeProviderError, Message: err.Error()}
+	}
+	return resp
+}
+
+func decode(req *Request, params interface{}) error {
+	if err := json.Unmarshal(req.Params, params); err != nil {
+		return &Error{Code: CodeInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+func dispatch(ctx context.Context, provider controller.ContextProviderInterface, req *Request) (interface{}, error) {
+	switch req.Method {
+	case "CreatePool", "AddMonitorToPool", "CheckAndClean":
+		p := PoolParams{}
+		if err := decode(req, &p); err != nil {
+			return nil, err
+		}
+		switch req.Method {
+		case "CreatePool":
+			return nil, provider.CreatePool(ctx, p.Name, p.Port)
+		case "AddMonitorToPool":
+			return nil, provider.AddMonitorToPool(ctx, p.Name, p.Port)
+		}
+		return nil, provider.CheckAndClean(ctx, p.Name, p.Port)
+	case "AddPoolMember", "DeletePoolMember":
+		p := MemberParams{}
+		if err := decode(req, &p); err != nil {
+			return nil, err
+		}
+		if req.Method == "AddPoolMember" {
+			return nil, provider.AddPoolMember(ctx, p.MemberName, p.Name, p.Port)
+		}
+		return nil, provider.DeletePoolMember(ctx, p.MemberName, p.Name, p.Port)
+	case "ModifyPool":
+		p := ModifyPoolParams{}
+		if err := decode(req, &p); err != nil {
+			return nil, err
+		}
+		return nil, provider.ModifyPool(ctx, p.Name, p.Port, p.LoadBalancingMethod, p.PGA, p.Maintenance, p.Prio, p.Role, p.MemberSettings)
+	case "CreateMonitor", "ModifyMonitor":
+		p := MonitorParams{}
+		if err := decode(req, &p); err != nil {
+			return nil, err
+		}
+		if req.Method == "CreateMonitor" {
+			return nil, provider.CreateMonitor(ctx, p.Host, p.Port, p.URI, p.HTTPMethod, p.Interval, p.Timeout)
+		}
+		return nil, provider.ModifyMonitor(ctx, p.Host, p.Port, p.URI, p.HTTPMethod, p.Interval, p.Timeout)
+	case "PreUpdate":
+		return nil, provider.PreUpdate(ctx)
+	case "PostUpdate":
+		return nil, provider.PostUpdate(ctx)
+	case "CheckPools":
+		p := CheckPoolsParams{}
+		if err := decode(req, &p); err != nil {
+			return nil, err
+		}
+		return provider.CheckPools(ctx, p.Routes, p.HostToWatch, p.MemberName)
+	}
+	return nil, &Error{Code: CodeMethodNotFound, Message: "method " + req.Method + " not found"}
+}
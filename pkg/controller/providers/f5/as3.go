@@ -0,0 +1,380 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package f5
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+	bigip "github.com/scottdware/go-bigip"
+)
+
+const (
+	as3ProviderName       = "f5-as3"
+	as3DeclarePath        = "mgmt/shared/appsvcs/declare"
+	as3SchemaVersion      = "3.13.0"
+	defaultAS3Application = "openshift"
+	as3MonitorSuffix      = "_monitor"
+)
+
+func init() {
+	controller.RegisterDeclarativeProvider(as3ProviderName, NewAS3(NewProviderF5()))
+}
+
+// AS3 implements controller.DeclarativeProviderInterface for F5 using AS3 declarations. Managed hosts
+// of the partition are kept in one AS3 application, each update reads the current declaration of the
+// tenant, changes members of this cluster and posts the declaration back.
+type AS3 struct {
+	*ProviderF5
+	application string
+	// address is the address of pool members of this cluster
+	address string
+	// declarationLock serializes read-modify-write of the declaration
+	declarationLock sync.Mutex
+}
+
+type as3Pointer struct {
+	Use string `json:"use"`
+}
+
+type as3Server struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+type as3Member struct {
+	ServicePort     int         `json:"servicePort"`
+	Servers         []as3Server `json:"servers"`
+	ShareNodes      bool        `json:"shareNodes"`
+	PriorityGroup   int         `json:"priorityGroup"`
+	AdminState      string      `json:"adminState"`
+	Ratio           int         `json:"ratio"`
+	ConnectionLimit int         `json:"connectionLimit"`
+}
+
+type as3Pool struct {
+	Class                string       `json:"class"`
+	LoadBalancingMode    string       `json:"loadBalancingMode"`
+	MinimumMembersActive int          `json:"minimumMembersActive"`
+	SlowRampTime         int          `json:"slowRampTime"`
+	ServiceDownAction    string       `json:"serviceDownAction"`
+	Monitors             []as3Pointer `json:"monitors"`
+	Members              []as3Member  `json:"members"`
+}
+
+type as3Monitor struct {
+	Class       string `json:"class"`
+	MonitorType string `json:"monitorType"`
+	Send        string `json:"send"`
+	Receive     string `json:"receive"`
+	Interval    int    `json:"interval"`
+	Timeout     int    `json:"timeout"`
+}
+
+type as3Result struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Tenant  string `json:"tenant"`
+}
+
+type as3Response struct {
+	Results []as3Result `json:"results"`
+}
+
+// NewAS3 returns new AS3 provider
+func NewAS3(f5 *ProviderF5) *AS3 {
+	return &AS3{
+		ProviderF5:  f5,
+		application: defaultAS3Application,
+	}
+}
+
+// Initialize initilizes new provider
+func (a *AS3) Initialize() {
+	a.ProviderF5.Initialize()
+	if a.bootstrap {
+		log.Printf("F5_BOOTSTRAP is not supported with %s, partition is not bootstrapped", as3ProviderName)
+		a.bootstrap = false
+		a.httpsVirtualServer = os.Getenv("F5_HTTPS_VIRTUAL_SERVER")
+	}
+	if len(a.httpsVirtualServer) > 0 {
+		log.Printf("F5_HTTPS_VIRTUAL_SERVER is not supported with %s, certificates are not installed", as3ProviderName)
+		a.httpsVirtualServer = ""
+	}
+	if len(a.dataGroup) > 0 {
+		log.Printf("F5_DATA_GROUP is not supported with %s, hosts are not added to data group", as3ProviderName)
+		a.dataGroup = ""
+	}
+	if len(os.Getenv("ROUTER_SERVICE")) > 0 || len(os.Getenv("ROUTER_ADDRESSES")) > 0 {
+		log.Printf("ROUTER_SERVICE and ROUTER_ADDRESSES are not supported with %s, AS3_MEMBER_ADDRESS is used", as3ProviderName)
+	}
+	application := os.Getenv("AS3_APPLICATION")
+	if len(application) > 0 {
+		a.application = application
+	}
+	a.address = os.Getenv("AS3_MEMBER_ADDRESS")
+	if len(a.address) == 0 {
+		err := errors.New("AS3_MEMBER_ADDRESS environment variable needed")
+		a.reporter.CaptureErrorAndWait(err, nil)
+		panic(err)
+	}
+}
+
+// SetMemberAddresses does nothing, members use AS3_MEMBER_ADDRESS
+func (a *AS3) SetMemberAddresses(ctx context.Context, membername string, addresses []string) error {
+	return nil
+}
+
+// PreUpdate checks are we running in HA mode, if yes write to active member
+func (a *AS3) PreUpdate(ctx context.Context) error {
+	return a.ProviderF5.PreUpdate()
+}
+
+// PostUpdate syncs the configuration in f5 cluster
+func (a *AS3) PostUpdate(ctx context.Context) error {
+	return a.ProviderF5.PostUpdate()
+}
+
+// declaration returns current declaration of the tenant, or empty tenant if it does not exist
+func (a *AS3) declaration(ctx context.Context, session *bigip.BigIP) (map[string]interface{}, error) {
+	adc := map[string]interface{}{}
+	err := restCall(ctx, session, http.MethodGet, as3DeclarePath+"/"+a.partition, nil, nil, &adc)
+	var status *statusError
+	if errors.As(err, &status) && status.code == http.StatusNotFound {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading as3 declaration %w", err)
+	}
+	tenant, ok := adc[a.partition].(map[string]interface{})
+	if !ok {
+		tenant = map[string]interface{}{"class": "Tenant"}
+	}
+	return tenant, nil
+}
+
+func (a *AS3) app(tenant map[string]interface{}) map[string]interface{} {
+	app, ok := tenant[a.application].(map[string]interface{})
+	if !ok {
+		app = map[string]interface{}{
+			"class":    "Application",
+			"template": "generic",
+		}
+		tenant[a.application] = app
+	}
+	return app
+}
+
+// convert converts between generic declaration objects and as3 types
+func convert(in interface{}, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (a *AS3) pool(app map[string]interface{}, name string) (*as3Pool, error) {
+	object, ok := app[name]
+	if !ok {
+		return nil, nil
+	}
+	pool := &as3Pool{}
+	if err := convert(object, pool); err != nil {
+		return nil, fmt.Errorf("invalid as3 pool %s %v", name, err)
+	}
+	return pool, nil
+}
+
+func findAS3Member(pool *as3Pool, membername string) int {
+	for i, member := range pool.Members {
+		for _, server := range member.Servers {
+			if server.Name == membername {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// post posts declaration of the tenant
+func (a *AS3) post(ctx context.Context, session *bigip.BigIP, tenant map[string]interface{}) error {
+	body := map[string]interface{}{
+		"class":   "AS3",
+		"action":  "deploy",
+		"persist": true,
+		"declaration": map[string]interface{}{
+			"class":         "ADC",
+			"schemaVersion": as3SchemaVersion,
+			"id":            "openshift-lb-controller-" + a.partition,
+			a.partition:     tenant,
+		},
+	}
+	resp := &as3Response{}
+	err := restCall(ctx, session, http.MethodPost, as3DeclarePath, body, nil, resp)
+	if err != nil {
+		return fmt.Errorf("error posting as3 declaration %w", err)
+	}
+	for _, result := range resp.Results {
+		if result.Code != http.StatusOK {
+			return fmt.Errorf("as3 declaration of tenant %s failed: %d %s", result.Tenant, result.Code, result.Message)
+		}
+	}
+	return nil
+}
+
+// update reads the declaration, modifies it and posts it back if it changed
+func (a *AS3) update(ctx context.Context, modify func(app map[string]interface{}) error) error {
+	a.declarationLock.Lock()
+	defer a.declarationLock.Unlock()
+	session := a.getSession()
+	tenant, err := a.declaration(ctx, session)
+	if err != nil {
+		return a.checkAuth(session, err)
+	}
+	app := a.app(tenant)
+	var original map[string]interface{}
+	if err := convert(app, &original); err != nil {
+		return err
+	}
+	err = modify(app)
+	if err != nil {
+		return err
+	}
+	var modified map[string]interface{}
+	if err := convert(app, &modified); err != nil {
+		return err
+	}
+	if reflect.DeepEqual(original, modified) {
+		return nil
+	}
+	return a.checkAuth(session, a.post(ctx, session, tenant))
+}
+
+// Apply makes pools, members and monitors of the host to match state
+func (a *AS3) Apply(ctx context.Context, state controller.HostState) error {
+	return a.update(ctx, func(app map[string]interface{}) error {
+		targetmode, pga, slowRampTime, prio := poolSettings(state.LoadBalancingMethod, state.PGA, state.Prio, state.SlowRampTime)
+		adminState := "enable"
+		if state.Maintenance {
+			adminState = "disable"
+		}
+		for _, port := range state.Ports {
+			name := state.Host + "_" + port
+			servicePort, err := strconv.Atoi(port)
+			if err != nil {
+				return fmt.Errorf("invalid port %s %v", port, err)
+			}
+			app[name+as3MonitorSuffix] = &as3Monitor{
+				Class:       "Monitor",
+				MonitorType: monitorScheme(port),
+				Send:        monitorSendString(state.Host, state.Monitor.Path, state.Monitor.Method),
+				Receive:     monitorReceiveString,
+				Interval:    state.Monitor.Interval,
+				Timeout:     state.Monitor.Timeout,
+			}
+			pool, err := a.pool(app, name)
+			if err != nil {
+				return err
+			}
+			if pool == nil {
+				pool = &as3Pool{Class: "Pool", Members: []as3Member{}}
+			}
+			pool.LoadBalancingMode = targetmode
+			pool.MinimumMembersActive = pga
+			pool.SlowRampTime = slowRampTime
+			pool.ServiceDownAction = "reset"
+			pool.Monitors = []as3Pointer{{Use: name + as3MonitorSuffix}}
+			member := as3Member{
+				ServicePort:     servicePort,
+				Servers:         []as3Server{{Name: state.Member, Address: a.address}},
+				ShareNodes:      true,
+				PriorityGroup:   prio,
+				AdminState:      adminState,
+				Ratio:           memberRatio(state.MemberSettings),
+				ConnectionLimit: state.ConnectionLimit,
+			}
+			if i := findAS3Member(pool, state.Member); i >= 0 {
+				pool.Members[i] = member
+			} else {
+				pool.Members = append(pool.Members, member)
+			}
+			app[name] = pool
+		}
+		return nil
+	})
+}
+
+// Remove removes member from pools of the host. Pools and monitors without members are deleted
+func (a *AS3) Remove(ctx context.Context, host string, membername string) error {
+	return a.update(ctx, func(app map[string]interface{}) error {
+		for _, port := range controller.Ports {
+			name := host + "_" + port
+			pool, err := a.pool(app, name)
+			if err != nil {
+				return err
+			}
+			if pool == nil {
+				continue
+			}
+			if i := findAS3Member(pool, membername); i >= 0 {
+				pool.Members = append(pool.Members[:i], pool.Members[i+1:]...)
+			}
+			if len(pool.Members) > 0 {
+				app[name] = pool
+				continue
+			}
+			delete(app, name)
+			delete(app, name+as3MonitorSuffix)
+		}
+		return nil
+	})
+}
+
+// ListHosts returns hosts which have membername as member
+func (a *AS3) ListHosts(ctx context.Context, membername string) ([]string, error) {
+	session := a.getSession()
+	tenant, err := a.declaration(ctx, session)
+	if err != nil {
+		return nil, a.checkAuth(session, err)
+	}
+	app := a.app(tenant)
+	found := map[string]bool{}
+	hosts := []string{}
+	names := []string{}
+	for name := range app {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		object, ok := app[name].(map[string]interface{})
+		if !ok || object["class"] != "Pool" {
+			continue
+		}
+		pool, err := a.pool(app, name)
+		if err != nil {
+			return nil, err
+		}
+		host := strings.Split(name, "_")[0]
+		if !found[host] && findAS3Member(pool, membername) >= 0 {
+			found[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, nil
+}
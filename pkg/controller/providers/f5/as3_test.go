@@ -0,0 +1,115 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package f5
+
+import (
+	"context"
+	"testing"
+
+	bigip "github.com/scottdware/go-bigip"
+)
+
+func newTestAS3(fake *fakeBigIP, address string) *AS3 {
+	newf5 := NewProviderF5()
+	newf5.partition = "xx"
+	newf5.session = bigip.NewSession(fake.URL(), "yy", "xx", nil)
+	a := NewAS3(newf5)
+	a.address = address
+	return a
+}
+
+func TestAS3(t *testing.T) {
+	fake := newFakeBigIP()
+	defer fake.Close()
+	ctx := context.Background()
+
+	// other applications of the tenant are kept
+	fake.tenants["xx"] = map[string]interface{}{
+		"class": "Tenant",
+		"other": map[string]interface{}{"class": "Application", "template": "generic"},
+	}
+
+	dc1 := newTestAS3(fake, "10.0.0.1")
+	dc2 := newTestAS3(fake, "10.0.0.2")
+	err := dc1.Apply(ctx, newTestState("test", "dc1"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = dc2.Apply(ctx, newTestState("test", "dc2"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if fake.as3Posts != 2 {
+		t.Errorf("excepted 2 declarations, got %d", fake.as3Posts)
+	}
+
+	tenant, err := dc1.declaration(ctx, dc1.session)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, ok := tenant["other"]; !ok {
+		t.Errorf("other application should be kept, got %v", tenant)
+	}
+	app := dc1.app(tenant)
+	pool, _ := dc1.pool(app, "test_443")
+	if pool == nil || len(pool.Members) != 2 || pool.Monitors[0].Use != "test_443_monitor" || pool.Members[1].Servers[0].Address != "10.0.0.2" {
+		t.Errorf("excepted pool with two members, got %v", pool)
+	}
+	if monitor, ok := app["test_443_monitor"].(map[string]interface{}); !ok || monitor["monitorType"] != "https" {
+		t.Errorf("excepted https monitor, got %v", app["test_443_monitor"])
+	}
+
+	// nothing changed, nothing is posted
+	err = dc1.Apply(ctx, newTestState("test", "dc1"))
+	if err != nil || fake.as3Posts != 2 {
+		t.Errorf("excepted no declaration when nothing changed, got %d %v", fake.as3Posts, err)
+	}
+
+	state := newTestState("test", "dc1")
+	// roles are resolved to priority and pga by the controller
+	state.Role = "active"
+	state.Prio = 20
+	state.PGA = 1
+	state.Maintenance = true
+	err = dc1.Apply(ctx, state)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	tenant, _ = dc1.declaration(ctx, dc1.session)
+	pool, _ = dc1.pool(dc1.app(tenant), "test_80")
+	if pool.Members[0].PriorityGroup != 20 || pool.Members[0].AdminState != "disable" || pool.MinimumMembersActive != 1 {
+		t.Errorf("excepted active disabled member, got %v", pool.Members[0])
+	}
+
+	hosts, err := dc2.ListHosts(ctx, "dc2")
+	if err != nil || len(hosts) != 1 || hosts[0] != "test" {
+		t.Errorf("excepted host test, got %v %v", hosts, err)
+	}
+
+	// router addresses are ignored, members use AS3_MEMBER_ADDRESS
+	err = dc1.SetMemberAddresses(ctx, "dc1", []string{"10.0.0.1"})
+	if err != nil {
+		t.Errorf("excepted router addresses to be ignored, got %v", err)
+	}
+
+	err = dc1.Remove(ctx, "test", "dc1")
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	hosts, _ = dc1.ListHosts(ctx, "dc1")
+	if len(hosts) != 0 {
+		t.Errorf("excepted no hosts, got %v", hosts)
+	}
+	err = dc2.Remove(ctx, "test", "dc2")
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	tenant, _ = dc1.declaration(ctx, dc1.session)
+	if app := dc1.app(tenant); len(app) != 2 {
+		t.Errorf("excepted empty application, got %v", app)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package f5
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	bigip "github.com/scottdware/go-bigip"
+)
+
+const (
+	defaultHTTPVirtualServer  = "http"
+	defaultHTTPSVirtualServer = "https"
+	defaultSSLCertificate     = "/Common/default.crt"
+	defaultSSLKey             = "/Common/default.key"
+	bootstrapHTTPProfile      = "openshift_http"
+	bootstrapSSLProfile       = "openshift_clientssl"
+	bootstrapRule             = "openshift_router"
+)
+
+type f5VirtualServer struct {
+	Destination string   `json:"destination"`
+	Rules       []string `json:"rules"`
+}
+
+type f5Rule struct {
+	APIAnonymous string `json:"apiAnonymous"`
+}
+
+// destination returns destination of the virtual server, port of ipv6 address is separated with a dot
+func (f5 *ProviderF5) destination(port string) string {
+	separator := ":"
+	if strings.Contains(f5.virtualAddress, ":") {
+		separator = "."
+	}
+	return getNameWithPool(f5.partition, f5.virtualAddress+separator+port)
+}
+
+// ensureBootstrap creates virtual servers, profiles and iRule of the partition once if bootstrap is enabled
+func (f5 *ProviderF5) ensureBootstrap(ctx context.Context) error {
+	if !f5.bootstrap {
+		return nil
+	}
+	f5.bootstrapLock.Lock()
+	defer f5.bootstrapLock.Unlock()
+	if f5.bootstrapped {
+		return nil
+	}
+	session := f5.getSession()
+	err := f5.checkAuth(session, f5.bootstrapPartition(ctx, session))
+	if err != nil {
+		return err
+	}
+	f5.bootstrapped = true
+	return nil
+}
+
+// bootstrapPartition makes sure that http and ssl profiles, the iRule and the virtual servers exist. Existing
+// virtual servers get the configured destination and the iRule, their profiles are not changed. All changes
+// are made in one transaction.
+func (f5 *ProviderF5) bootstrapPartition(ctx context.Context, session *bigip.BigIP) error {
+	// data group must exist before the iRule which refers to it
+	if _, err := f5.dataGroupRecords(ctx, session); err != nil {
+		return err
+	}
+	httpProfile := f5.fullPath(bootstrapHTTPProfile)
+	sslProfile := f5.fullPath(bootstrapSSLProfile)
+	rule := f5.fullPath(bootstrapRule)
+	operations := []operation{}
+
+	profiles := []struct {
+		collection string
+		body       map[string]interface{}
+	}{
+		{"ltm/profile/http", map[string]interface{}{
+			"name":         httpProfile,
+			"defaultsFrom": "/Common/http",
+		}},
+		{"ltm/profile/client-ssl", map[string]interface{}{
+			"name":         sslProfile,
+			"defaultsFrom": f5.clientSSLParent,
+			"sniDefault":   "true",
+			"certKeyChain": []interface{}{map[string]interface{}{
+				"name": "default",
+				"cert": f5.sslCertificate,
+				"key":  f5.sslKey,
+			}},
+		}},
+	}
+	for _, profile := range profiles {
+		object, err := getObject(ctx, session, profile.collection+"/"+iControlName(profile.body["name"].(string)))
+		if err != nil {
+			return err
+		}
+		if object == nil {
+			operations = append(operations, operation{http.MethodPost, profile.collection, profile.body})
+		}
+	}
+
+	content := iRule(f5.dataGroup, f5.roles.NonPersistentPrios())
+	existingRule := &f5Rule{}
+	err := restCall(ctx, session, http.MethodGet, "ltm/rule/"+iControlName(rule), nil, nil, existingRule)
+	switch {
+	case isNotFound(err):
+		operations = append(operations, operation{http.MethodPost, "ltm/rule", map[string]interface{}{
+			"name":         rule,
+			"apiAnonymous": content,
+		}})
+	case err != nil:
+		return err
+	case existingRule.APIAnonymous != content:
+		operations = append(operations, operation{http.MethodPatch, "ltm/rule/" + iControlName(rule), map[string]interface{}{
+			"apiAnonymous": content,
+		}})
+	}
+
+	virtualServers := []struct {
+		name     string
+		port     string
+		profiles []interface{}
+	}{
+		{f5.fullPath(f5.httpVirtualServer), "80", []interface{}{
+			map[string]interface{}{"name": "/Common/tcp"},
+			map[string]interface{}{"name": httpProfile},
+		}},
+		{f5.virtualServer(), "443", []interface{}{
+			map[string]interface{}{"name": "/Common/tcp"},
+			map[string]interface{}{"name": httpProfile},
+			map[string]interface{}{"name": sslProfile, "context": "clientside"},
+		}},
+	}
+	for _, vs := range virtualServers {
+		existing := &f5VirtualServer{}
+		err := restCall(ctx, session, http.MethodGet, "ltm/virtual/"+iControlName(vs.name), nil, nil, existing)
+		if isNotFound(err) {
+			operations = append(operations, operation{http.MethodPost, "ltm/virtual", map[string]interface{}{
+				"name":                     vs.name,
+				"destination":              f5.destination(vs.port),
+				"ipProtocol":               "tcp",
+				"sourceAddressTranslation": map[string]interface{}{"type": "automap"},
+				"profiles":                 vs.profiles,
+				"rules":                    []string{rule},
+			}})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if existing.Destination != f5.destination(vs.port) || !contains(existing.Rules, rule) {
+			rules := existing.Rules
+			if !contains(rules, rule) {
+				rules = append(rules, rule)
+			}
+			operations = append(operations, operation{http.MethodPatch, "ltm/virtual/" + iControlName(vs.name), map[string]interface{}{
+				"destination": f5.destination(vs.port),
+				"rules":       rules,
+			}})
+		}
+	}
+	if len(operations) > 0 {
+		log.Printf("committing %d changes to bootstrap partition %s", len(operations), f5.partition)
+	}
+	return execute(ctx, session, operations)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package f5
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+	bigip "github.com/scottdware/go-bigip"
+)
+
+func TestBootstrap(t *testing.T) {
+	fake := newFakeBigIP()
+	defer fake.Close()
+
+	newf5 := NewProviderF5()
+	newf5.addresses = []string{fake.URL()}
+	newf5.partition = "xx"
+	newf5.dataGroup = "hosts"
+	newf5.bootstrap = true
+	newf5.virtualAddress = "10.0.0.10"
+	newf5.httpsVirtualServer = defaultHTTPSVirtualServer
+	newf5.session = bigip.NewSession(newf5.addresses[0], "yy", "xx", nil)
+
+	err := newf5.PreUpdate()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if fake.commits != 1 {
+		t.Errorf("excepted one commit, got %d", fake.commits)
+	}
+	for _, key := range []string{"ltm/profile/http/openshift_http", "ltm/profile/client-ssl/openshift_clientssl", "ltm/data-group/internal/hosts"} {
+		if _, ok := fake.objects[key]; !ok {
+			t.Errorf("excepted %s to be created", key)
+		}
+	}
+	rule := fake.objects["ltm/rule/openshift_router"]
+	if rule == nil || !strings.Contains(rule["apiAnonymous"].(string), "equals hosts]") {
+		t.Errorf("excepted iRule which uses the data group, got %v", rule)
+	}
+	https := fake.objects["ltm/virtual/https"]
+	if https == nil || https["destination"] != "/xx/10.0.0.10:443" || len(https["profiles"].([]interface{})) != 3 {
+		t.Errorf("excepted https virtual server, got %v", https)
+	}
+	if http := fake.objects["ltm/virtual/http"]; http == nil || http["rules"].([]interface{})[0] != "/xx/openshift_router" {
+		t.Errorf("excepted http virtual server with the iRule, got %v", http)
+	}
+
+	// bootstrap is done once
+	err = newf5.PreUpdate()
+	if err != nil || fake.commits != 1 {
+		t.Errorf("excepted no changes, got %d commits %v", fake.commits, err)
+	}
+
+	// existing virtual server gets new destination and keeps its rules, changed iRule is updated
+	newf5.virtualAddress = "2001:db8::10"
+	newf5.dataGroup = ""
+	fake.objects["ltm/virtual/http"]["rules"] = []interface{}{"/Common/other"}
+	err = newf5.bootstrapPartition(context.Background(), newf5.session)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	http := fake.objects["ltm/virtual/http"]
+	if http["destination"] != "/xx/2001:db8::10.80" || len(http["rules"].([]interface{})) != 2 {
+		t.Errorf("excepted changed destination and both rules, got %v", http)
+	}
+	if !strings.Contains(fake.objects["ltm/rule/openshift_router"]["apiAnonymous"].(string), "catch") {
+		t.Errorf("excepted iRule without data group")
+	}
+	commits := fake.commits
+	err = newf5.bootstrapPartition(context.Background(), newf5.session)
+	if err != nil || fake.commits != commits {
+		t.Errorf("excepted no changes, got %d commits %v", fake.commits-commits, err)
+	}
+}
+
+func TestIRulePersistence(t *testing.T) {
+	rule := iRule("hosts", controller.DefaultRoles().NonPersistentPrios())
+	if !strings.Contains(rule, "if { [LB::server priority] == 15 } {") {
+		t.Errorf("excepted standby priority without persistence, got\n%s", rule)
+	}
+	roles, err := controller.ParseRoles(`{"primary":{"prio":30},"secondary":{"prio":10,"persist":false},"disaster":{"prio":5,"persist":false}}`)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	rule = iRule("hosts", roles.NonPersistentPrios())
+	if !strings.Contains(rule, "if { [LB::server priority] == 15 || [LB::server priority] == 10 || [LB::server priority] == 5 } {") {
+		t.Errorf("excepted priorities of standby, secondary and disaster without persistence, got\n%s", rule)
+	}
+	if rule = iRule("", nil); strings.Contains(rule, "LB_SELECTED") {
+		t.Errorf("excepted iRule without LB_SELECTED, got\n%s", rule)
+	}
+}
@@ -0,0 +1,289 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package f5
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+	bigip "github.com/scottdware/go-bigip"
+)
+
+const (
+	defaultClientSSLParent = "/Common/clientssl"
+	uploadPath             = "mgmt/shared/file-transfer/uploads/"
+	// uploadDirectory is the directory where f5 stores uploaded files
+	uploadDirectory = "/var/config/rest/downloads/"
+)
+
+// certificateFiles contains names of the f5 objects of host certificate
+type certificateFiles struct {
+	cert    string
+	key     string
+	chain   string
+	profile string
+}
+
+type f5Object struct {
+	FullPath    string `json:"fullPath"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type f5Objects struct {
+	Items []f5Object `json:"items"`
+}
+
+func (f5 *ProviderF5) certificateFiles(host string) certificateFiles {
+	return certificateFiles{
+		cert:    getNameWithPool(f5.partition, host+".crt"),
+		key:     getNameWithPool(f5.partition, host+".key"),
+		chain:   getNameWithPool(f5.partition, host+"_chain.crt"),
+		profile: getNameWithPool(f5.partition, host+"_clientssl"),
+	}
+}
+
+// fullPath returns full path of the object, names without partition are in the partition of the controller
+func (f5 *ProviderF5) fullPath(name string) string {
+	if strings.HasPrefix(name, "/") {
+		return name
+	}
+	return getNameWithPool(f5.partition, name)
+}
+
+// virtualServer returns full path of the https virtual server
+func (f5 *ProviderF5) virtualServer() string {
+	return f5.fullPath(f5.httpsVirtualServer)
+}
+
+// fingerprint returns SHA256 fingerprint of the first certificate in the same format as f5 does
+func fingerprint(data string) (string, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", errors.New("invalid certificate, PEM encoded certificate expected")
+	}
+	sum := sha256.Sum256(block.Bytes)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return "SHA256/" + strings.Join(hex, ":"), nil
+}
+
+func isNotFound(err error) bool {
+	var status *statusError
+	return errors.As(err, &status) && status.code == http.StatusNotFound
+}
+
+// getObject returns object of the path, nil if it does not exist
+func getObject(ctx context.Context, session *bigip.BigIP, path string) (*f5Object, error) {
+	object := &f5Object{}
+	err := restCall(ctx, session, http.MethodGet, path, nil, nil, object)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+// upload uploads file to f5, it can be installed from uploadDirectory
+func upload(ctx context.Context, session *bigip.BigIP, name string, data []byte) error {
+	header := map[string]string{
+		"Content-Type":  "application/octet-stream",
+		"Content-Range": fmt.Sprintf("0-%d/%d", len(data)-1, len(data)),
+	}
+	err := restCall(ctx, session, http.MethodPost, uploadPath+name, data, header, nil)
+	if err != nil {
+		return fmt.Errorf("error uploading %s %w", name, err)
+	}
+	return nil
+}
+
+// profileAttached returns true if the virtual server has the profile
+func profileAttached(ctx context.Context, session *bigip.BigIP, virtualServer string, profile string) (bool, error) {
+	profiles := &f5Objects{}
+	err := restCall(ctx, session, http.MethodGet, "ltm/virtual/"+iControlName(virtualServer)+"/profiles", nil, nil, profiles)
+	if err != nil {
+		return false, fmt.Errorf("error reading profiles of virtual server %s %w", virtualServer, err)
+	}
+	for _, item := range profiles.Items {
+		if item.FullPath == profile {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SetCertificate installs certificate and key of the host, and client ssl profile which uses them
+// for the host name to the https virtual server. All changes are made in one transaction.
+func (f5 *ProviderF5) SetCertificate(ctx context.Context, host string, certificate controller.Certificate) error {
+	if len(f5.httpsVirtualServer) == 0 {
+		return nil
+	}
+	session := f5.getSession()
+	return f5.checkAuth(session, f5.setCertificate(ctx, session, host, certificate))
+}
+
+// operation is iControl REST call which is executed in transaction
+type operation struct {
+	method string
+	path   string
+	body   interface{}
+}
+
+// execute executes operations in one transaction
+func execute(ctx context.Context, session *bigip.BigIP, operations []operation) error {
+	if len(operations) == 0 {
+		return nil
+	}
+	tx, err := beginTransaction(ctx, session)
+	if err != nil {
+		return err
+	}
+	for _, op := range operations {
+		if err = tx.add(ctx, op.method, op.path, op.body); err != nil {
+			tx.abort(ctx)
+			return err
+		}
+	}
+	return tx.commit(ctx)
+}
+
+// installFile returns operation which installs uploaded certificate or key, or replaces existing one
+func installFile(kind string, name string, exists bool, upload string) operation {
+	body := map[string]interface{}{"sourcePath": "file:" + uploadDirectory + upload}
+	if exists {
+		return operation{http.MethodPatch, "sys/file/" + kind + "/" + iControlName(name), body}
+	}
+	body["name"] = name
+	return operation{http.MethodPost, "sys/file/" + kind, body}
+}
+
+func (f5 *ProviderF5) setCertificate(ctx context.Context, session *bigip.BigIP, host string, certificate controller.Certificate) error {
+	files := f5.certificateFiles(host)
+	certFingerprint, err := fingerprint(certificate.Certificate)
+	if err != nil {
+		return err
+	}
+	chainFingerprint := ""
+	if len(certificate.CACertificate) > 0 {
+		chainFingerprint, err = fingerprint(certificate.CACertificate)
+		if err != nil {
+			return err
+		}
+	}
+	cert, err := getObject(ctx, session, "sys/file/ssl-cert/"+iControlName(files.cert))
+	if err != nil {
+		return err
+	}
+	chain, err := getObject(ctx, session, "sys/file/ssl-cert/"+iControlName(files.chain))
+	if err != nil {
+		return err
+	}
+	profile, err := getObject(ctx, session, "ltm/profile/client-ssl/"+iControlName(files.profile))
+	if err != nil {
+		return err
+	}
+	attached, err := profileAttached(ctx, session, f5.virtualServer(), files.profile)
+	if err != nil {
+		return err
+	}
+
+	operations := []operation{}
+	if cert == nil || cert.Fingerprint != certFingerprint {
+		if err = upload(ctx, session, host+".key", []byte(certificate.Key)); err != nil {
+			return err
+		}
+		if err = upload(ctx, session, host+".crt", []byte(certificate.Certificate)); err != nil {
+			return err
+		}
+		operations = append(operations, installFile("ssl-key", files.key, cert != nil, host+".key"), installFile("ssl-cert", files.cert, cert != nil, host+".crt"))
+	}
+	if len(chainFingerprint) > 0 && (chain == nil || chain.Fingerprint != chainFingerprint) {
+		if err = upload(ctx, session, host+"_chain.crt", []byte(certificate.CACertificate)); err != nil {
+			return err
+		}
+		operations = append(operations, installFile("ssl-cert", files.chain, chain != nil, host+"_chain.crt"))
+	}
+	certKeyChain := map[string]interface{}{
+		"name": host,
+		"cert": files.cert,
+		"key":  files.key,
+	}
+	if len(chainFingerprint) > 0 {
+		certKeyChain["chain"] = files.chain
+	}
+	desiredProfile := map[string]interface{}{
+		"serverName":   host,
+		"sniDefault":   "false",
+		"certKeyChain": []interface{}{certKeyChain},
+	}
+	if profile == nil {
+		desiredProfile["name"] = files.profile
+		desiredProfile["defaultsFrom"] = f5.clientSSLParent
+		operations = append(operations, operation{http.MethodPost, "ltm/profile/client-ssl", desiredProfile})
+	} else if len(operations) > 0 || (chain != nil && len(chainFingerprint) == 0) {
+		operations = append(operations, operation{http.MethodPatch, "ltm/profile/client-ssl/" + iControlName(files.profile), desiredProfile})
+	}
+	if !attached {
+		operations = append(operations, operation{http.MethodPost, "ltm/virtual/" + iControlName(f5.virtualServer()) + "/profiles", map[string]interface{}{
+			"name":    files.profile,
+			"context": "clientside",
+		}})
+	}
+	if len(operations) > 0 {
+		log.Printf("committing certificate of host %s", host)
+	}
+	return execute(ctx, session, operations)
+}
+
+// DeleteCertificate removes client ssl profile, certificate and key of the host
+func (f5 *ProviderF5) DeleteCertificate(ctx context.Context, host string) error {
+	if len(f5.httpsVirtualServer) == 0 {
+		return nil
+	}
+	session := f5.getSession()
+	return f5.checkAuth(session, f5.deleteCertificate(ctx, session, host))
+}
+
+func (f5 *ProviderF5) deleteCertificate(ctx context.Context, session *bigip.BigIP, host string) error {
+	files := f5.certificateFiles(host)
+	attached, err := profileAttached(ctx, session, f5.virtualServer(), files.profile)
+	if err != nil {
+		return err
+	}
+	operations := []operation{}
+	if attached {
+		operations = append(operations, operation{http.MethodDelete, "ltm/virtual/" + iControlName(f5.virtualServer()) + "/profiles/" + iControlName(files.profile), nil})
+	}
+	for _, path := range []string{
+		"ltm/profile/client-ssl/" + iControlName(files.profile),
+		"sys/file/ssl-cert/" + iControlName(files.cert),
+		"sys/file/ssl-cert/" + iControlName(files.chain),
+		"sys/file/ssl-key/" + iControlName(files.key),
+	} {
+		object, err := getObject(ctx, session, path)
+		if err != nil {
+			return err
+		}
+		if object != nil {
+			operations = append(operations, operation{http.MethodDelete, path, nil})
+		}
+	}
+	if len(operations) > 0 {
+		log.Printf("deleting certificate of host %s", host)
+	}
+	return execute(ctx, session, operations)
+}
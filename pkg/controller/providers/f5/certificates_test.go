@@ -0,0 +1,127 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package f5
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+	bigip "github.com/scottdware/go-bigip"
+)
+
+func newTestCertificate(t *testing.T, host string) controller.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return controller.Certificate{
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Key:         string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})),
+	}
+}
+
+func TestCertificates(t *testing.T) {
+	fake := newFakeBigIP()
+	defer fake.Close()
+	fake.objects["ltm/virtual/https"] = map[string]interface{}{"name": "https", "partition": "ext", "fullPath": "/ext/https"}
+
+	newf5 := NewProviderF5()
+	newf5.addresses = []string{fake.URL()}
+	newf5.partition = "ext"
+	newf5.httpsVirtualServer = "https"
+	newf5.session = bigip.NewSession(newf5.addresses[0], "yy", "xx", nil)
+	ctx := context.Background()
+
+	certificate := newTestCertificate(t, "fooext.fi")
+	err := newf5.SetCertificate(ctx, "fooext.fi", certificate)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	profile, ok := fake.objects["ltm/profile/client-ssl/fooext.fi_clientssl"]
+	if !ok || profile["serverName"] != "fooext.fi" || profile["defaultsFrom"] != defaultClientSSLParent {
+		t.Errorf("excepted client ssl profile, got %v", profile)
+	}
+	if _, ok := fake.objects["ltm/virtual/https/profiles/fooext.fi_clientssl"]; !ok {
+		t.Errorf("excepted profile to be attached to virtual server")
+	}
+	if _, ok := fake.objects["sys/file/ssl-key/fooext.fi.key"]; !ok || string(fake.uploads["fooext.fi.key"]) != certificate.Key {
+		t.Errorf("excepted key to be installed")
+	}
+
+	// nothing changed
+	commits := fake.commits
+	err = newf5.SetCertificate(ctx, "fooext.fi", certificate)
+	if err != nil || fake.commits != commits {
+		t.Errorf("excepted no changes, got %d commits %v", fake.commits-commits, err)
+	}
+
+	// rotated certificate replaces the old one
+	rotated := newTestCertificate(t, "fooext.fi")
+	rotated.CACertificate = newTestCertificate(t, "ca").Certificate
+	err = newf5.SetCertificate(ctx, "fooext.fi", rotated)
+	if err != nil || fake.commits != commits+1 {
+		t.Fatalf("excepted one commit, got %d %v", fake.commits-commits, err)
+	}
+	expected, _ := fingerprint(rotated.Certificate)
+	if fake.objects["sys/file/ssl-cert/fooext.fi.crt"]["fingerprint"] != expected {
+		t.Errorf("excepted rotated certificate, got %v", fake.objects["sys/file/ssl-cert/fooext.fi.crt"])
+	}
+	chain := fake.objects["ltm/profile/client-ssl/fooext.fi_clientssl"]["certKeyChain"].([]interface{})[0].(map[string]interface{})
+	if chain["chain"] != "/ext/fooext.fi_chain.crt" {
+		t.Errorf("excepted chain in profile, got %v", chain)
+	}
+
+	err = newf5.SetCertificate(ctx, "fooext.fi", controller.Certificate{Certificate: "invalid"})
+	if err == nil {
+		t.Errorf("excepted error from invalid certificate")
+	}
+
+	err = newf5.DeleteCertificate(ctx, "fooext.fi")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for key := range fake.objects {
+		if key != "ltm/virtual/https" {
+			t.Errorf("excepted %s to be removed", key)
+		}
+	}
+	err = newf5.DeleteCertificate(ctx, "fooext.fi")
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	// certificates are disabled without virtual server
+	newf5.httpsVirtualServer = ""
+	err = newf5.SetCertificate(ctx, "fooext.fi", certificate)
+	if err != nil || len(fake.objects) != 1 {
+		t.Errorf("excepted no changes, got %v", err)
+	}
+}
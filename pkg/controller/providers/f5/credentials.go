@@ -0,0 +1,104 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package f5
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+)
+
+const defaultCredentialsInterval = 30 * time.Second
+
+// credentialFiles contains paths of files containing credentials, for instance mounted secret.
+// Empty path means that the credential is read from environment variable.
+type credentialFiles struct {
+	username string
+	password string
+}
+
+func (c credentialFiles) enabled() bool {
+	return len(c.username) > 0 || len(c.password) > 0
+}
+
+func readCredential(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading credentials %v", err)
+	}
+	value := strings.TrimSpace(string(data))
+	if len(value) == 0 {
+		return "", fmt.Errorf("credentials file %s is empty", path)
+	}
+	return value, nil
+}
+
+// loadCredentials reads credentials from files. If they have changed, all sessions are renewed on
+// next use. It must be called holding the write lock.
+func (f5 *ProviderF5) loadCredentials() (bool, error) {
+	username := f5.username
+	password := f5.password
+	var err error
+	if len(f5.credentialFiles.username) > 0 {
+		username, err = readCredential(f5.credentialFiles.username)
+		if err != nil {
+			return false, err
+		}
+	}
+	if len(f5.credentialFiles.password) > 0 {
+		password, err = readCredential(f5.credentialFiles.password)
+		if err != nil {
+			return false, err
+		}
+	}
+	if username == f5.username && password == f5.password {
+		return false, nil
+	}
+	f5.username = username
+	f5.password = password
+	f5.staleSession = f5.session
+	f5.sessions = nil
+	return true, nil
+}
+
+// reloadCredentials reads credentials from files and logs if they have changed
+func (f5 *ProviderF5) reloadCredentials() {
+	f5.lock.Lock()
+	defer f5.lock.Unlock()
+	changed, err := f5.loadCredentials()
+	if err != nil {
+		f5.reporter.CaptureError(err, nil)
+		return
+	}
+	if changed {
+		log.Printf("f5 credentials changed, renewing sessions")
+	}
+}
+
+// watchCredentials reloads credentials from files periodically until stop is closed
+func (f5 *ProviderF5) watchCredentials(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f5.reloadCredentials()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Close stops periodic reload of credentials
+func (f5 *ProviderF5) Close() {
+	if f5.stopCredentials != nil {
+		close(f5.stopCredentials)
+		f5.stopCredentials = nil
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package f5
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	bigip "github.com/scottdware/go-bigip"
+)
+
+type dataGroup struct {
+	Records []bigip.DataGroupRecord `json:"records"`
+}
+
+// dataGroupPath returns path of the data group which maps hosts to pools
+func (f5 *ProviderF5) dataGroupPath() string {
+	return "ltm/data-group/internal/" + iControlName(getNameWithPool(f5.partition, f5.dataGroup))
+}
+
+// poolRecord returns data group record of the pool, the key is same as the pool name and the value is full path of the pool
+func (f5 *ProviderF5) poolRecord(name string, port string) bigip.DataGroupRecord {
+	return bigip.DataGroupRecord{Name: name + "_" + port, Data: getNameWithPool(f5.partition, name+"_"+port)}
+}
+
+// dataGroupRecords returns records of the data group by key, the data group is created if it does not
+// exist. Returns nil if the data group is not used.
+func (f5 *ProviderF5) dataGroupRecords(ctx context.Context, session *bigip.BigIP) (map[string]string, error) {
+	if len(f5.dataGroup) == 0 {
+		return nil, nil
+	}
+	group := &dataGroup{}
+	err := restCall(ctx, session, http.MethodGet, f5.dataGroupPath(), nil, nil, group)
+	if isNotFound(err) {
+		err = restCall(ctx, session, http.MethodPost, "ltm/data-group/internal", map[string]interface{}{
+			"name": getNameWithPool(f5.partition, f5.dataGroup),
+			"type": "string",
+		}, nil, nil)
+		if err != nil && !alreadyExist(err, f5.partition) {
+			return nil, fmt.Errorf("error creating data group %s %w", f5.dataGroup, err)
+		}
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading data group %s %w", f5.dataGroup, err)
+	}
+	records := map[string]string{}
+	for _, record := range group.Records {
+		records[record.Name] = record.Data
+	}
+	return records, nil
+}
+
+// recordOperation returns operation which adds or deletes single record. Records are not replaced as
+// a whole, so controllers of other clusters can change the same data group at the same time.
+func (f5 *ProviderF5) recordOperation(record bigip.DataGroupRecord, add bool) operation {
+	option := fmt.Sprintf("records delete { %s }", record.Name)
+	if add {
+		option = fmt.Sprintf("records add { %s { data %s } }", record.Name, record.Data)
+	}
+	return operation{http.MethodPatch, f5.dataGroupPath() + "?options=" + url.PathEscape(option), map[string]interface{}{}}
+}
+
+// recordChange returns operation which adds the pool to records or deletes it, nil if nothing needs to be changed
+func (f5 *ProviderF5) recordChange(records map[string]string, name string, port string, add bool) *operation {
+	if records == nil {
+		return nil
+	}
+	record := f5.poolRecord(name, port)
+	if _, ok := records[record.Name]; ok == add {
+		return nil
+	}
+	op := f5.recordOperation(record, add)
+	return &op
+}
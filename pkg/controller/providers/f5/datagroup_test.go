@@ -0,0 +1,118 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package f5
+
+import (
+	"context"
+	"testing"
+
+	bigip "github.com/scottdware/go-bigip"
+)
+
+// records returns records of the fake data group by key
+func (f *fakeBigIP) records(name string) map[string]string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	object, ok := f.objects["ltm/data-group/internal/"+name]
+	if !ok {
+		return nil
+	}
+	records := map[string]string{}
+	existing, _ := object["records"].([]interface{})
+	for _, record := range existing {
+		r := record.(map[string]interface{})
+		records[r["name"].(string)] = r["data"].(string)
+	}
+	return records
+}
+
+func TestDataGroup(t *testing.T) {
+	fake := newFakeBigIP()
+	defer fake.Close()
+
+	newf5 := NewProviderF5()
+	newf5.partition = "xx"
+	newf5.dataGroup = "hosts"
+	newf5.session = bigip.NewSession(fake.URL(), "yy", "xx", nil)
+
+	err := newf5.CreatePool("test", "80")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	records := fake.records("hosts")
+	if fake.commits != 1 || len(records) != 1 || records["test_80"] != "/xx/test_80" {
+		t.Errorf("excepted record in the same commit as the pool, got %d commits %v", fake.commits, records)
+	}
+	// pool already exists
+	err = newf5.CreatePool("test", "80")
+	if err != nil || fake.commits != 1 {
+		t.Errorf("excepted no changes, got %d commits %v", fake.commits, err)
+	}
+	// missing record is added to existing pool
+	delete(fake.objects, "ltm/data-group/internal/hosts")
+	err = newf5.CreatePool("test", "80")
+	if records := fake.records("hosts"); err != nil || len(records) != 1 {
+		t.Errorf("excepted record of the pool, got %v %v", records, err)
+	}
+	err = newf5.CreateMonitor("test", "80", "/", "GET", 3, 10)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if fake.objects["ltm/monitor/http/test_80"] == nil {
+		t.Errorf("excepted monitor to be created")
+	}
+	commits := fake.commits
+	err = newf5.CheckAndClean("test", "80")
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if records := fake.records("hosts"); fake.commits != commits+1 || len(records) != 0 {
+		t.Errorf("excepted record to be removed in the same commit as the pool, got %d commits %v", fake.commits-commits, records)
+	}
+	if fake.objects["ltm/pool/test_80"] != nil || fake.objects["ltm/monitor/http/test_80"] != nil {
+		t.Errorf("excepted pool and monitor to be removed")
+	}
+
+	// record of other cluster is kept
+	d := NewDeclarativeF5(newf5)
+	ctx := context.Background()
+	err = newf5.CreatePool("other", "80")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	commits = fake.commits
+	err = d.Apply(ctx, newTestState("test", "cluster1"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	records = fake.records("hosts")
+	if fake.commits != commits+1 || len(records) != 3 || records["test_443"] != "/xx/test_443" {
+		t.Errorf("excepted records in the same commit as pools, got %d commits %v", fake.commits-commits, records)
+	}
+	err = d.Apply(ctx, newTestState("test", "cluster1"))
+	if err != nil || fake.commits != commits+1 {
+		t.Errorf("excepted no changes, got %d commits %v", fake.commits-commits, err)
+	}
+
+	// missing record is added to existing pool
+	delete(fake.objects, "ltm/data-group/internal/hosts")
+	err = d.Apply(ctx, newTestState("test", "cluster1"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if records := fake.records("hosts"); len(records) != 2 {
+		t.Errorf("excepted records of the host, got %v", records)
+	}
+
+	err = d.Remove(ctx, "test", "cluster1")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if records := fake.records("hosts"); len(records) != 0 {
+		t.Errorf("excepted records to be removed, got %v", records)
+	}
+}
@@ -0,0 +1,240 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package f5
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+	bigip "github.com/scottdware/go-bigip"
+)
+
+// DeclarativeF5 implements controller.DeclarativeProviderInterface for F5, it is registered as f5 and f5-declarative.
+// Changes of a single host are executed in one iControl REST transaction.
+type DeclarativeF5 struct {
+	*ProviderF5
+}
+
+// NewDeclarativeF5 returns new declarative f5 provider
+func NewDeclarativeF5(f5 *ProviderF5) *DeclarativeF5 {
+	return &DeclarativeF5{ProviderF5: f5}
+}
+
+// PreUpdate checks are we running in HA mode, if yes write to active member
+func (d *DeclarativeF5) PreUpdate(ctx context.Context) error {
+	return d.ProviderF5.PreUpdate()
+}
+
+// PostUpdate syncs the configuration in f5 cluster
+func (d *DeclarativeF5) PostUpdate(ctx context.Context) error {
+	return d.ProviderF5.PostUpdate()
+}
+
+func (d *DeclarativeF5) memberName(membername string, port string) string {
+	return getNameWithPool(d.partition, membername+":"+port)
+}
+
+// escapeSendString escapes line breaks of monitor send string in the same way as they are stored in f5
+func escapeSendString(send string) string {
+	return strings.Replace(send, "\r\n", `\r\n`, -1)
+}
+
+func findMember(members *bigip.PoolMembers, membername string) *bigip.PoolMember {
+	if members == nil {
+		return nil
+	}
+	for i := range members.PoolMembers {
+		if members.PoolMembers[i].Name == membername {
+			return &members.PoolMembers[i]
+		}
+	}
+	return nil
+}
+
+// Apply makes pools, members and monitors of the host to match state in one transaction
+func (d *DeclarativeF5) Apply(ctx context.Context, state controller.HostState) error {
+	session := d.getSession()
+	return d.checkAuth(session, d.apply(ctx, session, state))
+}
+
+func (d *DeclarativeF5) apply(ctx context.Context, session *bigip.BigIP, state controller.HostState) error {
+	records, err := d.dataGroupRecords(ctx, session)
+	if err != nil {
+		return err
+	}
+	tx, err := beginTransaction(ctx, session)
+	if err != nil {
+		return err
+	}
+	for _, port := range state.Ports {
+		err = d.applyPort(ctx, tx, state, port, records)
+		if err != nil {
+			tx.abort(ctx)
+			return err
+		}
+	}
+	if tx.calls > 0 {
+		log.Printf("committing %d changes of host %s", tx.calls, state.Host)
+	}
+	return tx.commit(ctx)
+}
+
+func (d *DeclarativeF5) applyPort(ctx context.Context, tx *transaction, state controller.HostState, port string, records map[string]string) error {
+	name := state.Host + "_" + port
+	fullName := getNameWithPool(d.partition, name)
+	scheme := monitorScheme(port)
+	send := escapeSendString(monitorSendString(state.Host, state.Monitor.Path, state.Monitor.Method))
+
+	monitor, err := tx.session.GetMonitor(fullName, scheme)
+	if err != nil {
+		return err
+	}
+	desiredMonitor := map[string]interface{}{
+		"interval": state.Monitor.Interval,
+		"timeout":  state.Monitor.Timeout,
+		"send":     send,
+	}
+	if monitor == nil {
+		desiredMonitor["name"] = fullName
+		desiredMonitor["partition"] = d.partition
+		desiredMonitor["defaultsFrom"] = scheme
+		desiredMonitor["recv"] = monitorReceiveString
+		err = tx.add(ctx, http.MethodPost, "ltm/monitor/"+scheme, desiredMonitor)
+	} else if monitor.Interval != state.Monitor.Interval || monitor.Timeout != state.Monitor.Timeout || escapeSendString(monitor.SendString) != send {
+		err = tx.add(ctx, http.MethodPatch, d.monitorPath(state.Host, port), desiredMonitor)
+	}
+	if err != nil {
+		return err
+	}
+
+	targetmode, pga, slowRampTime, prio := poolSettings(state.LoadBalancingMethod, state.PGA, state.Prio, state.SlowRampTime)
+	desiredPool := map[string]interface{}{
+		"loadBalancingMode": targetmode,
+		"minActiveMembers":  pga,
+		"slowRampTime":      slowRampTime,
+		"serviceDownAction": "reset",
+		"monitor":           fullName,
+	}
+	pool, err := tx.session.GetPool(fullName)
+	if err != nil {
+		return err
+	}
+	var members *bigip.PoolMembers
+	if pool == nil {
+		desiredPool["name"] = fullName
+		desiredPool["partition"] = d.partition
+		err = tx.add(ctx, http.MethodPost, "ltm/pool", desiredPool)
+	} else {
+		if pool.LoadBalancingMode != targetmode || pool.MinActiveMembers != pga || pool.SlowRampTime != slowRampTime || pool.ServiceDownAction != "reset" || strings.TrimSpace(pool.Monitor) != fullName {
+			err = tx.add(ctx, http.MethodPatch, d.poolPath(state.Host, port), desiredPool)
+			if err != nil {
+				return err
+			}
+		}
+		members, err = tx.session.PoolMembers(fullName)
+	}
+	if err != nil {
+		return err
+	}
+	if op := d.recordChange(records, state.Host, port, true); op != nil {
+		if err = tx.add(ctx, op.method, op.path, op.body); err != nil {
+			return err
+		}
+	}
+
+	desiredMember := memberConfig(state.Maintenance, prio, state.MemberSettings)
+	member := findMember(members, state.Member+":"+port)
+	if member == nil {
+		desiredMember["name"] = d.memberName(state.Member, port)
+		return tx.add(ctx, http.MethodPost, d.poolPath(state.Host, port)+"/members", desiredMember)
+	}
+	enabled := member.Session != "user-disabled"
+	if member.PriorityGroup != prio || enabled == state.Maintenance || member.Ratio != memberRatio(state.MemberSettings) ||
+		member.ConnectionLimit != state.ConnectionLimit {
+		return tx.add(ctx, http.MethodPatch, d.poolPath(state.Host, port)+"/members/"+iControlName(d.memberName(state.Member, port)), desiredMember)
+	}
+	return nil
+}
+
+// Remove removes member from pools of the host in one transaction. Pools and monitors without members are deleted
+func (d *DeclarativeF5) Remove(ctx context.Context, host string, membername string) error {
+	session := d.getSession()
+	return d.checkAuth(session, d.remove(ctx, session, host, membername))
+}
+
+func (d *DeclarativeF5) remove(ctx context.Context, session *bigip.BigIP, host string, membername string) error {
+	records, err := d.dataGroupRecords(ctx, session)
+	if err != nil {
+		return err
+	}
+	tx, err := beginTransaction(ctx, session)
+	if err != nil {
+		return err
+	}
+	for _, port := range controller.Ports {
+		err = d.removePort(ctx, tx, host, membername, port, records)
+		if err != nil {
+			tx.abort(ctx)
+			return err
+		}
+	}
+	return tx.commit(ctx)
+}
+
+func (d *DeclarativeF5) removePort(ctx context.Context, tx *transaction, host string, membername string, port string, records map[string]string) error {
+	fullName := getNameWithPool(d.partition, host+"_"+port)
+	pool, err := tx.session.GetPool(fullName)
+	if err != nil {
+		return err
+	}
+	if pool == nil {
+		return nil
+	}
+	members, err := tx.session.PoolMembers(fullName)
+	if err != nil {
+		return err
+	}
+	remaining := len(members.PoolMembers)
+	if findMember(members, membername+":"+port) != nil {
+		err = tx.add(ctx, http.MethodDelete, d.poolPath(host, port)+"/members/"+iControlName(d.memberName(membername, port)), nil)
+		if err != nil {
+			return err
+		}
+		remaining--
+	}
+	if remaining > 0 {
+		return nil
+	}
+	monitor, err := tx.session.GetMonitor(fullName, monitorScheme(port))
+	if err != nil {
+		return err
+	}
+	return d.cleanPool(ctx, tx, host, port, records, monitor != nil)
+}
+
+// ListHosts returns hosts which have membername as member
+func (d *DeclarativeF5) ListHosts(ctx context.Context, membername string) ([]string, error) {
+	session := d.getSession()
+	pools, err := d.getPools(session)
+	if err != nil {
+		return nil, d.checkAuth(session, fmt.Errorf("error fetching pool %w", err))
+	}
+	found := map[string]bool{}
+	hosts := []string{}
+	for _, pool := range pools.Pools {
+		host := strings.Split(pool.Name, "_")[0]
+		if !found[host] && d.poolMemberExist(session, pool, membername) {
+			found[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts, nil
+}
@@ -0,0 +1,165 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package f5
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+	bigip "github.com/scottdware/go-bigip"
+)
+
+func newTestState(host string, member string) controller.HostState {
+	return controller.HostState{
+		Host:   host,
+		Member: member,
+		Ports:  controller.Ports,
+		PGA:    1,
+		Prio:   1,
+		Monitor: controller.MonitorState{
+			Path:     "/",
+			Method:   "GET",
+			Interval: 3,
+			Timeout:  10,
+		},
+	}
+}
+
+func TestDeclarativeApply(t *testing.T) {
+	fake := newFakeBigIP()
+	defer fake.Close()
+
+	newf5 := NewProviderF5()
+	newf5.partition = "xx"
+	newf5.session = bigip.NewSession(fake.URL(), "yy", "xx", nil)
+	d := NewDeclarativeF5(newf5)
+	ctx := context.Background()
+
+	state := newTestState("test", "cluster1")
+	err := d.Apply(ctx, state)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if fake.commits != 1 || len(fake.objects) != 6 {
+		t.Errorf("excepted 1 commit and 6 objects, got %d commits and objects %v", fake.commits, fake.objects)
+	}
+	member := fake.objects["ltm/pool/test_443/members/cluster1:443"]
+	if member == nil || member["session"] != "user-enabled" {
+		t.Errorf("excepted enabled member, got %v", member)
+	}
+
+	// nothing changed, no transaction should be committed
+	err = d.Apply(ctx, state)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if fake.commits != 1 {
+		t.Errorf("excepted no commit when nothing changed, got %d", fake.commits)
+	}
+
+	state.Maintenance = true
+	state.Monitor.Path = "/health"
+	err = d.Apply(ctx, state)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	member = fake.objects["ltm/pool/test_80/members/cluster1:80"]
+	if fake.commits != 2 || member["session"] != "user-disabled" {
+		t.Errorf("excepted disabled member, got %v", member)
+	}
+	if send := fake.objects["ltm/monitor/http/test_80"]["send"]; send != escapeSendString(monitorSendString("test", "/health", "GET")) {
+		t.Errorf("unexcepted monitor send string %v", send)
+	}
+
+	state.Ratio = 2
+	state.ConnectionLimit = 50
+	err = d.Apply(ctx, state)
+	member = fake.objects["ltm/pool/test_443/members/cluster1:443"]
+	if err != nil || fake.commits != 3 || member["ratio"] != float64(2) || member["connectionLimit"] != float64(50) {
+		t.Errorf("excepted member ratio and connection limit, got %v %v", member, err)
+	}
+
+	hosts, err := d.ListHosts(ctx, "cluster1")
+	if err != nil || len(hosts) != 1 || hosts[0] != "test" {
+		t.Errorf("excepted host test, got %v %v", hosts, err)
+	}
+
+	// second cluster shares the pools, removing first one must keep them
+	err = d.Apply(ctx, newTestState("test", "cluster2"))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	err = d.Remove(ctx, "test", "cluster1")
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if _, ok := fake.objects["ltm/pool/test_80"]; !ok {
+		t.Errorf("pool should exist while it has members")
+	}
+	hosts, _ = d.ListHosts(ctx, "cluster1")
+	if len(hosts) != 0 {
+		t.Errorf("excepted no hosts, got %v", hosts)
+	}
+
+	err = d.Remove(ctx, "test", "cluster2")
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("excepted all objects to be removed, got %v", fake.objects)
+	}
+}
+
+func TestDeclarativeRollback(t *testing.T) {
+	fake := newFakeBigIP()
+	defer fake.Close()
+
+	newf5 := NewProviderF5()
+	newf5.partition = "xx"
+	newf5.session = bigip.NewSession(fake.URL(), "yy", "xx", nil)
+	d := NewDeclarativeF5(newf5)
+
+	// https monitors can not be created, whole commit must fail and nothing is left behind
+	fake.collections["ltm/monitor/https"] = false
+	err := d.Apply(context.Background(), newTestState("test", "cluster1"))
+	if err == nil {
+		t.Errorf("excepted error from failed transaction")
+	}
+	if len(fake.objects) != 0 || len(fake.transactions) != 0 {
+		t.Errorf("excepted rollback, got objects %v transactions %v", fake.objects, fake.transactions)
+	}
+}
+
+func TestDeclarativeConcurrent(t *testing.T) {
+	fake := newFakeBigIP()
+	defer fake.Close()
+
+	newf5 := NewProviderF5()
+	newf5.partition = "xx"
+	newf5.session = bigip.NewSession(fake.URL(), "yy", "xx", nil)
+	d := NewDeclarativeF5(newf5)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			err := d.Apply(context.Background(), newTestState(host, "cluster1"))
+			if err != nil {
+				t.Errorf("%v", err)
+			}
+		}(fmt.Sprintf("test%d", i))
+	}
+	wg.Wait()
+	hosts, err := d.ListHosts(context.Background(), "cluster1")
+	if err != nil || len(hosts) != 8 {
+		t.Errorf("excepted 8 hosts, got %v %v", hosts, err)
+	}
+}
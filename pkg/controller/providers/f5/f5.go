@@ -7,43 +7,95 @@ SPDX-License-Identifier: Apache-2.0
 package f5
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ElisaOyj/openshift-lb-controller/pkg/common"
 	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
-	"github.com/getsentry/raven-go"
 	v1 "github.com/openshift/api/route/v1"
 	bigip "github.com/scottdware/go-bigip"
 )
 
-const providerName = "f5"
+const (
+	// providerName changes each host in one transaction
+	providerName = "f5"
+	// declarativeProviderName is the previous name of the transactional provider
+	declarativeProviderName = "f5-declarative"
+	// imperativeProviderName makes each change in a separate iControl REST call
+	imperativeProviderName = "f5-imperative"
+)
 
-// ProviderF5 is an implementation of Interface for F5.
+// ProviderF5 is an implementation of Interface for F5, it is registered as f5-imperative. It is safe for concurrent use.
 type ProviderF5 struct {
-	session      *bigip.BigIP
-	Clusteralias string
-	username     string
-	password     string
-	addresses    []string
-	currentaddr  int
-	groupname    string
-	partition    string
+	// lock protects session, sessions, staleSession, currentaddr, activeDevice and Clusteralias
+	lock          sync.RWMutex
+	session       *bigip.BigIP
+	sessions      []*bigip.BigIP
+	staleSession  *bigip.BigIP
+	sessionConfig sessionConfig
+	// username and password are protected by lock if credentials are read from files
+	credentialFiles credentialFiles
+	// stopCredentials stops periodic reload of credentials, nil if credentials are not reloaded
+	stopCredentials chan struct{}
+	activeDevice    string
+	Clusteralias    string
+	username        string
+	password        string
+	addresses       []string
+	currentaddr     int
+	groupname       string
+	partition       string
+	reporter        common.ErrorReporter
+	// httpsVirtualServer is the virtual server where client ssl profiles of hosts are attached, empty
+	// disables certificates
+	httpsVirtualServer string
+	clientSSLParent    string
+	// dataGroup is the internal data group which maps hosts to pools, empty disables it
+	dataGroup string
+	// nodeMonitorPort is the router health port which is monitored on the node, empty disables the monitor
+	nodeMonitorPort string
+	nodeMonitorPath string
+	// bootstrap creates virtual servers, profiles and iRule of the partition with virtualAddress as destination
+	bootstrap         bool
+	virtualAddress    string
+	httpVirtualServer string
+	sslCertificate    string
+	sslKey            string
+	// bootstrapLock protects bootstrapped
+	bootstrapLock sync.Mutex
+	bootstrapped  bool
+	// roles are same as in the controller, persistence of the iRule depends on them
+	roles controller.Roles
 }
 
 func init() {
-	controller.RegisterProvider(providerName, NewProviderF5())
+	controller.RegisterDeclarativeProvider(providerName, NewDeclarativeF5(NewProviderF5()))
+	controller.RegisterDeclarativeProvider(declarativeProviderName, NewDeclarativeF5(NewProviderF5()))
+	controller.RegisterProvider(imperativeProviderName, NewProviderF5())
 }
 
 // NewProviderF5 returns new f5 provider for testing purposes
 func NewProviderF5() *ProviderF5 {
 	f5 := ProviderF5{
-		currentaddr: 0,
-		groupname:   "cluster",
-		partition:   "Common",
+		currentaddr:       0,
+		groupname:         "cluster",
+		partition:         "Common",
+		reporter:          common.NewLogReporter(),
+		clientSSLParent:   defaultClientSSLParent,
+		nodeMonitorPath:   defaultNodeMonitorPath,
+		httpVirtualServer: defaultHTTPVirtualServer,
+		sslCertificate:    defaultSSLCertificate,
+		sslKey:            defaultSSLKey,
+		roles:             controller.DefaultRoles(),
 	}
 	return &f5
 }
@@ -65,9 +117,7 @@ func (f5 *ProviderF5) Initialize() {
 	address := os.Getenv("F5_ADDR")
 	if len(address) == 0 {
 		err := errors.New("F5_ADDR environment variable needed")
-		if common.SentryEnabled() {
-			raven.CaptureErrorAndWait(err, nil)
-		}
+		f5.reporter.CaptureErrorAndWait(err, nil)
 		panic(err)
 	}
 
@@ -77,204 +127,424 @@ func (f5 *ProviderF5) Initialize() {
 	}
 	f5.addresses = strings.Split(address, ",")
 
-	username := os.Getenv("F5_USER")
-	if len(username) == 0 {
-		err := errors.New("F5_USER environment variable needed")
-		if common.SentryEnabled() {
-			raven.CaptureErrorAndWait(err, nil)
-		}
+	f5.credentialFiles = credentialFiles{
+		username: os.Getenv("F5_USER_FILE"),
+		password: os.Getenv("F5_PASSWORD_FILE"),
+	}
+	f5.username = os.Getenv("F5_USER")
+	f5.password = os.Getenv("F5_PASSWORD")
+	if _, err := f5.loadCredentials(); err != nil {
+		f5.reporter.CaptureErrorAndWait(err, nil)
 		panic(err)
 	}
-	password := os.Getenv("F5_PASSWORD")
-	if len(password) == 0 {
-		err := errors.New("F5_PASSWORD environment variable needed")
-		if common.SentryEnabled() {
-			raven.CaptureErrorAndWait(err, nil)
-		}
+	if len(f5.username) == 0 {
+		err := errors.New("F5_USER or F5_USER_FILE environment variable needed")
+		f5.reporter.CaptureErrorAndWait(err, nil)
 		panic(err)
 	}
-	f5.username = username
-	f5.password = password
+	if len(f5.password) == 0 {
+		err := errors.New("F5_PASSWORD or F5_PASSWORD_FILE environment variable needed")
+		f5.reporter.CaptureErrorAndWait(err, nil)
+		panic(err)
+	}
+	if f5.credentialFiles.enabled() {
+		interval := defaultCredentialsInterval
+		if value := os.Getenv("F5_CREDENTIALS_INTERVAL"); len(value) > 0 {
+			var err error
+			interval, err = time.ParseDuration(value)
+			if err != nil || interval <= 0 {
+				err = fmt.Errorf("invalid F5_CREDENTIALS_INTERVAL %q", value)
+				f5.reporter.CaptureErrorAndWait(err, nil)
+				panic(err)
+			}
+		}
+		f5.Close()
+		f5.stopCredentials = make(chan struct{})
+		go f5.watchCredentials(interval, f5.stopCredentials)
+	}
 
 	partition := os.Getenv("PARTITION")
 	if len(partition) > 0 {
 		f5.partition = partition
 	}
 
-	f5.session = bigip.NewSession(f5.addresses[0], f5.username, f5.password, nil)
-}
+	f5.httpsVirtualServer = os.Getenv("F5_HTTPS_VIRTUAL_SERVER")
+	if parent := os.Getenv("F5_CLIENT_SSL_PARENT"); len(parent) > 0 {
+		f5.clientSSLParent = parent
+	}
 
-// CreatePool creates new loadbalancer pool
-func (f5 *ProviderF5) CreatePool(name string, port string) error {
-	f5Pool := &bigip.Pool{
-		Name:              name + "_" + port,
-		Partition:         f5.partition,
-		ServiceDownAction: "reset",
+	f5.dataGroup = os.Getenv("F5_DATA_GROUP")
+	if port := os.Getenv("F5_NODE_MONITOR_PORT"); len(port) > 0 {
+		if _, err := strconv.Atoi(port); err != nil {
+			err = fmt.Errorf("invalid F5_NODE_MONITOR_PORT %q", port)
+			f5.reporter.CaptureErrorAndWait(err, nil)
+			panic(err)
+		}
+		f5.nodeMonitorPort = port
+	}
+	if path := os.Getenv("F5_NODE_MONITOR_PATH"); len(path) > 0 {
+		f5.nodeMonitorPath = path
 	}
-	err := f5.session.AddPool(f5Pool)
+	roles, err := controller.ParseRoles(os.Getenv("ROLES"))
 	if err != nil {
-		if !alreadyExist(err, f5.partition) {
-			return err
+		f5.reporter.CaptureErrorAndWait(err, nil)
+		panic(err)
+	}
+	f5.roles = roles
+	if os.Getenv("F5_BOOTSTRAP") == "true" {
+		f5.bootstrap = true
+		f5.virtualAddress = os.Getenv("F5_VIRTUAL_ADDRESS")
+		if net.ParseIP(f5.virtualAddress) == nil {
+			err := errors.New("F5_VIRTUAL_ADDRESS environment variable with ip address needed when F5_BOOTSTRAP is true")
+			f5.reporter.CaptureErrorAndWait(err, nil)
+			panic(err)
+		}
+		if len(f5.httpsVirtualServer) == 0 {
+			f5.httpsVirtualServer = defaultHTTPSVirtualServer
+		}
+		if name := os.Getenv("F5_HTTP_VIRTUAL_SERVER"); len(name) > 0 {
+			f5.httpVirtualServer = name
+		}
+		if cert := os.Getenv("F5_SSL_CERTIFICATE"); len(cert) > 0 {
+			f5.sslCertificate = cert
+		}
+		if key := os.Getenv("F5_SSL_KEY"); len(key) > 0 {
+			f5.sslKey = key
 		}
 	}
-	return nil
+
+	config, err := readSessionConfig()
+	if err != nil {
+		f5.reporter.CaptureErrorAndWait(err, nil)
+		panic(err)
+	}
+	f5.sessionConfig = config
+	f5.session, err = f5.newSession(f5.addresses[0])
+	if err != nil {
+		f5.reporter.CaptureError(err, nil)
+	}
 }
 
-// AddPoolMember adds new member to pool
-func (f5 *ProviderF5) AddPoolMember(membername string, name string, port string) error {
+// getSession returns session of the device which is currently used, expired session is renewed
+func (f5 *ProviderF5) getSession() *bigip.BigIP {
+	f5.lock.RLock()
+	session := f5.session
+	expired := f5.expired(session)
+	f5.lock.RUnlock()
+	if !expired {
+		return session
+	}
+	f5.lock.Lock()
+	defer f5.lock.Unlock()
+	f5.renewSession()
+	return f5.session
+}
+
+// withSession calls fn with the session of the current device. Errors caused by rejected credentials
+// mark the session stale, so that new session is created on next call
+func (f5 *ProviderF5) withSession(fn func(session *bigip.BigIP) error) error {
+	session := f5.getSession()
+	return f5.checkAuth(session, fn(session))
+}
+
+func (f5 *ProviderF5) setClusteralias(membername string) {
+	f5.lock.Lock()
+	defer f5.lock.Unlock()
 	f5.Clusteralias = membername
-	err := f5.session.AddPoolMember(getNameWithPool(f5.partition, name+"_"+port), getNameWithPool(f5.partition, membername+":"+port))
+}
+
+func (f5 *ProviderF5) getClusteralias() string {
+	f5.lock.RLock()
+	defer f5.lock.RUnlock()
+	return f5.Clusteralias
+}
+
+// SetReporter sets error reporter
+func (f5 *ProviderF5) SetReporter(reporter common.ErrorReporter) {
+	f5.reporter = reporter
+}
+
+// CreatePool creates new loadbalancer pool. If the pool is missing from the data group, the record is
+// added in the same transaction as the pool
+func (f5 *ProviderF5) CreatePool(name string, port string) error {
+	return f5.withSession(func(session *bigip.BigIP) error {
+		return f5.createPool(context.Background(), session, name, port)
+	})
+}
+
+func (f5 *ProviderF5) createPool(ctx context.Context, session *bigip.BigIP, name string, port string) error {
+	records, err := f5.dataGroupRecords(ctx, session)
 	if err != nil {
-		if !alreadyExist(err, f5.partition) {
+		return err
+	}
+	op := f5.recordChange(records, name, port, true)
+	if op == nil {
+		err = session.AddPool(&bigip.Pool{
+			Name:              name + "_" + port,
+			Partition:         f5.partition,
+			ServiceDownAction: "reset",
+		})
+		if err != nil && !alreadyExist(err, f5.partition) {
 			return err
 		}
+		return nil
 	}
-	return nil
+	fullName := getNameWithPool(f5.partition, name+"_"+port)
+	pool, err := session.GetPool(fullName)
+	if err != nil {
+		return err
+	}
+	tx, err := beginTransaction(ctx, session)
+	if err != nil {
+		return err
+	}
+	if pool == nil {
+		err = tx.add(ctx, http.MethodPost, "ltm/pool", map[string]interface{}{
+			"name":              fullName,
+			"partition":         f5.partition,
+			"serviceDownAction": "reset",
+		})
+	}
+	if err == nil {
+		err = tx.add(ctx, op.method, op.path, op.body)
+	}
+	if err != nil {
+		tx.abort(ctx)
+		return err
+	}
+	return tx.commit(ctx)
 }
 
-func (f5 *ProviderF5) modifyMember(name string, port string, maintenance bool, prio int) {
+// AddPoolMember adds new member to pool
+func (f5 *ProviderF5) AddPoolMember(membername string, name string, port string) error {
+	f5.setClusteralias(membername)
+	return f5.withSession(func(session *bigip.BigIP) error {
+		err := session.AddPoolMember(getNameWithPool(f5.partition, name+"_"+port), getNameWithPool(f5.partition, membername+":"+port))
+		if err != nil {
+			if !alreadyExist(err, f5.partition) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (f5 *ProviderF5) modifyMember(session *bigip.BigIP, name string, port string, maintenance bool, prio int, settings controller.MemberSettings) error {
+	clusteralias := f5.getClusteralias()
 	// we need use this because getpoolmember is not working correctly
-	members, err := f5.session.PoolMembers(getNameWithPool(f5.partition, name+"_"+port))
+	members, err := session.PoolMembers(getNameWithPool(f5.partition, name+"_"+port))
 	if err != nil {
-		log.Printf("error in getpoolmembers %v", err)
-		return
+		return fmt.Errorf("error retrieving poolmembers %s %w", name+"_"+port, err)
 	}
 	for _, item := range members.PoolMembers {
-		if item.Name == f5.Clusteralias+":"+port {
-			config := &bigip.PoolMember{
-				FullPath:      item.FullPath,
-				PriorityGroup: prio,
-				Partition:     f5.partition,
-			}
+		if item.Name == clusteralias+":"+port {
+			// zero values must be sent too, so that removed settings are reset
+			config := memberConfig(maintenance, prio, settings)
 			if maintenance {
-				config.Session = "user-disabled"
-				log.Printf("setting poolmember %s in pool %s_%s to disabled", f5.Clusteralias, name, port)
+				log.Printf("setting poolmember %s in pool %s_%s to disabled", clusteralias, name, port)
 			} else {
-				config.Session = "user-enabled"
-				log.Printf("setting poolmember %s in pool %s_%s to enabled", f5.Clusteralias, name, port)
+				log.Printf("setting poolmember %s in pool %s_%s to enabled", clusteralias, name, port)
 			}
-			err = f5.session.PatchPoolMember(getNameWithPool(f5.partition, name+"_"+port), config)
+			path := "ltm/pool/" + iControlName(getNameWithPool(f5.partition, name+"_"+port)) + "/members/" + iControlName(item.FullPath)
+			err = restCall(context.Background(), session, http.MethodPatch, path, config, nil, nil)
 			if err != nil {
-				log.Printf("error in modifyMember %v", err)
+				return fmt.Errorf("error modifying poolmember %s in pool %s %w", clusteralias, name+"_"+port, err)
 			}
-			break
+			return nil
 		}
 	}
+	return nil
 }
 
-// ModifyPool modifies loadbalancer pool
-func (f5 *ProviderF5) ModifyPool(name string, port string, loadBalancingMethod string, pga int, maintenance bool, prio int, role string) error {
-	pool, err := f5.session.GetPool(getNameWithPool(f5.partition, name+"_"+port))
-	if err != nil {
-		return err
+// memberRatio returns ratio of the member, f5 default is 1
+func memberRatio(settings controller.MemberSettings) int {
+	if settings.Ratio == 0 {
+		return 1
 	}
+	return settings.Ratio
+}
+
+// memberConfig returns settings of the pool member of this cluster
+func memberConfig(maintenance bool, prio int, settings controller.MemberSettings) map[string]interface{} {
+	session := "user-enabled"
+	if maintenance {
+		session = "user-disabled"
+	}
+	return map[string]interface{}{
+		"priorityGroup":   prio,
+		"session":         session,
+		"ratio":           memberRatio(settings),
+		"connectionLimit": settings.ConnectionLimit,
+	}
+}
+
+// poolSettings returns loadbalancing mode, pga, slow ramp time and member priority used for the pool,
+// roles are resolved to priority, pga and slow ramp time by the controller
+func poolSettings(loadBalancingMethod string, pga int, prio int, slowRamp *int) (string, int, int, int) {
 	targetmode := loadBalancingMethod
 	if len(loadBalancingMethod) == 0 {
 		targetmode = "round-robin"
 	}
-	log.Printf("changing pool %s loadbalancingmode to %s", name+"_"+port, targetmode)
-	pool.LoadBalancingMode = targetmode
-	if strings.ToLower(role) == "active" || strings.ToLower(role) == "standby" {
-		log.Printf("modifying slow ramp time pool to 0 %s", name+"_"+port)
-		pool.SlowRampTime = 0
-		pga = 1
-		if strings.ToLower(role) == "active" {
-			prio = 20
-		} else if strings.ToLower(role) == "standby" {
-			prio = 15
+	slowRampTime := 10
+	if slowRamp != nil {
+		slowRampTime = *slowRamp
+	}
+	return targetmode, pga, slowRampTime, prio
+}
+
+// ModifyPool modifies loadbalancer pool
+func (f5 *ProviderF5) ModifyPool(name string, port string, loadBalancingMethod string, pga int, maintenance bool, prio int, role string, settings controller.MemberSettings) error {
+	return f5.withSession(func(session *bigip.BigIP) error {
+		pool, err := session.GetPool(getNameWithPool(f5.partition, name+"_"+port))
+		if err != nil {
+			return err
 		}
-	} else {
-		log.Printf("modifying slow ramp time pool to 10 %s", name+"_"+port)
-		pool.SlowRampTime = 10
-	}
-	log.Printf("changing pool %s pga to %d", name+"_"+port, pga)
-	pool.MinActiveMembers = pga
-	f5.modifyMember(name, port, maintenance, prio)
-	// override servicedownaction to reset
-	log.Printf("changing pool serviceaction down to reset %s", name+"_"+port)
-	pool.ServiceDownAction = "reset"
-	err = f5.session.ModifyPool(name+"_"+port, pool)
-	if err != nil {
-		return err
+		if pool == nil {
+			return fmt.Errorf("pool %s not found", name+"_"+port)
+		}
+		targetmode, pga, slowRampTime, prio := poolSettings(loadBalancingMethod, pga, prio, settings.SlowRampTime)
+		log.Printf("changing pool %s loadbalancingmode to %s", name+"_"+port, targetmode)
+		pool.LoadBalancingMode = targetmode
+		log.Printf("modifying slow ramp time pool to %d %s", slowRampTime, name+"_"+port)
+		pool.SlowRampTime = slowRampTime
+		log.Printf("changing pool %s pga to %d", name+"_"+port, pga)
+		pool.MinActiveMembers = pga
+		err = f5.modifyMember(session, name, port, maintenance, prio, settings)
+		if err != nil {
+			return err
+		}
+		// override servicedownaction to reset
+		log.Printf("changing pool serviceaction down to reset %s", name+"_"+port)
+		pool.ServiceDownAction = "reset"
+		return session.ModifyPool(name+"_"+port, pool)
+	})
+}
+
+func monitorScheme(port string) string {
+	if port == "443" {
+		return "https"
 	}
-	return nil
+	return "http"
+}
+
+func monitorSendString(host string, uri string, httpMethod string) string {
+	return httpMethod + " " + uri + " HTTP/1.1\r\nHost:" + host + "  \r\nConnection: Close\r\n\r\n"
 }
 
+const monitorReceiveString = "^HTTP.1.(0|1) ([2|3]0[0-9])"
+
 // CreateMonitor creates new monitor
 func (f5 *ProviderF5) CreateMonitor(host string, port string, uri string, httpMethod string, interval int, timeout int) error {
-	scheme := "http"
-	if port == "443" {
-		scheme = "https"
-	}
-	err := f5.session.CreateMonitor(getNameWithPool(f5.partition, host+"_"+port), scheme, interval, timeout, httpMethod+" "+uri+" HTTP/1.1\r\nHost:"+host+"  \r\nConnection: Close\r\n\r\n", "^HTTP.1.(0|1) ([2|3]0[0-9])", scheme)
-	if err != nil {
-		if !alreadyExist(err, f5.partition) {
-			return err
+	scheme := monitorScheme(port)
+	return f5.withSession(func(session *bigip.BigIP) error {
+		err := session.CreateMonitor(getNameWithPool(f5.partition, host+"_"+port), scheme, interval, timeout, monitorSendString(host, uri, httpMethod), monitorReceiveString, scheme)
+		if err != nil {
+			if !alreadyExist(err, f5.partition) {
+				return err
+			}
 		}
-	}
-	return nil
+		return nil
+	})
 }
 
 // ModifyMonitor modifies monitor
 func (f5 *ProviderF5) ModifyMonitor(host string, port string, uri string, httpMethod string, interval int, timeout int) error {
-	scheme := "http"
-	if port == "443" {
-		scheme = "https"
-	}
 	config := &bigip.Monitor{
 		Interval:   interval,
 		Timeout:    timeout,
-		SendString: httpMethod + " " + uri + " HTTP/1.1\r\nHost:" + host + "  \r\nConnection: Close\r\n\r\n",
+		SendString: monitorSendString(host, uri, httpMethod),
 		Partition:  f5.partition,
 	}
-	err := f5.session.PatchMonitor(getNameWithPool(f5.partition, host+"_"+port), scheme, config)
-	if err != nil {
-		return err
-	}
-	return nil
+	return f5.withSession(func(session *bigip.BigIP) error {
+		return session.PatchMonitor(getNameWithPool(f5.partition, host+"_"+port), monitorScheme(port), config)
+	})
 }
 
 // AddMonitorToPool adds monitor to pool
 func (f5 *ProviderF5) AddMonitorToPool(name string, port string) error {
-	err := f5.session.AddMonitorToPool(name+"_"+port, getNameWithPool(f5.partition, name+"_"+port))
-	if err != nil {
-		if !alreadyExist(err, f5.partition) {
-			return err
+	return f5.withSession(func(session *bigip.BigIP) error {
+		err := session.AddMonitorToPool(name+"_"+port, getNameWithPool(f5.partition, name+"_"+port))
+		if err != nil {
+			if !alreadyExist(err, f5.partition) {
+				return err
+			}
 		}
-	}
-	return nil
+		return nil
+	})
 }
 
 // DeletePoolMember delete pool member
 func (f5 *ProviderF5) DeletePoolMember(membername string, poolname string, poolport string) error {
-	return f5.session.DeletePoolMember(getNameWithPool(f5.partition, poolname+"_"+poolport), membername+":"+poolport)
+	return f5.withSession(func(session *bigip.BigIP) error {
+		return session.DeletePoolMember(getNameWithPool(f5.partition, poolname+"_"+poolport), membername+":"+poolport)
+	})
 }
 
-// CheckAndClean checks pool members and if 0 members left in pool, delete monitor and delete pool
-func (f5 *ProviderF5) CheckAndClean(name string, port string) {
-	scheme := "http"
-	if port == "443" {
-		scheme = "https"
+// CheckAndClean checks pool members and if 0 members left in pool, delete monitor and delete pool. The pool,
+// its monitor and data group record are deleted in one transaction
+func (f5 *ProviderF5) CheckAndClean(name string, port string) error {
+	return f5.withSession(func(session *bigip.BigIP) error {
+		return f5.checkAndClean(context.Background(), session, name, port)
+	})
+}
+
+func (f5 *ProviderF5) checkAndClean(ctx context.Context, session *bigip.BigIP, name string, port string) error {
+	f5name := getNameWithPool(f5.partition, name+"_"+port)
+	members, err := session.PoolMembers(f5name)
+	if err != nil {
+		return fmt.Errorf("error retrieving poolmembers %s %w", name+"_"+port, err)
+	}
+	if len(members.PoolMembers) > 0 {
+		return nil
 	}
-	members, err := f5.session.PoolMembers(getNameWithPool(f5.partition, name+"_"+port))
+	records, err := f5.dataGroupRecords(ctx, session)
 	if err != nil {
-		log.Printf("error retrieving poolmembers %s %v", name+"_"+port, err)
+		return err
 	}
-	if len(members.PoolMembers) == 0 {
-		f5name := getNameWithPool(f5.partition, name+"_"+port)
-		err = f5.session.DeletePool(f5name)
-		if err != nil {
-			log.Printf("error delete pool %s %v", f5name, err)
-		}
-		err = f5.session.DeleteMonitor(f5name, scheme)
-		if err != nil {
-			log.Printf("error delete monitor %s %v", f5name, err)
+	monitor, err := session.GetMonitor(f5name, monitorScheme(port))
+	if err != nil {
+		return fmt.Errorf("error retrieving monitor %s %w", f5name, err)
+	}
+	tx, err := beginTransaction(ctx, session)
+	if err != nil {
+		return err
+	}
+	err = f5.cleanPool(ctx, tx, name, port, records, monitor != nil)
+	if err != nil {
+		tx.abort(ctx)
+		return fmt.Errorf("error delete pool %s %w", f5name, err)
+	}
+	return tx.commit(ctx)
+}
+
+// poolPath returns iControl REST path of the pool
+func (f5 *ProviderF5) poolPath(host string, port string) string {
+	return "ltm/pool/" + iControlName(getNameWithPool(f5.partition, host+"_"+port))
+}
+
+// monitorPath returns iControl REST path of the monitor
+func (f5 *ProviderF5) monitorPath(host string, port string) string {
+	return "ltm/monitor/" + monitorScheme(port) + "/" + iControlName(getNameWithPool(f5.partition, host+"_"+port))
+}
+
+// cleanPool queues deletion of the pool record, the pool and its monitor
+func (f5 *ProviderF5) cleanPool(ctx context.Context, tx *transaction, name string, port string, records map[string]string, monitor bool) error {
+	if op := f5.recordChange(records, name, port, false); op != nil {
+		if err := tx.add(ctx, op.method, op.path, op.body); err != nil {
+			return err
 		}
 	}
+	if err := tx.add(ctx, http.MethodDelete, f5.poolPath(name, port), nil); err != nil {
+		return err
+	}
+	if !monitor {
+		return nil
+	}
+	return tx.add(ctx, http.MethodDelete, f5.monitorPath(name, port), nil)
 }
 
-func (f5 *ProviderF5) poolMemberExist(pool bigip.Pool, membername string) bool {
-	members, err := f5.session.PoolMembers(getNameWithPool(f5.partition, pool.Name))
+func (f5 *ProviderF5) poolMemberExist(session *bigip.BigIP, pool bigip.Pool, membername string) bool {
+	members, err := session.PoolMembers(getNameWithPool(f5.partition, pool.Name))
 	if err != nil {
 		log.Printf("error in poolmembers %v", err)
 		return false
@@ -290,10 +560,10 @@ func (f5 *ProviderF5) poolMemberExist(pool bigip.Pool, membername string) bool {
 	return false
 }
 
-func (f5 *ProviderF5) getPools() (*bigip.Pools, error) {
+func (f5 *ProviderF5) getPools(session *bigip.BigIP) (*bigip.Pools, error) {
 	var filteredPools *bigip.Pools
 	filteredPools = &bigip.Pools{}
-	pools, err := f5.session.Pools()
+	pools, err := session.Pools()
 	if err != nil {
 		return filteredPools, err
 	}
@@ -308,15 +578,15 @@ func (f5 *ProviderF5) getPools() (*bigip.Pools, error) {
 }
 
 // CheckPools compares current load balancer setup and what routes we have. It returns list of pools which should be removed
-func (f5 *ProviderF5) CheckPools(routes []v1.Route, hosttowatch string, membername string) map[string]bool {
+func (f5 *ProviderF5) CheckPools(routes []v1.Route, hosttowatch string, membername string) (map[string]bool, error) {
 	hosts := map[string]bool{}
-	pools, err := f5.getPools()
+	session := f5.getSession()
+	pools, err := f5.getPools(session)
 	if err != nil {
-		log.Printf("error fetching pool %v", err)
-		return hosts
+		return hosts, f5.checkAuth(session, fmt.Errorf("error fetching pool %w", err))
 	}
 	for _, pool := range pools.Pools {
-		if f5.poolMemberExist(pool, membername) {
+		if f5.poolMemberExist(session, pool, membername) {
 			remove := true
 			splittedpool := strings.Split(pool.Name, "_")[0]
 			for _, route := range routes {
@@ -336,49 +606,32 @@ func (f5 *ProviderF5) CheckPools(routes []v1.Route, hosttowatch string, memberna
 			}
 		}
 	}
-	return hosts
+	return hosts, nil
 }
 
-// PreUpdate checks are we running in HA mode, if yes write to active member
-func (f5 *ProviderF5) PreUpdate() {
+// PreUpdate checks are we running in HA mode, if yes write to active member. Partition is bootstrapped
+// before the first update if it is enabled
+func (f5 *ProviderF5) PreUpdate() error {
 	// skip if no HA turned on
-	if len(f5.addresses) == 1 {
-		return
-	}
-	device, err := f5.session.GetCurrentDevice()
-	if err != nil {
-		msg := fmt.Sprintf("Error in PreUpdate %v", err)
-		if common.SentryEnabled() {
-			raven.CaptureMessage(msg, map[string]string{"stage": "preupdate"})
-		}
-		log.Printf(msg)
-		return
-	}
-	if device.FailoverState == "standby" {
-		log.Printf("changing f5.session to active member")
-		count := f5.currentaddr + 1
-		if len(f5.addresses) <= count {
-			count = 0
+	if len(f5.addresses) > 1 {
+		f5.lock.Lock()
+		err := f5.selectActiveDevice()
+		f5.lock.Unlock()
+		if err != nil {
+			return err
 		}
-		f5.currentaddr = count
-		f5.session = bigip.NewSession(f5.addresses[f5.currentaddr], f5.username, f5.password, nil)
 	}
+	return f5.ensureBootstrap(context.Background())
 }
 
 // PostUpdate syncs the configuration in f5 cluster
-func (f5 *ProviderF5) PostUpdate() {
+func (f5 *ProviderF5) PostUpdate() error {
 	// skip if no HA turned on
 	if len(f5.addresses) == 1 {
-		return
-	}
-	err := f5.session.ConfigSyncToGroup(f5.groupname)
-	if err != nil {
-		msg := fmt.Sprintf("Error in PostUpdate %v", err)
-		if common.SentryEnabled() {
-			raven.CaptureMessage(msg, map[string]string{"stage": "postupdate"})
-		}
-		log.Printf(msg)
+		return nil
 	}
+	session := f5.getSession()
+	return f5.checkAuth(session, session.ConfigSyncToGroup(f5.groupname))
 }
 
 // Calls returns list of methodcalls, not in use in this provider
@@ -7,23 +7,33 @@ SPDX-License-Identifier: Apache-2.0
 package f5
 
 import (
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/common"
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
 	bigip "github.com/scottdware/go-bigip"
+	"net/http"
+	"strings"
 	"testing"
 )
 
 func TestCreate(t *testing.T) {
 
+	fake := newFakeBigIP()
+	defer fake.Close()
+
 	newf5 := NewProviderF5()
 	newf5.Clusteralias = "xx"
-	newf5.addresses = []string{"xxx"}
+	newf5.addresses = []string{fake.URL()}
 	newf5.username = "yy"
 	newf5.password = "xx"
 	newf5.partition = "xx"
 	newf5.session = bigip.NewSession(newf5.addresses[0], newf5.username, newf5.password, nil)
 
-	newf5.PreUpdate()
+	err := newf5.PreUpdate()
+	if err != nil {
+		t.Errorf("%v", err)
+	}
 
-	err := newf5.CreatePool("test", "80")
+	err = newf5.CreatePool("test", "80")
 	if err != nil {
 		t.Errorf("%v", err)
 
@@ -34,10 +44,24 @@ func TestCreate(t *testing.T) {
 
 	}
 
-	err = newf5.ModifyPool("test", "80", "", 1, false, 1)
+	slowRamp := 30
+	err = newf5.ModifyPool("test", "80", "ratio-member", 1, false, 1, "", controller.MemberSettings{Ratio: 3, ConnectionLimit: 100, SlowRampTime: &slowRamp})
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	member := fake.objects["ltm/pool/test_80/members/xx:80"]
+	if member["ratio"] != float64(3) || member["connectionLimit"] != float64(100) || fake.objects["ltm/pool/test_80"]["slowRampTime"] != float64(30) {
+		t.Errorf("excepted member ratio, connection limit and slow ramp time, got %v %v", member, fake.objects["ltm/pool/test_80"])
+	}
+	// removed settings are reset
+	err = newf5.ModifyPool("test", "80", "", 1, false, 1, "", controller.MemberSettings{})
 	if err != nil {
 		t.Errorf("%v", err)
 	}
+	member = fake.objects["ltm/pool/test_80/members/xx:80"]
+	if member["ratio"] != float64(1) || member["connectionLimit"] != float64(0) || fake.objects["ltm/pool/test_80"]["slowRampTime"] != float64(10) {
+		t.Errorf("excepted default settings, got %v %v", member, fake.objects["ltm/pool/test_80"])
+	}
 
 	err = newf5.CreateMonitor("test", "80", "foobar.com", "http", 3, 10)
 	if err != nil {
@@ -48,7 +72,7 @@ func TestCreate(t *testing.T) {
 	if err != nil {
 		t.Errorf("%v", err)
 	}
-	pools, err := newf5.getPools()
+	pools, err := newf5.getPools(newf5.getSession())
 	if err != nil {
 		t.Errorf("%v", err)
 	}
@@ -62,9 +86,12 @@ func TestCreate(t *testing.T) {
 		t.Errorf("%v", err)
 	}
 
-	newf5.CheckAndClean("test", "80")
+	err = newf5.CheckAndClean("test", "80")
+	if err != nil {
+		t.Errorf("%v", err)
+	}
 
-	pools, err = newf5.getPools()
+	pools, err = newf5.getPools(newf5.getSession())
 	if err != nil {
 		t.Errorf("%v", err)
 	}
@@ -72,6 +99,138 @@ func TestCreate(t *testing.T) {
 		t.Errorf("should be zero pool")
 
 	}
-	newf5.PostUpdate()
+	err = newf5.PostUpdate()
+	if err != nil {
+		t.Errorf("%v", err)
+	}
 
 }
+
+func TestErrors(t *testing.T) {
+	fake := newFakeBigIP()
+	defer fake.Close()
+
+	newf5 := NewProviderF5()
+	newf5.addresses = []string{fake.URL(), fake.URL()}
+	newf5.partition = "xx"
+	newf5.session = bigip.NewSession(newf5.addresses[0], "yy", "xx", nil)
+
+	err := newf5.CheckAndClean("missing", "80")
+	if err == nil {
+		t.Errorf("excepted error from missing pool")
+	}
+
+	err = newf5.ModifyPool("missing", "80", "", 1, false, 1, "", controller.MemberSettings{})
+	if err == nil {
+		t.Errorf("excepted error from missing pool")
+	}
+
+	// errors of the pool member of this cluster are returned
+	newf5.Clusteralias = "dc1"
+	err = newf5.CreatePool("test", "80")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = newf5.AddPoolMember(newf5.Clusteralias, "test", "80")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	fake.lock.Lock()
+	fake.failures["PATCH ltm/pool/test_80/members/dc1:80"] = http.StatusBadRequest
+	fake.lock.Unlock()
+	err = newf5.ModifyPool("test", "80", "", 1, true, 1, "", controller.MemberSettings{})
+	if err == nil || !strings.Contains(err.Error(), "dc1") {
+		t.Errorf("excepted error from modifying pool member, got %v", err)
+	}
+	fake.lock.Lock()
+	fake.failures["GET ltm/pool/test_80/members"] = http.StatusInternalServerError
+	fake.lock.Unlock()
+	err = newf5.ModifyPool("test", "80", "", 1, true, 1, "", controller.MemberSettings{})
+	if err == nil || !strings.Contains(err.Error(), "poolmembers") {
+		t.Errorf("excepted error from retrieving pool members, got %v", err)
+	}
+
+	// no devices, active member can not be found
+	err = newf5.PreUpdate()
+	if err == nil {
+		t.Errorf("excepted error from missing device")
+	}
+
+	err = newf5.PostUpdate()
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if len(fake.Syncs()) != 1 || fake.Syncs()[0] != "config-sync to-group cluster" {
+		t.Errorf("excepted config sync, got %v", fake.Syncs())
+	}
+}
+
+func newFakeDevice(name string, state string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":          name,
+		"selfDevice":    "true",
+		"failoverState": state,
+	}
+}
+
+func TestActiveDevice(t *testing.T) {
+	first := newFakeBigIP()
+	defer first.Close()
+	second := newFakeBigIP()
+	defer second.Close()
+	unreachable := newFakeBigIP()
+	unreachable.Close()
+
+	first.devices = []map[string]interface{}{newFakeDevice("f5-a", "standby")}
+	second.devices = []map[string]interface{}{newFakeDevice("f5-b", "active")}
+
+	reporter := common.NewRecordingReporter()
+	newf5 := NewProviderF5()
+	newf5.SetReporter(reporter)
+	newf5.addresses = []string{unreachable.URL(), first.URL(), second.URL()}
+	newf5.session = bigip.NewSession(newf5.addresses[0], "yy", "xx", nil)
+
+	err := newf5.PreUpdate()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if newf5.currentaddr != 2 || newf5.getSession().Host != second.URL() {
+		t.Errorf("excepted active device to be selected, got %d", newf5.currentaddr)
+	}
+	// device in use is logged, only errors are reported
+	if len(reporter.Reports()) != 0 {
+		t.Errorf("excepted no reports, got %v", reporter.Reports())
+	}
+	err = newf5.PostUpdate()
+	if err != nil || len(second.Syncs()) != 1 || len(first.Syncs()) != 0 {
+		t.Errorf("excepted config sync from active device, got %v", err)
+	}
+
+	err = newf5.PreUpdate()
+	if err != nil || newf5.currentaddr != 2 {
+		t.Errorf("excepted same device, got %d %v", newf5.currentaddr, err)
+	}
+
+	// failover
+	first.devices = []map[string]interface{}{newFakeDevice("f5-a", "active")}
+	second.devices = []map[string]interface{}{newFakeDevice("f5-b", "standby")}
+	err = newf5.PreUpdate()
+	if err != nil || newf5.currentaddr != 1 {
+		t.Errorf("excepted failover to first device, got %d %v", newf5.currentaddr, err)
+	}
+
+	// split brain
+	second.devices = []map[string]interface{}{newFakeDevice("f5-b", "active")}
+	err = newf5.PreUpdate()
+	if err == nil || !strings.Contains(err.Error(), "split brain") {
+		t.Errorf("excepted split brain error, got %v", err)
+	}
+
+	// no active devices
+	first.devices = []map[string]interface{}{newFakeDevice("f5-a", "standby")}
+	second.devices = []map[string]interface{}{newFakeDevice("f5-b", "standby")}
+	err = newf5.PreUpdate()
+	if err == nil || !strings.Contains(err.Error(), "unreachable") {
+		t.Errorf("excepted no active device error, got %v", err)
+	}
+}
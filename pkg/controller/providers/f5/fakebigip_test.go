@@ -0,0 +1,417 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package f5
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeBigIP is a minimal in-memory stand-in for the iControl REST api. Objects are stored by
+// their path below /mgmt/tm, partition prefixes are dropped from the object names.
+type fakeBigIP struct {
+	server      *httptest.Server
+	lock        sync.Mutex
+	objects     map[string]map[string]interface{}
+	collections map[string]bool
+	devices     []map[string]interface{}
+	syncs       []string
+
+	// transactions contains queued calls by transaction id
+	transactions    map[int64][]fakeCall
+	lastTransaction int64
+	commits         int
+
+	// if requireToken is set, only requests with valid token are accepted
+	requireToken bool
+	tokens       map[string]bool
+	logins       int
+
+	// tenants contains as3 declarations by tenant name
+	tenants  map[string]interface{}
+	as3Posts int
+
+	// uploads contains uploaded files by name
+	uploads map[string][]byte
+
+	// failures contains status codes returned to calls by "METHOD path"
+	failures map[string]int
+}
+
+// fakeCall is a call queued to transaction
+type fakeCall struct {
+	method string
+	path   string
+	body   map[string]interface{}
+}
+
+func newFakeBigIP() *fakeBigIP {
+	fake := &fakeBigIP{
+		objects:      map[string]map[string]interface{}{},
+		transactions: map[int64][]fakeCall{},
+		tokens:       map[string]bool{},
+		tenants:      map[string]interface{}{},
+		uploads:      map[string][]byte{},
+		failures:     map[string]int{},
+		collections: map[string]bool{
+			"ltm/pool":                true,
+			"ltm/monitor/http":        true,
+			"ltm/monitor/https":       true,
+			"ltm/node":                true,
+			"ltm/virtual":             true,
+			"ltm/rule":                true,
+			"ltm/data-group/internal": true,
+			"ltm/profile/client-ssl":  true,
+			"ltm/profile/http":        true,
+			"sys/file/ssl-cert":       true,
+			"sys/file/ssl-key":        true,
+		},
+	}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.handle))
+	return fake
+}
+
+func (f *fakeBigIP) Close() {
+	f.server.Close()
+}
+
+// URL returns address which can be used as F5_ADDR
+func (f *fakeBigIP) URL() string {
+	return f.server.URL
+}
+
+func (f *fakeBigIP) Syncs() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.syncs...)
+}
+
+// shortName drops the partition from object name, "~xx~test_80" and "/xx/test_80" are both "test_80"
+func shortName(name string) string {
+	name = strings.Replace(name, "~", "/", -1)
+	s := strings.Split(name, "/")
+	return s[len(s)-1]
+}
+
+func normalizePath(path string) string {
+	path = strings.TrimPrefix(path, "/mgmt/tm/")
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		parts[i] = shortName(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+func (f *fakeBigIP) children(collection string) []string {
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, collection+"/") && !strings.Contains(strings.TrimPrefix(key, collection+"/"), "/") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// isCollection returns true for known collections and for sub collections of existing objects
+func (f *fakeBigIP) isCollection(path string) bool {
+	if f.collections[path] {
+		return true
+	}
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return false
+	}
+	_, ok := f.objects[path[:i]]
+	return ok
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"code": code, "message": message})
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func (f *fakeBigIP) handle(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	body := map[string]interface{}{}
+	data, _ := ioutil.ReadAll(r.Body)
+	if strings.HasPrefix(r.URL.Path, "/"+uploadPath) {
+		f.uploads[strings.TrimPrefix(r.URL.Path, "/"+uploadPath)] = data
+		writeJSON(w, map[string]interface{}{})
+		return
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	path := normalizePath(r.URL.Path)
+	if options := r.URL.Query().Get("options"); len(options) > 0 {
+		body["options"] = options
+	}
+
+	if r.URL.Path == "/mgmt/shared/authn/login" {
+		if body["username"] != "yy" || body["password"] != "xx" {
+			writeError(w, http.StatusUnauthorized, "Authentication failed.")
+			return
+		}
+		f.logins++
+		token := fmt.Sprintf("token%d", f.logins)
+		f.tokens[token] = true
+		writeJSON(w, map[string]interface{}{"token": map[string]interface{}{
+			"token":            token,
+			"expirationMicros": time.Now().Add(20*time.Minute).UnixNano() / int64(time.Microsecond),
+		}})
+		return
+	}
+	if f.requireToken && !f.tokens[r.Header.Get("X-F5-Auth-Token")] {
+		writeError(w, http.StatusUnauthorized, fmt.Sprintf("X-F5-Auth-Token %s does not exist.", r.Header.Get("X-F5-Auth-Token")))
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/mgmt/shared/appsvcs/declare") {
+		f.handleAS3(w, r.Method, strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/mgmt/shared/appsvcs/declare"), "/"), body)
+		return
+	}
+
+	switch {
+	case path == "cm/device" && r.Method == http.MethodGet:
+		writeJSON(w, map[string]interface{}{"items": f.devices})
+		return
+	case path == "cm" && r.Method == http.MethodPost:
+		f.syncs = append(f.syncs, fmt.Sprintf("%v", body["utilCmdArgs"]))
+		writeJSON(w, body)
+		return
+	case path == "transaction" && r.Method == http.MethodPost:
+		f.lastTransaction++
+		f.transactions[f.lastTransaction] = []fakeCall{}
+		writeJSON(w, map[string]interface{}{"transId": f.lastTransaction, "state": "STARTED"})
+		return
+	case strings.HasPrefix(path, "transaction/"):
+		f.handleTransaction(w, r.Method, strings.TrimPrefix(path, "transaction/"))
+		return
+	}
+
+	if code, ok := f.failures[r.Method+" "+path]; ok {
+		writeError(w, code, fmt.Sprintf("%s %s failed", r.Method, path))
+		return
+	}
+
+	if id := r.Header.Get("X-F5-REST-Coordination-Id"); len(id) > 0 {
+		transID, _ := strconv.ParseInt(id, 10, 64)
+		calls, ok := f.transactions[transID]
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("Transaction %s not found", id))
+			return
+		}
+		f.transactions[transID] = append(calls, fakeCall{method: r.Method, path: path, body: body})
+		writeJSON(w, body)
+		return
+	}
+
+	code, response := f.apply(r.Method, path, body)
+	if code != http.StatusOK {
+		writeError(w, code, response.(string))
+		return
+	}
+	writeJSON(w, response)
+}
+
+// handleTransaction commits or deletes transaction. Commit applies all queued calls, or none of them
+// if any fails.
+func (f *fakeBigIP) handleTransaction(w http.ResponseWriter, method string, id string) {
+	transID, _ := strconv.ParseInt(id, 10, 64)
+	calls, ok := f.transactions[transID]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Transaction %s not found", id))
+		return
+	}
+	switch method {
+	case http.MethodDelete:
+		delete(f.transactions, transID)
+		writeJSON(w, map[string]interface{}{})
+	case http.MethodPatch:
+		delete(f.transactions, transID)
+		backup := f.copyObjects()
+		for _, call := range calls {
+			code, response := f.apply(call.method, call.path, call.body)
+			if code != http.StatusOK {
+				f.objects = backup
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("transaction failed:%v", response))
+				return
+			}
+		}
+		f.commits++
+		writeJSON(w, map[string]interface{}{"transId": transID, "state": "COMPLETED"})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, method)
+	}
+}
+
+// handleAS3 stores tenants of posted declarations, tenants which are not in the declaration are not changed
+func (f *fakeBigIP) handleAS3(w http.ResponseWriter, method string, tenant string, body map[string]interface{}) {
+	switch method {
+	case http.MethodGet:
+		declaration, ok := f.tenants[tenant]
+		if !ok {
+			writeError(w, http.StatusNotFound, "specified tenant not found in declaration")
+			return
+		}
+		writeJSON(w, map[string]interface{}{"class": "ADC", "schemaVersion": "3.13.0", tenant: declaration})
+	case http.MethodPost:
+		f.as3Posts++
+		declaration, _ := body["declaration"].(map[string]interface{})
+		results := []interface{}{}
+		for name, value := range declaration {
+			object, ok := value.(map[string]interface{})
+			if !ok || object["class"] != "Tenant" {
+				continue
+			}
+			f.tenants[name] = object
+			results = append(results, map[string]interface{}{"code": 200, "message": "success", "tenant": name})
+		}
+		writeJSON(w, map[string]interface{}{"results": results})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, method)
+	}
+}
+
+func (f *fakeBigIP) copyObjects() map[string]map[string]interface{} {
+	objects := map[string]map[string]interface{}{}
+	for key, object := range f.objects {
+		copied := map[string]interface{}{}
+		for k, v := range object {
+			copied[k] = v
+		}
+		objects[key] = copied
+	}
+	return objects
+}
+
+// apply executes call to configuration, returns http status code and response body or error message
+func (f *fakeBigIP) apply(method string, path string, body map[string]interface{}) (int, interface{}) {
+	notFound := fmt.Sprintf("The requested object (%s) was not found.", path)
+	if source, ok := body["sourcePath"].(string); ok && strings.HasPrefix(path, "sys/file/ssl-cert") {
+		upload, ok := f.uploads[strings.TrimPrefix(source, "file:"+uploadDirectory)]
+		if !ok {
+			return http.StatusBadRequest, fmt.Sprintf("file %s not found", source)
+		}
+		body["fingerprint"], _ = fingerprint(string(upload))
+	}
+	switch method {
+	case http.MethodGet:
+		if object, ok := f.objects[path]; ok {
+			return http.StatusOK, object
+		}
+		if !f.isCollection(path) {
+			return http.StatusNotFound, notFound
+		}
+		items := []interface{}{}
+		for _, key := range f.children(path) {
+			items = append(items, f.objects[key])
+		}
+		return http.StatusOK, map[string]interface{}{"items": items}
+	case http.MethodPost:
+		fullPath, _ := body["name"].(string)
+		if len(fullPath) == 0 {
+			return http.StatusBadRequest, "name is required"
+		}
+		name := shortName(fullPath)
+		partition, _ := body["partition"].(string)
+		if s := strings.Split(strings.TrimPrefix(fullPath, "/"), "/"); len(s) > 1 {
+			partition = s[0]
+		}
+		if len(partition) == 0 {
+			partition = "Common"
+		}
+		if !f.isCollection(path) {
+			return http.StatusNotFound, notFound
+		}
+		key := path + "/" + name
+		if _, ok := f.objects[key]; ok {
+			return http.StatusConflict, fmt.Sprintf("01020066:3: The requested object (/%s/%s) already exists in partition %s.", partition, name, partition)
+		}
+		body["name"] = name
+		body["partition"] = partition
+		body["fullPath"] = fmt.Sprintf("/%s/%s", partition, name)
+		f.objects[key] = body
+		return http.StatusOK, body
+	case http.MethodPut, http.MethodPatch:
+		object, ok := f.objects[path]
+		if !ok {
+			return http.StatusNotFound, notFound
+		}
+		if options, ok := body["options"].(string); ok {
+			return changeRecords(object, options)
+		}
+		for key, value := range body {
+			if key == "name" || key == "partition" || key == "fullPath" {
+				continue
+			}
+			object[key] = value
+		}
+		return http.StatusOK, object
+	case http.MethodDelete:
+		if _, ok := f.objects[path]; !ok {
+			return http.StatusNotFound, notFound
+		}
+		for key := range f.objects {
+			if key == path || strings.HasPrefix(key, path+"/") {
+				delete(f.objects, key)
+			}
+		}
+		return http.StatusOK, map[string]interface{}{}
+	}
+	return http.StatusMethodNotAllowed, method
+}
+
+// changeRecords executes "records add { key { data value } }" or "records delete { key }" option of data group
+func changeRecords(object map[string]interface{}, options string) (int, interface{}) {
+	fields := strings.Fields(options)
+	if len(fields) < 4 || fields[0] != "records" {
+		return http.StatusBadRequest, fmt.Sprintf("invalid options %s", options)
+	}
+	key := fields[3]
+	records := []interface{}{}
+	found := false
+	existing, _ := object["records"].([]interface{})
+	for _, record := range existing {
+		if record.(map[string]interface{})["name"] == key {
+			found = true
+			continue
+		}
+		records = append(records, record)
+	}
+	switch {
+	case fields[1] == "add" && len(fields) == 9 && !found:
+		records = append(records, map[string]interface{}{"name": key, "data": fields[6]})
+	case fields[1] == "add" && found:
+		return http.StatusConflict, fmt.Sprintf("01020066:3: The requested data group record (%s) already exists.", key)
+	case fields[1] == "delete" && found:
+	default:
+		return http.StatusBadRequest, fmt.Sprintf("invalid options %s", options)
+	}
+	object["records"] = records
+	return http.StatusOK, object
+}
@@ -0,0 +1,103 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package f5
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	bigip "github.com/scottdware/go-bigip"
+)
+
+const failoverStateActive = "active"
+
+// deviceState is the failover state of a device in F5_ADDR
+type deviceState struct {
+	address string
+	session *bigip.BigIP
+	device  *bigip.Device
+	err     error
+}
+
+func (s deviceState) String() string {
+	if s.err != nil {
+		return fmt.Sprintf("%s: unreachable (%v)", s.address, s.err)
+	}
+	return fmt.Sprintf("%s: %s %s", s.address, s.device.Name, s.device.FailoverState)
+}
+
+// deviceStates queries failover state of all devices in parallel. Missing and expired sessions are
+// created, it must be called holding the write lock
+func (f5 *ProviderF5) deviceStates() []deviceState {
+	if len(f5.sessions) != len(f5.addresses) {
+		f5.sessions = make([]*bigip.BigIP, len(f5.addresses))
+		if f5.currentaddr < len(f5.sessions) {
+			f5.sessions[f5.currentaddr] = f5.session
+		}
+	}
+	states := make([]deviceState, len(f5.sessions))
+	var wg sync.WaitGroup
+	for i := range f5.sessions {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			states[i].address = f5.addresses[i]
+			session := f5.sessions[i]
+			if f5.expired(session) {
+				session, states[i].err = f5.newSession(f5.addresses[i])
+				if states[i].err != nil {
+					return
+				}
+			}
+			states[i].session = session
+			states[i].device, states[i].err = session.GetCurrentDevice()
+		}(i)
+	}
+	wg.Wait()
+	for i, state := range states {
+		if state.session != nil {
+			f5.sessions[i] = state.session
+		}
+	}
+	f5.staleSession = nil
+	return states
+}
+
+// selectActiveDevice changes the session to the active device. It fails if there is no active device
+// or if more than one device claims to be active (split brain), in which case nothing should be written.
+func (f5 *ProviderF5) selectActiveDevice() error {
+	states := f5.deviceStates()
+	active := []int{}
+	summary := []string{}
+	for i, state := range states {
+		summary = append(summary, state.String())
+		if state.err != nil {
+			log.Printf("f5 device %s", state)
+			continue
+		}
+		if state.device.FailoverState == failoverStateActive {
+			active = append(active, i)
+		}
+	}
+	switch len(active) {
+	case 0:
+		return fmt.Errorf("no active f5 device found, %s", strings.Join(summary, ", "))
+	case 1:
+	default:
+		return fmt.Errorf("split brain, multiple active f5 devices found, %s", strings.Join(summary, ", "))
+	}
+	i := active[0]
+	if i != f5.currentaddr || f5.activeDevice != states[i].device.Name {
+		log.Printf("using active f5 device %s at %s", states[i].device.Name, states[i].address)
+	}
+	f5.currentaddr = i
+	f5.session = states[i].session
+	f5.activeDevice = states[i].device.Name
+	return nil
+}
@@ -0,0 +1,66 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package f5
+
+import (
+	"fmt"
+	"strings"
+)
+
+const iRuleHeaders = `when HTTP_REQUEST {
+    HTTP::header remove X-Forwarded-For
+    HTTP::header remove X-Forwarded-Inet
+
+    HTTP::header insert X-Forwarded-Inet [IP::version]
+    HTTP::header insert X-Forwarded-For "[getfield [IP::remote_addr] % 1]"
+
+    set host [string tolower [getfield [HTTP::host] ":" 1]]
+`
+
+// dataGroupRule selects the pool from the data group, it is same as examples/f5.irule
+const dataGroupRule = `    set pool [class match -value "${host}_[TCP::local_port]" equals %s]
+    if { $pool eq "" } {
+      HTTP::respond 404 content "Application not found"
+    } else {
+      pool $pool
+    }
+}
+`
+
+// poolRule selects the pool by name, any pool of the partition is routable
+const poolRule = `    set pool "${host}_[TCP::local_port]"
+    if { [catch {pool $pool} id ] } {
+      HTTP::respond 404 content "Application not found"
+    }
+}
+`
+
+// lbSelectedRule disables persistence to members of roles without persistence
+const lbSelectedRule = `
+when LB_SELECTED {
+    if { %s } {
+      persist none
+    }
+}
+`
+
+// iRule returns the iRule of the virtual servers, which uses the data group if it is set. Members with
+// priorities of nonPersistent roles are not persisted.
+func iRule(dataGroup string, nonPersistent []int) string {
+	rule := iRuleHeaders + fmt.Sprintf(dataGroupRule, dataGroup)
+	if len(dataGroup) == 0 {
+		rule = iRuleHeaders + poolRule
+	}
+	if len(nonPersistent) == 0 {
+		return rule
+	}
+	conditions := []string{}
+	for _, prio := range nonPersistent {
+		conditions = append(conditions, fmt.Sprintf("[LB::server priority] == %d", prio))
+	}
+	return rule + fmt.Sprintf(lbSelectedRule, strings.Join(conditions, " || "))
+}
@@ -0,0 +1,185 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package f5
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	bigip "github.com/scottdware/go-bigip"
+)
+
+const (
+	defaultNodeMonitorPath = "/healthz"
+	nodeMonitorSuffix      = "_router"
+)
+
+type f5Node struct {
+	Address string `json:"address"`
+	Monitor string `json:"monitor"`
+}
+
+type f5Monitor struct {
+	Destination string `json:"destination"`
+	Send        string `json:"send"`
+}
+
+// nodeMember is a pool member which refers to the node
+type nodeMember struct {
+	pool   string
+	member bigip.PoolMember
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeMonitor returns full path of the monitor of the node, empty if node monitor is not used
+func (f5 *ProviderF5) nodeMonitor(membername string) string {
+	if len(f5.nodeMonitorPort) == 0 {
+		return ""
+	}
+	return getNameWithPool(f5.partition, membername+nodeMonitorSuffix)
+}
+
+// nodeMonitorOperations returns operations which create or modify monitor of the router health port
+func (f5 *ProviderF5) nodeMonitorOperations(ctx context.Context, session *bigip.BigIP, membername string) ([]operation, error) {
+	name := f5.nodeMonitor(membername)
+	path := "ltm/monitor/http/" + iControlName(name)
+	monitor := &f5Monitor{}
+	err := restCall(ctx, session, http.MethodGet, path, nil, nil, monitor)
+	exists := !isNotFound(err)
+	if exists && err != nil {
+		return nil, fmt.Errorf("error reading monitor %s %w", name, err)
+	}
+	destination := "*:" + f5.nodeMonitorPort
+	send := escapeSendString(monitorSendString(membername, f5.nodeMonitorPath, "GET"))
+	desired := map[string]interface{}{
+		"destination": destination,
+		"send":        send,
+	}
+	if !exists {
+		desired["name"] = name
+		desired["defaultsFrom"] = "http"
+		desired["recv"] = monitorReceiveString
+		return []operation{{http.MethodPost, "ltm/monitor/http", desired}}, nil
+	}
+	if monitor.Destination != destination || escapeSendString(monitor.Send) != send {
+		return []operation{{http.MethodPatch, path, desired}}, nil
+	}
+	return nil, nil
+}
+
+// nodeMembers returns pool members of the partition which refer to the node
+func (f5 *ProviderF5) nodeMembers(session *bigip.BigIP, membername string) ([]nodeMember, error) {
+	pools, err := f5.getPools(session)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching pool %w", err)
+	}
+	found := []nodeMember{}
+	for _, pool := range pools.Pools {
+		fullName := getNameWithPool(f5.partition, pool.Name)
+		members, err := session.PoolMembers(fullName)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving poolmembers %s %w", fullName, err)
+		}
+		for _, member := range members.PoolMembers {
+			if strings.Split(member.Name, ":")[0] == membername {
+				found = append(found, nodeMember{pool: fullName, member: member})
+			}
+		}
+	}
+	return found, nil
+}
+
+// SetMemberAddresses makes sure that node membername exists and its address is one of the router addresses.
+// The address of f5 node cannot be changed, so the node is recreated with the pool members which refer
+// to it when the address is not a router address anymore. All changes are made in one transaction.
+func (f5 *ProviderF5) SetMemberAddresses(ctx context.Context, membername string, addresses []string) error {
+	session := f5.getSession()
+	return f5.checkAuth(session, f5.setMemberAddresses(ctx, session, membername, addresses))
+}
+
+func (f5 *ProviderF5) setMemberAddresses(ctx context.Context, session *bigip.BigIP, membername string, addresses []string) error {
+	if len(addresses) == 0 {
+		return fmt.Errorf("no addresses for node %s", membername)
+	}
+	nodeName := getNameWithPool(f5.partition, membername)
+	nodePath := "ltm/node/" + iControlName(nodeName)
+	node := &f5Node{}
+	err := restCall(ctx, session, http.MethodGet, nodePath, nil, nil, node)
+	exists := !isNotFound(err)
+	if exists && err != nil {
+		return fmt.Errorf("error reading node %s %w", nodeName, err)
+	}
+
+	operations := []operation{}
+	monitor := f5.nodeMonitor(membername)
+	if len(monitor) > 0 {
+		ops, err := f5.nodeMonitorOperations(ctx, session, membername)
+		if err != nil {
+			return err
+		}
+		operations = append(operations, ops...)
+	}
+	desiredNode := map[string]interface{}{}
+	if len(monitor) > 0 {
+		desiredNode["monitor"] = monitor
+	}
+	createNode := func() {
+		desiredNode["name"] = nodeName
+		desiredNode["address"] = addresses[0]
+		operations = append(operations, operation{http.MethodPost, "ltm/node", desiredNode})
+	}
+	switch {
+	case !exists:
+		createNode()
+	case !contains(addresses, node.Address):
+		members, err := f5.nodeMembers(session, membername)
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			operations = append(operations, operation{http.MethodDelete, "ltm/pool/" + iControlName(m.pool) + "/members/" + iControlName(getNameWithPool(f5.partition, m.member.Name)), nil})
+		}
+		operations = append(operations, operation{http.MethodDelete, nodePath, nil})
+		createNode()
+		for _, m := range members {
+			enabled := "user-enabled"
+			if m.member.Session == "user-disabled" {
+				enabled = "user-disabled"
+			}
+			body := map[string]interface{}{
+				"name":          getNameWithPool(f5.partition, m.member.Name),
+				"priorityGroup": m.member.PriorityGroup,
+				"session":       enabled,
+			}
+			if m.member.Ratio > 0 {
+				body["ratio"] = m.member.Ratio
+			}
+			if m.member.ConnectionLimit > 0 {
+				body["connectionLimit"] = m.member.ConnectionLimit
+			}
+			operations = append(operations, operation{http.MethodPost, "ltm/pool/" + iControlName(m.pool) + "/members", body})
+		}
+		log.Printf("address %s of node %s is not a router address, recreating it with %d pool members", node.Address, nodeName, len(members))
+	case len(monitor) > 0 && strings.TrimSpace(node.Monitor) != monitor:
+		operations = append(operations, operation{http.MethodPatch, nodePath, desiredNode})
+	}
+	if len(operations) > 0 {
+		log.Printf("committing node %s", nodeName)
+	}
+	return execute(ctx, session, operations)
+}
@@ -0,0 +1,79 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package f5
+
+import (
+	"context"
+	"testing"
+
+	bigip "github.com/scottdware/go-bigip"
+)
+
+func TestSetMemberAddresses(t *testing.T) {
+	fake := newFakeBigIP()
+	defer fake.Close()
+
+	newf5 := NewProviderF5()
+	newf5.addresses = []string{fake.URL()}
+	newf5.partition = "xx"
+	newf5.session = bigip.NewSession(newf5.addresses[0], "yy", "xx", nil)
+	ctx := context.Background()
+
+	err := newf5.SetMemberAddresses(ctx, "dc1", []string{"10.0.0.1", "10.0.0.2"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if node := fake.objects["ltm/node/dc1"]; node == nil || node["address"] != "10.0.0.1" {
+		t.Errorf("excepted node with first address, got %v", node)
+	}
+
+	// current address is still a router address
+	commits := fake.commits
+	err = newf5.SetMemberAddresses(ctx, "dc1", []string{"10.0.0.0", "10.0.0.1"})
+	if err != nil || fake.commits != commits {
+		t.Errorf("excepted no changes, got %d commits %v", fake.commits-commits, err)
+	}
+
+	// node is recreated with the pool members
+	err = NewDeclarativeF5(newf5).Apply(ctx, newTestState("test", "dc1"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	fake.objects["ltm/pool/test_80/members/dc1:80"]["ratio"] = 3
+	fake.objects["ltm/pool/test_80/members/dc1:80"]["session"] = "user-disabled"
+	commits = fake.commits
+	err = newf5.SetMemberAddresses(ctx, "dc1", []string{"10.0.1.1"})
+	if err != nil || fake.commits != commits+1 {
+		t.Fatalf("excepted one commit, got %d %v", fake.commits-commits, err)
+	}
+	if node := fake.objects["ltm/node/dc1"]; node["address"] != "10.0.1.1" {
+		t.Errorf("excepted new address, got %v", node)
+	}
+	member := fake.objects["ltm/pool/test_80/members/dc1:80"]
+	if member == nil || member["ratio"] != float64(3) || member["session"] != "user-disabled" || member["priorityGroup"] != float64(1) {
+		t.Errorf("excepted member to be restored, got %v", member)
+	}
+	if fake.objects["ltm/pool/test_443/members/dc1:443"] == nil {
+		t.Errorf("excepted members of all pools to be restored")
+	}
+
+	// router health monitor
+	newf5.nodeMonitorPort = "1936"
+	err = newf5.SetMemberAddresses(ctx, "dc1", []string{"10.0.1.1"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	monitor := fake.objects["ltm/monitor/http/dc1_router"]
+	if monitor == nil || monitor["destination"] != "*:1936" || fake.objects["ltm/node/dc1"]["monitor"] != "/xx/dc1_router" {
+		t.Errorf("excepted node monitor, got %v %v", monitor, fake.objects["ltm/node/dc1"])
+	}
+	commits = fake.commits
+	err = newf5.SetMemberAddresses(ctx, "dc1", []string{"10.0.1.1"})
+	if err != nil || fake.commits != commits {
+		t.Errorf("excepted no changes, got %d commits %v", fake.commits-commits, err)
+	}
+}
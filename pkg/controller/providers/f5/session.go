@@ -0,0 +1,217 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package f5
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	bigip "github.com/scottdware/go-bigip"
+)
+
+const (
+	defaultLoginProvider = "tmos"
+	defaultAPITimeout    = 60 * time.Second
+	// token is renewed when it expires in less than this
+	tokenRefreshMargin = time.Minute
+)
+
+// sessionConfig contains settings which are used when sessions to f5 are created
+type sessionConfig struct {
+	// tokenAuth uses token based authentication instead of basic auth
+	tokenAuth     bool
+	loginProvider string
+	timeout       time.Duration
+	// transport is shared by all sessions, nil uses default transport of go-bigip
+	transport *http.Transport
+}
+
+// readSessionConfig reads session settings from environment variables
+func readSessionConfig() (sessionConfig, error) {
+	config := sessionConfig{
+		loginProvider: defaultLoginProvider,
+		timeout:       defaultAPITimeout,
+	}
+	switch auth := strings.ToLower(os.Getenv("F5_AUTH")); auth {
+	case "", "basic":
+	case "token":
+		config.tokenAuth = true
+	default:
+		return config, fmt.Errorf("invalid F5_AUTH %q, expected basic or token", auth)
+	}
+	if provider := os.Getenv("F5_LOGIN_PROVIDER"); len(provider) > 0 {
+		config.tokenAuth = true
+		config.loginProvider = provider
+	}
+	if value := os.Getenv("F5_TIMEOUT"); len(value) > 0 {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid F5_TIMEOUT %q: %v", value, err)
+		}
+		config.timeout = timeout
+	}
+
+	caFile := os.Getenv("F5_CA_FILE")
+	// certificates are not verified by default for backwards compatibility
+	insecure := len(caFile) == 0
+	if value := os.Getenv("F5_INSECURE"); len(value) > 0 {
+		var err error
+		insecure, err = strconv.ParseBool(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid F5_INSECURE %q: %v", value, err)
+		}
+	}
+	if insecure {
+		log.Printf("f5 api certificates are not verified")
+	}
+	transport, err := newTransport(caFile, insecure, config.timeout)
+	if err != nil {
+		return config, err
+	}
+	config.transport = transport
+	return config, nil
+}
+
+// newTransport returns transport which trusts certificates in caFile, or system roots if caFile is empty
+func newTransport(caFile string, insecure bool, timeout time.Duration) (*http.Transport, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecure,
+	}
+	if len(caFile) > 0 {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading F5_CA_FILE %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in F5_CA_FILE %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: timeout,
+		IdleConnTimeout:     90 * time.Second,
+	}, nil
+}
+
+type loginResponse struct {
+	Token struct {
+		Token      string `json:"token"`
+		Expiration int64  `json:"expirationMicros"`
+	} `json:"token"`
+}
+
+// newSession returns session to address. With token auth the session is logged in, if login fails
+// session without token is returned with the error and login is tried again on next use.
+// Sessions are not modified after they are returned, so that they can be used concurrently.
+func (f5 *ProviderF5) newSession(address string) (*bigip.BigIP, error) {
+	config := f5.sessionConfig
+	timeout := config.timeout
+	if timeout == 0 {
+		timeout = defaultAPITimeout
+	}
+	session := bigip.NewSession(address, f5.username, f5.password, &bigip.ConfigOptions{APICallTimeout: timeout})
+	if config.transport != nil {
+		session.Transport = config.transport
+	}
+	if !config.tokenAuth {
+		return session, nil
+	}
+	resp := &loginResponse{}
+	err := restCall(context.Background(), session, http.MethodPost, "mgmt/shared/authn/login", map[string]string{
+		"username":          f5.username,
+		"password":          f5.password,
+		"loginProviderName": config.loginProvider,
+	}, nil, resp)
+	if err == nil && len(resp.Token.Token) == 0 {
+		err = errors.New("unable to acquire authentication token")
+	}
+	if err != nil {
+		return session, fmt.Errorf("login to f5 %s failed: %v", address, err)
+	}
+	session.Token = resp.Token.Token
+	session.TokenExpiry = time.Unix(0, resp.Token.Expiration*int64(time.Microsecond))
+	return session, nil
+}
+
+// expired returns true if a new session should be created before session is used
+func (f5 *ProviderF5) expired(session *bigip.BigIP) bool {
+	if session == nil || session == f5.staleSession {
+		return true
+	}
+	if !f5.sessionConfig.tokenAuth {
+		return false
+	}
+	return len(session.Token) == 0 || time.Until(session.TokenExpiry) < tokenRefreshMargin
+}
+
+// renewSession replaces expired current session, it must be called holding the write lock
+func (f5 *ProviderF5) renewSession() {
+	if !f5.expired(f5.session) {
+		return
+	}
+	if f5.session != nil && f5.session == f5.staleSession && f5.credentialFiles.enabled() {
+		// credentials were rejected, they may have been changed after the last check
+		if _, err := f5.loadCredentials(); err != nil {
+			f5.reporter.CaptureError(err, nil)
+		}
+	}
+	session, err := f5.newSession(f5.addresses[f5.currentaddr])
+	if err != nil {
+		f5.reporter.CaptureError(err, nil)
+	}
+	f5.session = session
+	f5.staleSession = nil
+	if f5.currentaddr < len(f5.sessions) {
+		f5.sessions[f5.currentaddr] = session
+	}
+}
+
+// isUnauthorized returns true if the error is caused by rejected credentials or token
+func isUnauthorized(err error) bool {
+	if err == nil {
+		return false
+	}
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.code == http.StatusUnauthorized
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "http 401") || strings.Contains(msg, "x-f5-auth-token") || strings.Contains(msg, "authentication failed")
+}
+
+// checkAuth marks session stale if err is caused by authentication, so that new session is created
+// on next use
+func (f5 *ProviderF5) checkAuth(session *bigip.BigIP, err error) error {
+	if isUnauthorized(err) {
+		f5.lock.Lock()
+		if f5.session == session {
+			log.Printf("f5 rejected credentials, creating new session")
+			f5.staleSession = session
+		}
+		f5.lock.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,243 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package f5
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+)
+
+func TestTokenAuth(t *testing.T) {
+	fake := newFakeBigIP()
+	defer fake.Close()
+	fake.requireToken = true
+
+	newf5 := NewProviderF5()
+	newf5.partition = "xx"
+	newf5.username = "yy"
+	newf5.password = "xx"
+	newf5.addresses = []string{fake.URL()}
+	newf5.sessionConfig = sessionConfig{tokenAuth: true, loginProvider: defaultLoginProvider, timeout: time.Second}
+	session, err := newf5.newSession(fake.URL())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	newf5.session = session
+	d := NewDeclarativeF5(newf5)
+
+	err = d.Apply(context.Background(), newTestState("test", "cluster1"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// token is revoked, first call fails and the next one logs in again
+	fake.lock.Lock()
+	fake.tokens = map[string]bool{}
+	fake.lock.Unlock()
+	err = d.Apply(context.Background(), newTestState("test2", "cluster1"))
+	if !isUnauthorized(err) {
+		t.Errorf("excepted unauthorized error, got %v", err)
+	}
+	err = d.Apply(context.Background(), newTestState("test2", "cluster1"))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if fake.logins != 2 {
+		t.Errorf("excepted 2 logins, got %d", fake.logins)
+	}
+
+	// wrong password
+	newf5.password = "wrong"
+	_, err = newf5.newSession(fake.URL())
+	if err == nil {
+		t.Errorf("excepted login to fail")
+	}
+}
+
+func TestImperativeTokenAuth(t *testing.T) {
+	fake := newFakeBigIP()
+	defer fake.Close()
+	fake.requireToken = true
+
+	newf5 := NewProviderF5()
+	newf5.partition = "xx"
+	newf5.username = "yy"
+	newf5.password = "xx"
+	newf5.addresses = []string{fake.URL()}
+	newf5.sessionConfig = sessionConfig{tokenAuth: true, loginProvider: defaultLoginProvider, timeout: time.Second}
+	session, err := newf5.newSession(fake.URL())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	newf5.session = session
+
+	calls := []struct {
+		name string
+		call func() error
+	}{
+		{"CreatePool", func() error { return newf5.CreatePool("test", "80") }},
+		{"AddPoolMember", func() error { return newf5.AddPoolMember("cluster1", "test", "80") }},
+		{"ModifyPool", func() error {
+			return newf5.ModifyPool("test", "80", "", 0, false, 1, "", controller.MemberSettings{})
+		}},
+		{"CreateMonitor", func() error { return newf5.CreateMonitor("test", "80", "/", "GET", 3, 10) }},
+		{"ModifyMonitor", func() error { return newf5.ModifyMonitor("test", "80", "/", "GET", 3, 10) }},
+		{"AddMonitorToPool", func() error { return newf5.AddMonitorToPool("test", "80") }},
+		{"CheckPools", func() error {
+			_, err := newf5.CheckPools(nil, "", "cluster1")
+			return err
+		}},
+		{"DeletePoolMember", func() error { return newf5.DeletePoolMember("cluster1", "test", "80") }},
+		{"CheckAndClean", func() error { return newf5.CheckAndClean("test", "80") }},
+	}
+	for _, c := range calls {
+		// token is revoked, first call fails and the next one logs in again
+		fake.lock.Lock()
+		fake.tokens = map[string]bool{}
+		fake.lock.Unlock()
+		err = c.call()
+		if !isUnauthorized(err) {
+			t.Errorf("excepted unauthorized error from %s, got %v", c.name, err)
+		}
+		err = c.call()
+		if err != nil {
+			t.Errorf("%s %v", c.name, err)
+		}
+	}
+	if fake.logins != len(calls)+1 {
+		t.Errorf("excepted %d logins, got %d", len(calls)+1, fake.logins)
+	}
+	if len(fake.objects["ltm/pool/test_80"]) > 0 {
+		t.Errorf("excepted pool to be removed")
+	}
+}
+
+func TestTransport(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "f5")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	transport, err := newTransport(caFile, false, time.Second)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, err = (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Errorf("excepted certificate to be trusted, got %v", err)
+	}
+
+	transport, _ = newTransport("", false, time.Second)
+	_, err = (&http.Client{Transport: transport}).Get(server.URL)
+	if err == nil {
+		t.Errorf("excepted unknown certificate to be rejected")
+	}
+
+	transport, _ = newTransport("", true, time.Second)
+	_, err = (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Errorf("excepted insecure transport to accept certificate, got %v", err)
+	}
+
+	_, err = newTransport(filepath.Join(dir, "missing.pem"), false, time.Second)
+	if err == nil {
+		t.Errorf("excepted error from missing ca file")
+	}
+}
+
+func TestCredentialFiles(t *testing.T) {
+	fake := newFakeBigIP()
+	defer fake.Close()
+	fake.requireToken = true
+
+	dir, err := ioutil.TempDir("", "f5")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	userFile := filepath.Join(dir, "username")
+	passwordFile := filepath.Join(dir, "password")
+	ioutil.WriteFile(userFile, []byte("yy\n"), 0600)
+	ioutil.WriteFile(passwordFile, []byte("old"), 0600)
+
+	newf5 := NewProviderF5()
+	newf5.partition = "xx"
+	newf5.addresses = []string{fake.URL()}
+	newf5.credentialFiles = credentialFiles{username: userFile, password: passwordFile}
+	newf5.sessionConfig = sessionConfig{tokenAuth: true, loginProvider: defaultLoginProvider, timeout: time.Second}
+	changed, err := newf5.loadCredentials()
+	if err != nil || !changed || newf5.username != "yy" {
+		t.Fatalf("excepted credentials to be read, got %v %v", changed, err)
+	}
+	d := NewDeclarativeF5(newf5)
+
+	// old password is rejected
+	err = d.Apply(context.Background(), newTestState("test", "cluster1"))
+	if !isUnauthorized(err) {
+		t.Errorf("excepted unauthorized error, got %v", err)
+	}
+
+	// password is rotated, it is read again after the failure
+	ioutil.WriteFile(passwordFile, []byte("xx"), 0600)
+	err = d.Apply(context.Background(), newTestState("test", "cluster1"))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	// periodic reload renews session
+	ioutil.WriteFile(userFile, []byte("other"), 0600)
+	newf5.reloadCredentials()
+	if newf5.username != "other" || !newf5.expired(newf5.session) {
+		t.Errorf("excepted session to be renewed after credentials change")
+	}
+
+	os.Remove(passwordFile)
+	newf5.reloadCredentials()
+	if newf5.password != "xx" {
+		t.Errorf("missing file should not clear credentials")
+	}
+
+	// watcher reloads credentials until it is stopped
+	ioutil.WriteFile(passwordFile, []byte("new"), 0600)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		newf5.watchCredentials(10*time.Millisecond, stop)
+		close(stopped)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("excepted watcher to stop")
+	}
+	newf5.lock.RLock()
+	password := newf5.password
+	newf5.lock.RUnlock()
+	if password != "new" {
+		t.Errorf("excepted password to be reloaded, got %s", password)
+	}
+}
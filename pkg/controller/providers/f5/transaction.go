@@ -0,0 +1,148 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package f5
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	bigip "github.com/scottdware/go-bigip"
+)
+
+const coordinationHeader = "X-F5-REST-Coordination-Id"
+
+// transaction groups iControl REST calls so that they are committed or rolled back as a unit.
+// Calls made inside of transaction are only queued, they are validated and executed in commit.
+type transaction struct {
+	session *bigip.BigIP
+	id      string
+	calls   int
+}
+
+type transactionResponse struct {
+	TransID int64  `json:"transId"`
+	State   string `json:"state"`
+}
+
+// statusError is returned by restCall when f5 responds with error status
+type statusError struct {
+	code    int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+// restCall executes iControl REST call using session credentials. Path is relative to /mgmt/tm/
+// unless it starts with mgmt/. Body of type []byte is sent as it is, other bodies as json.
+func restCall(ctx context.Context, session *bigip.BigIP, method string, path string, body interface{}, header map[string]string, out interface{}) error {
+	var data []byte
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		data = b
+	default:
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	url := fmt.Sprintf("%s/mgmt/tm/%s", session.Host, path)
+	if strings.HasPrefix(path, "mgmt/") {
+		url = fmt.Sprintf("%s/%s", session.Host, path)
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if len(session.Token) > 0 {
+		req.Header.Set("X-F5-Auth-Token", session.Token)
+	} else {
+		req.SetBasicAuth(session.User, session.Password)
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	client := &http.Client{
+		Transport: session.Transport,
+		Timeout:   session.ConfigOptions.APICallTimeout,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		var reqError bigip.RequestError
+		if json.Unmarshal(respData, &reqError) == nil && len(reqError.Message) > 0 {
+			return &statusError{code: resp.StatusCode, message: reqError.Message}
+		}
+		return &statusError{code: resp.StatusCode, message: fmt.Sprintf("HTTP %d :: %s", resp.StatusCode, string(respData))}
+	}
+	if out != nil && len(respData) > 0 {
+		return json.Unmarshal(respData, out)
+	}
+	return nil
+}
+
+// iControlName returns name which can be used in iControl REST path, /ext/foo_80 is ~ext~foo_80
+func iControlName(name string) string {
+	return strings.Replace(name, "/", "~", -1)
+}
+
+// beginTransaction starts new transaction
+func beginTransaction(ctx context.Context, session *bigip.BigIP) (*transaction, error) {
+	resp := &transactionResponse{}
+	err := restCall(ctx, session, http.MethodPost, "transaction", map[string]interface{}{}, nil, resp)
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction %w", err)
+	}
+	return &transaction{
+		session: session,
+		id:      fmt.Sprintf("%d", resp.TransID),
+	}, nil
+}
+
+// add queues call to transaction
+func (t *transaction) add(ctx context.Context, method string, path string, body interface{}) error {
+	t.calls++
+	return restCall(ctx, t.session, method, path, body, map[string]string{coordinationHeader: t.id}, nil)
+}
+
+// commit executes queued calls, if any of them fails none of the changes are applied
+func (t *transaction) commit(ctx context.Context) error {
+	if t.calls == 0 {
+		return t.abort(ctx)
+	}
+	resp := &transactionResponse{}
+	err := restCall(ctx, t.session, http.MethodPatch, "transaction/"+t.id, map[string]string{"state": "VALIDATING"}, nil, resp)
+	if err != nil {
+		return fmt.Errorf("error committing transaction %s %w", t.id, err)
+	}
+	if len(resp.State) > 0 && resp.State != "COMPLETED" {
+		return fmt.Errorf("transaction %s ended in state %s", t.id, resp.State)
+	}
+	return nil
+}
+
+// abort drops the queued calls
+func (t *transaction) abort(ctx context.Context) error {
+	return restCall(ctx, t.session, http.MethodDelete, "transaction/"+t.id, nil, nil, nil)
+}
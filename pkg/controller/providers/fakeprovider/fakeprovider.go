@@ -7,14 +7,19 @@ SPDX-License-Identifier: Apache-2.0
 package fakeprovider
 
 import (
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/common"
 	v1 "github.com/openshift/api/route/v1"
 	"sync"
+	"time"
 )
 
 // Fakeprovider is an implementation of Interface for fakeprovider which helps testing.
 type Fakeprovider struct {
 	calls       []string
 	addCallLock sync.Mutex
+	errors      map[string]error
+	delay       time.Duration
+	reporter    common.ErrorReporter
 }
 
 func init() {
@@ -23,15 +28,39 @@ func init() {
 // NewFakeProvider returns new fakeprovider for testing purposes
 func NewFakeProvider() *Fakeprovider {
 	fake := Fakeprovider{
-		calls: []string{},
+		calls:    []string{},
+		errors:   map[string]error{},
+		reporter: common.NewNopReporter(),
 	}
 	return &fake
 }
 
-func (f *Fakeprovider) addCall(desc string) {
+func (f *Fakeprovider) addCall(desc string) error {
 	f.addCallLock.Lock()
-	defer f.addCallLock.Unlock()
 	f.calls = append(f.calls, desc)
+	err := f.errors[desc]
+	delay := f.delay
+	f.addCallLock.Unlock()
+	time.Sleep(delay)
+	return err
+}
+
+// SetDelay makes every method call to take at least delay
+func (f *Fakeprovider) SetDelay(delay time.Duration) {
+	f.addCallLock.Lock()
+	defer f.addCallLock.Unlock()
+	f.delay = delay
+}
+
+// FailOn makes method calls with given name return err, nil err removes the failure
+func (f *Fakeprovider) FailOn(method string, err error) {
+	f.addCallLock.Lock()
+	defer f.addCallLock.Unlock()
+	if err == nil {
+		delete(f.errors, method)
+		return
+	}
+	f.errors[method] = err
 }
 
 // Initialize initilizes new provider
@@ -39,75 +68,76 @@ func (f *Fakeprovider) Initialize() {
 	f.addCall("Initialize")
 }
 
+// SetReporter sets error reporter
+func (f *Fakeprovider) SetReporter(reporter common.ErrorReporter) {
+	f.reporter = reporter
+}
+
 // AddPoolMember adds new member to pool
 func (f *Fakeprovider) AddPoolMember(membername string, name string, port string) error {
-	f.addCall("AddPoolMember")
-	return nil
+	return f.addCall("AddPoolMember")
 }
 
 // CreatePool creates new loadbalancer pool
 func (f *Fakeprovider) CreatePool(name string, port string) error {
-	f.addCall("CreatePool")
-	return nil
+	return f.addCall("CreatePool")
 }
 
 // ModifyPool modifies loadbalancer pool
-func (f *Fakeprovider) ModifyPool(name string, port string, loadBalancingMethod string, pga int, maintenance bool, prio int, role string) error {
-	f.addCall("ModifyPool")
-	return nil
+func (f *Fakeprovider) ModifyPool(name string, port string, loadBalancingMethod string, pga int, maintenance bool, prio int, role string, settings common.MemberSettings) error {
+	return f.addCall("ModifyPool")
 }
 
 // CreateMonitor creates new monitor
 func (f *Fakeprovider) CreateMonitor(host string, port string, uri string, httpMethod string, interval int, timeout int) error {
-	f.addCall("CreateMonitor")
-	return nil
+	return f.addCall("CreateMonitor")
 }
 
 // ModifyMonitor modifies monitor
 func (f *Fakeprovider) ModifyMonitor(host string, port string, uri string, httpMethod string, interval int, timeout int) error {
-	f.addCall("ModifyMonitor")
-	return nil
+	return f.addCall("ModifyMonitor")
 }
 
 // AddMonitorToPool adds monitor to pool
 func (f *Fakeprovider) AddMonitorToPool(name string, port string) error {
-	f.addCall("AddMonitorToPool")
-	return nil
+	return f.addCall("AddMonitorToPool")
 }
 
 // DeletePoolMember delete pool member
 func (f *Fakeprovider) DeletePoolMember(membername string, name string, port string) error {
-	f.addCall("DeletePoolMember")
-	return nil
+	return f.addCall("DeletePoolMember")
 }
 
 // CheckAndClean checks pool members and if 0 members left in pool, delete monitor and delete pool
-func (f *Fakeprovider) CheckAndClean(name string, port string) {
-	f.addCall("CheckAndClean")
+func (f *Fakeprovider) CheckAndClean(name string, port string) error {
+	return f.addCall("CheckAndClean")
 }
 
 // CheckPools compares current load balancer setup and what routes we have. It returns list of pools which should be removed
-func (f *Fakeprovider) CheckPools(routes []v1.Route, hosttowatch string, membername string) map[string]bool {
-	f.addCall("CheckPools")
-	return nil
+func (f *Fakeprovider) CheckPools(routes []v1.Route, hosttowatch string, membername string) (map[string]bool, error) {
+	return nil, f.addCall("CheckPools")
 }
 
 // PreUpdate is executed before updating anything
-func (f *Fakeprovider) PreUpdate() {
-	f.addCall("PreUpdate")
+func (f *Fakeprovider) PreUpdate() error {
+	return f.addCall("PreUpdate")
 }
 
 // PostUpdate is executed after updating
-func (f *Fakeprovider) PostUpdate() {
-	f.addCall("PostUpdate")
+func (f *Fakeprovider) PostUpdate() error {
+	return f.addCall("PostUpdate")
 }
 
 // Calls returns list of methodcalls
 func (f *Fakeprovider) Calls() []string {
+	f.addCallLock.Lock()
+	defer f.addCallLock.Unlock()
 	return f.calls
 }
 
 // CleanCalls cleans calls
 func (f *Fakeprovider) CleanCalls() {
+	f.addCallLock.Lock()
+	defer f.addCallLock.Unlock()
 	f.calls = []string{}
 }
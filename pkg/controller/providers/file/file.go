@@ -0,0 +1,496 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package file
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/common"
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+	v1 "github.com/openshift/api/route/v1"
+)
+
+const (
+	providerName = "file"
+	// pathPlaceholder is replaced with the path of the rendered file in commands
+	pathPlaceholder       = "{}"
+	defaultCommandTimeout = 60 * time.Second
+)
+
+// ProviderFile is an implementation of ProviderInterface which keeps pools in memory and renders them
+// through a template to a configuration file. The file is validated and the lb reloaded in PostUpdate.
+type ProviderFile struct {
+	// lock protects pools, dirty and synced
+	lock  sync.Mutex
+	pools map[string]*Pool
+	// dirty is true when pools have changed after the file was rendered
+	dirty bool
+	// synced is true when the initial routes have been added to pools
+	synced bool
+
+	template       *template.Template
+	output         string
+	clusteralias   string
+	partition      string
+	memberAddress  string
+	checkCommand   string
+	reloadCommand  string
+	pidFile        string
+	reloadSignal   syscall.Signal
+	commandTimeout time.Duration
+	reporter       common.ErrorReporter
+}
+
+// Pool is a pool of one host and port, it is passed to the template
+type Pool struct {
+	Name                string
+	Host                string
+	Port                string
+	LoadBalancingMethod string
+	PGA                 int
+	Members             []*Member
+	// Monitor is nil if pool does not have monitor
+	Monitor *Monitor
+}
+
+// Member is a pool member, each cluster is a member
+type Member struct {
+	Name        string
+	Address     string
+	Port        string
+	Prio        int
+	Backup      bool
+	Maintenance bool
+	// Ratio is the weight of the member, 0 if it is not set
+	Ratio int
+	// ConnectionLimit is the maximum number of connections, 0 is unlimited
+	ConnectionLimit int
+	// SlowRampTime is the slow start time in seconds, 0 if it is not set
+	SlowRampTime int
+}
+
+// Monitor is a http health check of the pool
+type Monitor struct {
+	Path     string
+	Method   string
+	Interval int
+	Timeout  int
+}
+
+// TemplateData is passed to the template
+type TemplateData struct {
+	// Pools are sorted by name
+	Pools []*Pool
+}
+
+func init() {
+	controller.RegisterProvider(providerName, NewProviderFile())
+}
+
+// NewProviderFile returns new file provider
+func NewProviderFile() *ProviderFile {
+	return &ProviderFile{
+		pools:          map[string]*Pool{},
+		dirty:          true,
+		reloadSignal:   syscall.SIGHUP,
+		commandTimeout: defaultCommandTimeout,
+		reporter:       common.NewLogReporter(),
+	}
+}
+
+// Initialize initilizes new provider
+func (f *ProviderFile) Initialize() {
+	err := f.initialize()
+	if err != nil {
+		f.reporter.CaptureErrorAndWait(err, nil)
+		panic(err)
+	}
+}
+
+func (f *ProviderFile) initialize() error {
+	f.output = os.Getenv("FILE_OUTPUT")
+	if len(f.output) == 0 {
+		return errors.New("FILE_OUTPUT environment variable needed")
+	}
+	f.memberAddress = os.Getenv("FILE_MEMBER_ADDRESS")
+	if len(f.memberAddress) == 0 {
+		return errors.New("FILE_MEMBER_ADDRESS environment variable needed")
+	}
+	f.clusteralias = os.Getenv("CLUSTERALIAS")
+	f.partition = os.Getenv("PARTITION")
+	name := os.Getenv("FILE_TEMPLATE")
+	if len(name) == 0 {
+		return errors.New("FILE_TEMPLATE environment variable needed")
+	}
+	tmpl, err := loadTemplate(name)
+	if err != nil {
+		return err
+	}
+	f.template = tmpl
+	f.checkCommand = os.Getenv("FILE_CHECK_COMMAND")
+	f.reloadCommand = os.Getenv("FILE_RELOAD_COMMAND")
+	f.pidFile = os.Getenv("FILE_RELOAD_PID_FILE")
+	if value := os.Getenv("FILE_RELOAD_SIGNAL"); len(value) > 0 {
+		signal, err := parseSignal(value)
+		if err != nil {
+			return err
+		}
+		f.reloadSignal = signal
+	}
+	if value := os.Getenv("FILE_COMMAND_TIMEOUT"); len(value) > 0 {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid FILE_COMMAND_TIMEOUT %q: %v", value, err)
+		}
+		f.commandTimeout = timeout
+	}
+	return nil
+}
+
+func parseSignal(value string) (syscall.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(value), "SIG") {
+	case "HUP":
+		return syscall.SIGHUP, nil
+	case "USR1":
+		return syscall.SIGUSR1, nil
+	case "USR2":
+		return syscall.SIGUSR2, nil
+	}
+	return 0, fmt.Errorf("invalid FILE_RELOAD_SIGNAL %q, expected HUP, USR1 or USR2", value)
+}
+
+// loadTemplate returns template shipped with the controller, or reads it from file
+func loadTemplate(name string) (*template.Template, error) {
+	text, ok := templates[name]
+	if !ok {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("error reading FILE_TEMPLATE %v", err)
+		}
+		text = string(data)
+	}
+	tmpl, err := template.New(filepath.Base(name)).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template %s %v", name, err)
+	}
+	return tmpl, nil
+}
+
+// SetReporter sets error reporter
+func (f *ProviderFile) SetReporter(reporter common.ErrorReporter) {
+	f.reporter = reporter
+}
+
+func poolName(name string, port string) string {
+	return name + "_" + port
+}
+
+func (p *Pool) member(membername string) *Member {
+	for _, member := range p.Members {
+		if member.Name == membername {
+			return member
+		}
+	}
+	return nil
+}
+
+// getPool returns pool, it must be called holding the lock
+func (f *ProviderFile) getPool(name string, port string) (*Pool, error) {
+	pool, ok := f.pools[poolName(name, port)]
+	if !ok {
+		return nil, fmt.Errorf("pool %s does not exist", poolName(name, port))
+	}
+	return pool, nil
+}
+
+// CreatePool creates new pool
+func (f *ProviderFile) CreatePool(name string, port string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.pools[poolName(name, port)]; ok {
+		return nil
+	}
+	f.pools[poolName(name, port)] = &Pool{
+		Name: poolName(name, port),
+		Host: name,
+		Port: port,
+	}
+	f.dirty = true
+	return nil
+}
+
+// AddPoolMember adds new member to pool
+func (f *ProviderFile) AddPoolMember(membername string, name string, port string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	pool, err := f.getPool(name, port)
+	if err != nil {
+		return err
+	}
+	if pool.member(membername) != nil {
+		return nil
+	}
+	pool.Members = append(pool.Members, &Member{
+		Name:    membername,
+		Address: f.memberAddress,
+		Port:    port,
+	})
+	f.dirty = true
+	return nil
+}
+
+// ModifyPool modifies pool and the member of this cluster. Roles with lower priority than the greatest role
+// priority make the member backup member
+func (f *ProviderFile) ModifyPool(name string, port string, loadBalancingMethod string, pga int, maintenance bool, prio int, role string, settings controller.MemberSettings) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	pool, err := f.getPool(name, port)
+	if err != nil {
+		return err
+	}
+	member := pool.member(f.clusteralias)
+	if member == nil {
+		return fmt.Errorf("member %s does not exist in pool %s", f.clusteralias, pool.Name)
+	}
+	pool.LoadBalancingMethod = loadBalancingMethod
+	pool.PGA = pga
+	member.Prio = prio
+	member.Backup = settings.Backup
+	member.Maintenance = maintenance
+	member.Ratio = settings.Ratio
+	member.ConnectionLimit = settings.ConnectionLimit
+	member.SlowRampTime = 0
+	if settings.SlowRampTime != nil {
+		member.SlowRampTime = *settings.SlowRampTime
+	}
+	f.dirty = true
+	return nil
+}
+
+// CreateMonitor creates http health check of the pool
+func (f *ProviderFile) CreateMonitor(host string, port string, uri string, httpMethod string, interval int, timeout int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	pool, err := f.getPool(host, port)
+	if err != nil {
+		return err
+	}
+	pool.Monitor = &Monitor{
+		Path:     uri,
+		Method:   httpMethod,
+		Interval: interval,
+		Timeout:  timeout,
+	}
+	f.dirty = true
+	return nil
+}
+
+// ModifyMonitor modifies http health check of the pool
+func (f *ProviderFile) ModifyMonitor(host string, port string, uri string, httpMethod string, interval int, timeout int) error {
+	return f.CreateMonitor(host, port, uri, httpMethod, interval, timeout)
+}
+
+// AddMonitorToPool does nothing, monitor is created to the pool
+func (f *ProviderFile) AddMonitorToPool(name string, port string) error {
+	return nil
+}
+
+// DeletePoolMember deletes member from pool
+func (f *ProviderFile) DeletePoolMember(membername string, name string, port string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	pool, ok := f.pools[poolName(name, port)]
+	if !ok {
+		return nil
+	}
+	for i, member := range pool.Members {
+		if member.Name == membername {
+			pool.Members = append(pool.Members[:i], pool.Members[i+1:]...)
+			f.dirty = true
+			return nil
+		}
+	}
+	return nil
+}
+
+// CheckAndClean deletes pool if it does not have members
+func (f *ProviderFile) CheckAndClean(name string, port string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	pool, ok := f.pools[poolName(name, port)]
+	if ok && len(pool.Members) == 0 {
+		delete(f.pools, poolName(name, port))
+		f.dirty = true
+	}
+	return nil
+}
+
+// PreUpdate does nothing
+func (f *ProviderFile) PreUpdate() error {
+	return nil
+}
+
+// Synced renders the first configuration file when the routes which existed at startup are in pools
+func (f *ProviderFile) Synced(ctx context.Context) error {
+	f.lock.Lock()
+	f.synced = true
+	f.lock.Unlock()
+	return f.PostUpdate()
+}
+
+// PostUpdate renders the configuration file if pools have changed, nothing is rendered before initial
+// sync so that hosts which are not processed yet are not dropped from the running configuration
+func (f *ProviderFile) PostUpdate() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.dirty || !f.synced {
+		return nil
+	}
+	err := f.render()
+	if err != nil {
+		return err
+	}
+	f.dirty = false
+	return nil
+}
+
+// CheckPools compares current pools and what routes we have. It returns list of hosts which should be removed
+func (f *ProviderFile) CheckPools(routes []v1.Route, hosttowatch string, membername string) (map[string]bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	managed := map[string]bool{}
+	for i := range routes {
+		if controller.ManagedRoute(&routes[i], hosttowatch, f.partition) {
+			managed[routes[i].Spec.Host] = true
+		}
+	}
+	hosts := map[string]bool{}
+	for _, pool := range f.pools {
+		if !managed[pool.Host] && pool.member(membername) != nil {
+			hosts[pool.Host] = true
+		}
+	}
+	return hosts, nil
+}
+
+// data returns template data, it must be called holding the lock
+func (f *ProviderFile) data() TemplateData {
+	data := TemplateData{Pools: []*Pool{}}
+	for _, pool := range f.pools {
+		data.Pools = append(data.Pools, pool)
+	}
+	sort.Slice(data.Pools, func(i, j int) bool {
+		return data.Pools[i].Name < data.Pools[j].Name
+	})
+	return data
+}
+
+// render writes the configuration file, validates it and reloads the lb. The file is not replaced
+// if validation fails, and nothing is done if the content has not changed.
+func (f *ProviderFile) render() error {
+	buf := &bytes.Buffer{}
+	err := f.template.Execute(buf, f.data())
+	if err != nil {
+		return fmt.Errorf("error rendering template %v", err)
+	}
+	current, err := ioutil.ReadFile(f.output)
+	if err == nil && bytes.Equal(current, buf.Bytes()) {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.output), "."+filepath.Base(f.output))
+	if err != nil {
+		return fmt.Errorf("error creating temporary file %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(buf.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing temporary file %v", err)
+	}
+	if len(f.checkCommand) > 0 {
+		err = f.run(f.checkCommand, tmp.Name())
+		if err != nil {
+			return fmt.Errorf("validation of %s failed %v", f.output, err)
+		}
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), f.output)
+	if err != nil {
+		return fmt.Errorf("error writing %s %v", f.output, err)
+	}
+	log.Printf("wrote %s with %d pools", f.output, len(f.pools))
+	return f.reload()
+}
+
+// run executes command, placeholder in arguments is replaced with path
+func (f *ProviderFile) run(command string, path string) error {
+	args := strings.Fields(command)
+	for i := range args {
+		args[i] = strings.Replace(args[i], pathPlaceholder, path, -1)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), f.commandTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// reload executes reload command or sends signal to the process in pid file
+func (f *ProviderFile) reload() error {
+	if len(f.reloadCommand) > 0 {
+		err := f.run(f.reloadCommand, f.output)
+		if err != nil {
+			return fmt.Errorf("reload failed %v", err)
+		}
+	}
+	if len(f.pidFile) > 0 {
+		data, err := ioutil.ReadFile(f.pidFile)
+		if err != nil {
+			return fmt.Errorf("error reading pid file %v", err)
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return fmt.Errorf("invalid pid file %s %v", f.pidFile, err)
+		}
+		err = syscall.Kill(pid, f.reloadSignal)
+		if err != nil {
+			return fmt.Errorf("error sending %v to %d %v", f.reloadSignal, pid, err)
+		}
+	}
+	return nil
+}
+
+// Calls returns list of methodcalls, not in use in this provider
+func (f *ProviderFile) Calls() []string {
+	return nil
+}
+
+// CleanCalls cleans calls, not in use in this provider
+func (f *ProviderFile) CleanCalls() {
+}
@@ -0,0 +1,212 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package file
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+	v1 "github.com/openshift/api/route/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestProvider(t *testing.T, name string) (*ProviderFile, string) {
+	dir, err := ioutil.TempDir("", "file-provider")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	tmpl, err := loadTemplate(name)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	f := NewProviderFile()
+	f.template = tmpl
+	f.output = filepath.Join(dir, name+".cfg")
+	f.memberAddress = "10.0.0.1"
+	f.clusteralias = "dc1"
+	f.partition = "ext"
+	f.synced = true
+	return f, dir
+}
+
+func addHost(t *testing.T, f *ProviderFile, host string, role string, maintenance bool, settings controller.MemberSettings) {
+	for _, port := range controller.Ports {
+		for _, err := range []error{
+			f.CreatePool(host, port),
+			f.AddPoolMember("dc1", host, port),
+			f.ModifyPool(host, port, "least-connections-member", 1, maintenance, 10, role, settings),
+			f.CreateMonitor(host, port, "/health", "GET", 3, 10),
+			f.AddMonitorToPool(host, port),
+		} {
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+	}
+}
+
+func readOutput(t *testing.T, f *ProviderFile) string {
+	data, err := ioutil.ReadFile(f.output)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return string(data)
+}
+
+func TestRenderHAProxy(t *testing.T) {
+	f, dir := newTestProvider(t, "haproxy")
+	defer os.RemoveAll(dir)
+	reloaded := filepath.Join(dir, "reloaded")
+	f.checkCommand = "test -s {}"
+	f.reloadCommand = "touch " + reloaded
+
+	slowRamp := 30
+	addHost(t, f, "test", "standby", false, controller.MemberSettings{Ratio: 2, ConnectionLimit: 50, SlowRampTime: &slowRamp, Backup: true})
+	err := f.PostUpdate()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	config := readOutput(t, f)
+	for _, line := range []string{
+		"backend test_443",
+		"    balance leastconn",
+		`    option httpchk GET /health HTTP/1.1\r\nHost:\ test`,
+		"    server dc1 10.0.0.1:443 check ssl verify none weight 2 maxconn 50 slowstart 30s backup",
+		"    server dc1 10.0.0.1:80 check weight 2 maxconn 50 slowstart 30s backup",
+	} {
+		if !strings.Contains(config, line+"\n") {
+			t.Errorf("excepted %q in config, got\n%s", line, config)
+		}
+	}
+	if _, err := os.Stat(reloaded); err != nil {
+		t.Errorf("excepted reload, got %v", err)
+	}
+
+	// unchanged configuration is not reloaded
+	os.Remove(reloaded)
+	f.dirty = true
+	err = f.PostUpdate()
+	if _, statErr := os.Stat(reloaded); err != nil || statErr == nil {
+		t.Errorf("unchanged configuration should not be reloaded, got %v", err)
+	}
+
+	// invalid configuration does not replace the file
+	f.checkCommand = "false"
+	for _, port := range controller.Ports {
+		f.DeletePoolMember("dc1", "test", port)
+		f.CheckAndClean("test", port)
+	}
+	err = f.PostUpdate()
+	if err == nil || readOutput(t, f) != config || !f.dirty {
+		t.Errorf("excepted validation error and old config, got %v", err)
+	}
+	f.checkCommand = ""
+	err = f.PostUpdate()
+	if err != nil || strings.Contains(readOutput(t, f), "backend") {
+		t.Errorf("excepted empty config, got %v\n%s", err, readOutput(t, f))
+	}
+}
+
+func TestRenderNginx(t *testing.T) {
+	f, dir := newTestProvider(t, "nginx")
+	defer os.RemoveAll(dir)
+
+	addHost(t, f, "test", "active", true, controller.MemberSettings{ConnectionLimit: 20})
+	err := f.PostUpdate()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	config := readOutput(t, f)
+	for _, line := range []string{
+		"upstream test_80 {",
+		"    least_conn;",
+		"    server 10.0.0.1:443 max_fails=3 fail_timeout=10s max_conns=20 down;",
+		"    server_name test;",
+		"        proxy_pass http://test_80;",
+	} {
+		if !strings.Contains(config, line+"\n") {
+			t.Errorf("excepted %q in config, got\n%s", line, config)
+		}
+	}
+}
+
+func TestCheckPools(t *testing.T) {
+	f, dir := newTestProvider(t, "haproxy")
+	defer os.RemoveAll(dir)
+
+	addHost(t, f, "test.example.com", "active", false, controller.MemberSettings{})
+	addHost(t, f, "www.fooext.fi", "active", false, controller.MemberSettings{})
+	route := v1.Route{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{controller.CustomHostAnnotation: "other"}},
+		Spec:       v1.RouteSpec{Host: "www.fooext.fi"},
+	}
+	routes := []v1.Route{{Spec: v1.RouteSpec{Host: "test.example.com"}}, route}
+	hosts, err := f.CheckPools(routes, ".example.com", "dc1")
+	if err != nil || len(hosts) != 1 || !hosts["www.fooext.fi"] {
+		t.Errorf("excepted host of other partition to be removed, got %v %v", hosts, err)
+	}
+	route.Annotations[controller.CustomHostAnnotation] = "ext"
+	hosts, err = f.CheckPools(routes, ".example.com", "dc1")
+	if err != nil || len(hosts) != 0 {
+		t.Errorf("excepted hosts to be kept, got %v %v", hosts, err)
+	}
+}
+
+func TestModifyMember(t *testing.T) {
+	f, dir := newTestProvider(t, "haproxy")
+	defer os.RemoveAll(dir)
+
+	addHost(t, f, "test", "active", false, controller.MemberSettings{})
+	err := f.AddPoolMember("dc2", "test", "80")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = f.ModifyPool("test", "80", "", 1, true, 5, "", controller.MemberSettings{Ratio: 3})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	pool := f.pools[poolName("test", "80")]
+	if member := pool.member("dc1"); !member.Maintenance || member.Prio != 5 || member.Ratio != 3 {
+		t.Errorf("excepted settings of dc1 to be modified, got %v", member)
+	}
+	if member := pool.member("dc2"); member.Maintenance || member.Prio != 0 || member.Ratio != 0 {
+		t.Errorf("excepted member of other cluster to be unchanged, got %v", member)
+	}
+
+	f.clusteralias = "dc3"
+	err = f.ModifyPool("test", "80", "", 1, true, 5, "", controller.MemberSettings{})
+	if err == nil {
+		t.Errorf("excepted error from missing member")
+	}
+}
+
+func TestSynced(t *testing.T) {
+	f, dir := newTestProvider(t, "haproxy")
+	defer os.RemoveAll(dir)
+	f.synced = false
+
+	addHost(t, f, "test", "active", false, controller.MemberSettings{})
+	err := f.PostUpdate()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := os.Stat(f.output); !os.IsNotExist(err) {
+		t.Errorf("excepted nothing to be rendered before sync, got %v", err)
+	}
+	err = f.Synced(context.Background())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if config := readOutput(t, f); !strings.Contains(config, "backend test_80\n") {
+		t.Errorf("excepted test in config after sync, got\n%s", config)
+	}
+}
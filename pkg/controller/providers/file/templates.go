@@ -0,0 +1,72 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package file
+
+import (
+	"strings"
+	"text/template"
+)
+
+// templates shipped with the controller, selected by name in FILE_TEMPLATE
+var templates = map[string]string{
+	"haproxy": haproxyTemplate,
+	"nginx":   nginxTemplate,
+}
+
+var templateFuncs = template.FuncMap{
+	// leastConn returns true if load balancing method balances by connections
+	"leastConn": func(method string) bool {
+		return strings.HasPrefix(method, "least-")
+	},
+}
+
+// haproxyTemplate renders one backend per pool. Frontends are not rendered, they should select the
+// backend by host and port, for instance use_backend %[req.hdr(host),lower,field(1,:)]_80
+const haproxyTemplate = `# generated by openshift-lb-controller, do not edit
+{{- range $pool := .Pools}}
+
+backend {{$pool.Name}}
+    mode http
+    balance {{if leastConn $pool.LoadBalancingMethod}}leastconn{{else}}roundrobin{{end}}
+{{- with $pool.Monitor}}
+    option httpchk {{.Method}} {{.Path}} HTTP/1.1\r\nHost:\ {{$pool.Host}}
+    timeout check {{.Timeout}}s
+    default-server inter {{.Interval}}s
+{{- end}}
+{{- range $pool.Members}}
+    server {{.Name}} {{.Address}}:{{.Port}}{{if $pool.Monitor}} check{{end}}{{if eq .Port "443"}} ssl verify none{{end}}{{if .Ratio}} weight {{.Ratio}}{{end}}{{if .ConnectionLimit}} maxconn {{.ConnectionLimit}}{{end}}{{if .SlowRampTime}} slowstart {{.SlowRampTime}}s{{end}}{{if .Backup}} backup{{end}}{{if .Maintenance}} disabled{{end}}
+{{- end}}
+{{- end}}
+`
+
+// nginxTemplate renders one upstream per pool and a server for plain http pools. Open source nginx does
+// not have active health checks, monitor timeout is used for passive checks instead.
+const nginxTemplate = `# generated by openshift-lb-controller, do not edit
+{{- range $pool := .Pools}}
+
+upstream {{$pool.Name}} {
+{{- if leastConn $pool.LoadBalancingMethod}}
+    least_conn;
+{{- end}}
+{{- range $pool.Members}}
+    server {{.Address}}:{{.Port}}{{with $pool.Monitor}} max_fails=3 fail_timeout={{.Timeout}}s{{end}}{{if .Ratio}} weight={{.Ratio}}{{end}}{{if .ConnectionLimit}} max_conns={{.ConnectionLimit}}{{end}}{{if .Backup}} backup{{end}}{{if .Maintenance}} down{{end}};
+{{- end}}
+}
+{{- if eq $pool.Port "80"}}
+
+server {
+    listen 80;
+    server_name {{$pool.Host}};
+    location / {
+        proxy_pass http://{{$pool.Name}};
+        proxy_set_header Host $host;
+        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+    }
+}
+{{- end}}
+{{- end}}
+`
@@ -0,0 +1,473 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package haproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/common"
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+	v1 "github.com/openshift/api/route/v1"
+)
+
+const (
+	providerName      = "haproxy"
+	configurationPath = "/v2/services/haproxy/configuration"
+	transactionsPath  = "/v2/services/haproxy/transactions"
+	defaultTimeout    = 60 * time.Second
+)
+
+// ProviderHAProxy is an implementation of ProviderInterface for HAProxy Data Plane API. Each host and
+// port has own backend, each cluster is a server in the backend. Changes made between PreUpdate and
+// PostUpdate are committed in one transaction.
+type ProviderHAProxy struct {
+	url           string
+	username      string
+	password      string
+	clusteralias  string
+	partition     string
+	memberAddress string
+	client        *http.Client
+	reporter      common.ErrorReporter
+	// lock protects transaction
+	lock        sync.Mutex
+	transaction string
+}
+
+type backend struct {
+	Name    string   `json:"name"`
+	Mode    string   `json:"mode,omitempty"`
+	Balance *balance `json:"balance,omitempty"`
+}
+
+type balance struct {
+	Algorithm string `json:"algorithm"`
+}
+
+type server struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+	Check   string `json:"check,omitempty"`
+	Ssl     string `json:"ssl,omitempty"`
+	Verify  string `json:"verify,omitempty"`
+}
+
+type transactionResponse struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// apiError is returned when Data Plane API responds with error status
+type apiError struct {
+	code    int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("haproxy api error %d: %s", e.code, e.message)
+}
+
+func isStatus(err error, code int) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && apiErr.code == code
+}
+
+func init() {
+	controller.RegisterProvider(providerName, NewProviderHAProxy())
+}
+
+// NewProviderHAProxy returns new haproxy provider
+func NewProviderHAProxy() *ProviderHAProxy {
+	return &ProviderHAProxy{
+		client:   &http.Client{Timeout: defaultTimeout},
+		reporter: common.NewLogReporter(),
+	}
+}
+
+// Initialize initilizes new provider
+func (h *ProviderHAProxy) Initialize() {
+	h.url = strings.TrimSuffix(os.Getenv("HAPROXY_URL"), "/")
+	if len(h.url) == 0 {
+		err := errors.New("HAPROXY_URL environment variable needed")
+		h.reporter.CaptureErrorAndWait(err, nil)
+		panic(err)
+	}
+	h.username = os.Getenv("HAPROXY_USER")
+	h.password = os.Getenv("HAPROXY_PASSWORD")
+	h.memberAddress = os.Getenv("HAPROXY_MEMBER_ADDRESS")
+	if len(h.memberAddress) == 0 {
+		err := errors.New("HAPROXY_MEMBER_ADDRESS environment variable needed")
+		h.reporter.CaptureErrorAndWait(err, nil)
+		panic(err)
+	}
+	h.clusteralias = os.Getenv("CLUSTERALIAS")
+	h.partition = os.Getenv("PARTITION")
+	if value := os.Getenv("HAPROXY_TIMEOUT"); len(value) > 0 {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			err = fmt.Errorf("invalid HAPROXY_TIMEOUT %q: %v", value, err)
+			h.reporter.CaptureErrorAndWait(err, nil)
+			panic(err)
+		}
+		h.client.Timeout = timeout
+	}
+}
+
+// SetReporter sets error reporter
+func (h *ProviderHAProxy) SetReporter(reporter common.ErrorReporter) {
+	h.reporter = reporter
+}
+
+// call executes Data Plane API call. Path is relative to configuration path unless it starts with /
+func (h *ProviderHAProxy) call(method string, path string, query url.Values, body interface{}, out interface{}) error {
+	if !strings.HasPrefix(path, "/") {
+		path = configurationPath + "/" + path
+	}
+	if query == nil {
+		query = url.Values{}
+	}
+	if strings.HasPrefix(path, configurationPath+"/") && path != configurationPath+"/version" {
+		h.lock.Lock()
+		transaction := h.transaction
+		h.lock.Unlock()
+		// reads inside the transaction see changes which are not committed yet
+		if len(transaction) > 0 {
+			query.Set("transaction_id", transaction)
+		} else if method != http.MethodGet {
+			version, err := h.version()
+			if err != nil {
+				return err
+			}
+			query.Set("version", fmt.Sprintf("%d", version))
+		}
+	}
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	address := h.url + path
+	if len(query) > 0 {
+		address += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, address, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(h.username) > 0 {
+		req.SetBasicAuth(h.username, h.password)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		message := struct {
+			Message string `json:"message"`
+		}{}
+		if json.Unmarshal(respData, &message) != nil || len(message.Message) == 0 {
+			message.Message = string(respData)
+		}
+		return &apiError{code: resp.StatusCode, message: message.Message}
+	}
+	if out != nil && len(respData) > 0 {
+		return json.Unmarshal(respData, out)
+	}
+	return nil
+}
+
+func (h *ProviderHAProxy) version() (int64, error) {
+	var version int64
+	err := h.call(http.MethodGet, "version", nil, nil, &version)
+	return version, err
+}
+
+func backendName(name string, port string) string {
+	return name + "_" + port
+}
+
+func backendQuery(name string) url.Values {
+	return url.Values{"backend": []string{name}}
+}
+
+// balanceAlgorithm converts load balancing method annotation to haproxy algorithm
+func balanceAlgorithm(loadBalancingMethod string) string {
+	switch loadBalancingMethod {
+	case "", "round-robin", "ratio-member", "ratio-node":
+		return "roundrobin"
+	case "least-connections-member", "least-connections-node", "least-sessions":
+		return "leastconn"
+	}
+	log.Printf("load balancing method %s is not supported by haproxy, using roundrobin", loadBalancingMethod)
+	return "roundrobin"
+}
+
+// getBackend returns backend as generic object, so that settings not managed by us are kept when it is replaced
+func (h *ProviderHAProxy) getBackend(name string) (map[string]interface{}, error) {
+	resp := struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+	err := h.call(http.MethodGet, "backends/"+url.PathEscape(name), nil, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+func (h *ProviderHAProxy) getServers(backendname string) ([]server, error) {
+	resp := struct {
+		Data []server `json:"data"`
+	}{}
+	err := h.call(http.MethodGet, "servers", backendQuery(backendname), nil, &resp)
+	return resp.Data, err
+}
+
+func (h *ProviderHAProxy) getServer(backendname string, membername string) (map[string]interface{}, error) {
+	resp := struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+	err := h.call(http.MethodGet, "servers/"+url.PathEscape(membername), backendQuery(backendname), nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// CreatePool creates new backend
+func (h *ProviderHAProxy) CreatePool(name string, port string) error {
+	err := h.call(http.MethodPost, "backends", nil, &backend{
+		Name:    backendName(name, port),
+		Mode:    "http",
+		Balance: &balance{Algorithm: "roundrobin"},
+	}, nil)
+	if isStatus(err, http.StatusConflict) {
+		return nil
+	}
+	return err
+}
+
+// AddPoolMember adds new server to backend
+func (h *ProviderHAProxy) AddPoolMember(membername string, name string, port string) error {
+	s := &server{
+		Name:    membername,
+		Address: h.memberAddress,
+		Check:   "enabled",
+	}
+	fmt.Sscanf(port, "%d", &s.Port)
+	if port == "443" {
+		s.Ssl = "enabled"
+		s.Verify = "none"
+	}
+	err := h.call(http.MethodPost, "servers", backendQuery(backendName(name, port)), s, nil)
+	if isStatus(err, http.StatusConflict) {
+		return nil
+	}
+	return err
+}
+
+// ModifyPool modifies backend balancing and server of this cluster. Roles with lower priority than the greatest
+// role priority make the server backup server, pga and priorities are not supported
+func (h *ProviderHAProxy) ModifyPool(name string, port string, loadBalancingMethod string, pga int, maintenance bool, prio int, role string, settings controller.MemberSettings) error {
+	backendname := backendName(name, port)
+	b, err := h.getBackend(backendname)
+	if err != nil {
+		return err
+	}
+	b["balance"] = &balance{Algorithm: balanceAlgorithm(loadBalancingMethod)}
+	err = h.call(http.MethodPut, "backends/"+url.PathEscape(backendname), nil, b, nil)
+	if err != nil {
+		return err
+	}
+	s, err := h.getServer(backendname, h.clusteralias)
+	if err != nil {
+		return err
+	}
+	s["backup"] = "disabled"
+	if settings.Backup {
+		s["backup"] = "enabled"
+	}
+	s["maintenance"] = "disabled"
+	if maintenance {
+		s["maintenance"] = "enabled"
+	}
+	delete(s, "weight")
+	if settings.Ratio > 0 {
+		s["weight"] = settings.Ratio
+	}
+	delete(s, "maxconn")
+	if settings.ConnectionLimit > 0 {
+		s["maxconn"] = settings.ConnectionLimit
+	}
+	delete(s, "slowstart")
+	if settings.SlowRampTime != nil && *settings.SlowRampTime > 0 {
+		s["slowstart"] = *settings.SlowRampTime * 1000
+	}
+	return h.call(http.MethodPut, "servers/"+url.PathEscape(h.clusteralias), backendQuery(backendname), s, nil)
+}
+
+// CreateMonitor configures http health check of the backend
+func (h *ProviderHAProxy) CreateMonitor(host string, port string, uri string, httpMethod string, interval int, timeout int) error {
+	backendname := backendName(host, port)
+	b, err := h.getBackend(backendname)
+	if err != nil {
+		return err
+	}
+	b["adv_check"] = "httpchk"
+	b["httpchk_params"] = map[string]string{
+		"method":  httpMethod,
+		"uri":     uri,
+		"version": `HTTP/1.1\r\nHost:\ ` + host,
+	}
+	b["check_timeout"] = timeout * 1000
+	defaults, ok := b["default_server"].(map[string]interface{})
+	if !ok {
+		defaults = map[string]interface{}{}
+	}
+	defaults["inter"] = interval * 1000
+	b["default_server"] = defaults
+	return h.call(http.MethodPut, "backends/"+url.PathEscape(backendname), nil, b, nil)
+}
+
+// ModifyMonitor modifies http health check of the backend
+func (h *ProviderHAProxy) ModifyMonitor(host string, port string, uri string, httpMethod string, interval int, timeout int) error {
+	return h.CreateMonitor(host, port, uri, httpMethod, interval, timeout)
+}
+
+// AddMonitorToPool does nothing, health check is part of the backend and servers are created with checks enabled
+func (h *ProviderHAProxy) AddMonitorToPool(name string, port string) error {
+	return nil
+}
+
+// DeletePoolMember deletes server from backend
+func (h *ProviderHAProxy) DeletePoolMember(membername string, name string, port string) error {
+	err := h.call(http.MethodDelete, "servers/"+url.PathEscape(membername), backendQuery(backendName(name, port)), nil, nil)
+	if isStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
+
+// CheckAndClean deletes backend if it does not have servers
+func (h *ProviderHAProxy) CheckAndClean(name string, port string) error {
+	backendname := backendName(name, port)
+	servers, err := h.getServers(backendname)
+	if isStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error retrieving servers %s %v", backendname, err)
+	}
+	if len(servers) > 0 {
+		return nil
+	}
+	err = h.call(http.MethodDelete, "backends/"+url.PathEscape(backendname), nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("error delete backend %s %v", backendname, err)
+	}
+	return nil
+}
+
+// PreUpdate starts transaction, changes are committed in PostUpdate
+func (h *ProviderHAProxy) PreUpdate() error {
+	version, err := h.version()
+	if err != nil {
+		return err
+	}
+	resp := &transactionResponse{}
+	err = h.call(http.MethodPost, transactionsPath, url.Values{"version": []string{fmt.Sprintf("%d", version)}}, nil, resp)
+	if err != nil {
+		return fmt.Errorf("error starting transaction %v", err)
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.transaction = resp.ID
+	return nil
+}
+
+// PostUpdate commits the transaction, haproxy configuration is reloaded once
+func (h *ProviderHAProxy) PostUpdate() error {
+	h.lock.Lock()
+	transaction := h.transaction
+	h.transaction = ""
+	h.lock.Unlock()
+	if len(transaction) == 0 {
+		return nil
+	}
+	err := h.call(http.MethodPut, transactionsPath+"/"+url.PathEscape(transaction), nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("error committing transaction %s %v", transaction, err)
+	}
+	return nil
+}
+
+// CheckPools compares current backends and what routes we have. It returns list of hosts which should be removed
+func (h *ProviderHAProxy) CheckPools(routes []v1.Route, hosttowatch string, membername string) (map[string]bool, error) {
+	hosts := map[string]bool{}
+	resp := struct {
+		Data []backend `json:"data"`
+	}{}
+	err := h.call(http.MethodGet, "backends", nil, nil, &resp)
+	if err != nil {
+		return hosts, fmt.Errorf("error fetching backends %v", err)
+	}
+	managed := map[string]bool{}
+	for i := range routes {
+		if controller.ManagedRoute(&routes[i], hosttowatch, h.partition) {
+			managed[routes[i].Spec.Host] = true
+		}
+	}
+	for _, b := range resp.Data {
+		i := strings.LastIndex(b.Name, "_")
+		if i < 0 {
+			continue
+		}
+		host := b.Name[:i]
+		if managed[host] || hosts[host] {
+			continue
+		}
+		servers, err := h.getServers(b.Name)
+		if err != nil {
+			return hosts, fmt.Errorf("error fetching servers %v", err)
+		}
+		for _, s := range servers {
+			if s.Name == membername {
+				hosts[host] = true
+			}
+		}
+	}
+	return hosts, nil
+}
+
+// Calls returns list of methodcalls, not in use in this provider
+func (h *ProviderHAProxy) Calls() []string {
+	return nil
+}
+
+// CleanCalls cleans calls, not in use in this provider
+func (h *ProviderHAProxy) CleanCalls() {
+}
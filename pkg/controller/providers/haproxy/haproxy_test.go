@@ -0,0 +1,361 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package haproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+	v1 "github.com/openshift/api/route/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeDataPlane is a minimal in-memory implementation of HAProxy Data Plane API configuration endpoints.
+// Each transaction has own copy of the configuration, which replaces the running configuration when the
+// transaction is committed.
+type fakeDataPlane struct {
+	*httptest.Server
+	lock         sync.Mutex
+	version      int64
+	running      *fakeConfig
+	transactions map[string]*fakeConfig
+	commits      int
+	started      int
+}
+
+type fakeConfig struct {
+	Backends map[string]map[string]interface{}
+	Servers  map[string]map[string]map[string]interface{}
+}
+
+// copy returns deep copy of the configuration
+func (c *fakeConfig) copy() *fakeConfig {
+	data, _ := json.Marshal(c)
+	copied := &fakeConfig{}
+	json.Unmarshal(data, copied)
+	return copied
+}
+
+func newFakeDataPlane() *fakeDataPlane {
+	fake := &fakeDataPlane{
+		version: 1,
+		running: &fakeConfig{
+			Backends: map[string]map[string]interface{}{},
+			Servers:  map[string]map[string]map[string]interface{}{},
+		},
+		transactions: map[string]*fakeConfig{},
+	}
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.handle))
+	return fake
+}
+
+// backend returns committed backend
+func (f *fakeDataPlane) backend(name string) map[string]interface{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.running.Backends[name]
+}
+
+// server returns committed server of the backend
+func (f *fakeDataPlane) server(backendname string, name string) map[string]interface{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.running.Servers[backendname][name]
+}
+
+func (f *fakeDataPlane) backendCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.running.Backends)
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]interface{}{"code": code, "message": message})
+}
+
+func (f *fakeDataPlane) handle(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if user, password, ok := r.BasicAuth(); !ok || user != "admin" || password != "secret" {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	query := r.URL.Query()
+	if strings.HasPrefix(r.URL.Path, transactionsPath) {
+		f.handleTransaction(w, r)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, configurationPath+"/")
+	if path == "version" {
+		writeJSON(w, http.StatusOK, f.version)
+		return
+	}
+	var body map[string]interface{}
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	cfg := f.running
+	if id := query.Get("transaction_id"); len(id) > 0 {
+		var ok bool
+		if cfg, ok = f.transactions[id]; !ok {
+			writeError(w, http.StatusNotFound, "transaction not found")
+			return
+		}
+	} else if r.Method != http.MethodGet {
+		if query.Get("version") != fmt.Sprintf("%d", f.version) {
+			writeError(w, http.StatusConflict, "version mismatch")
+			return
+		}
+		f.version++
+	}
+	parts := strings.Split(path, "/")
+	backendname := query.Get("backend")
+	switch {
+	case parts[0] == "backends" && len(parts) == 1 && r.Method == http.MethodGet:
+		data := []map[string]interface{}{}
+		for _, b := range cfg.Backends {
+			data = append(data, b)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": data})
+	case parts[0] == "backends" && len(parts) == 1 && r.Method == http.MethodPost:
+		name := body["name"].(string)
+		if _, ok := cfg.Backends[name]; ok {
+			writeError(w, http.StatusConflict, "backend exists")
+			return
+		}
+		cfg.Backends[name] = body
+		cfg.Servers[name] = map[string]map[string]interface{}{}
+		writeJSON(w, http.StatusAccepted, body)
+	case parts[0] == "backends" && len(parts) == 2:
+		if _, ok := cfg.Backends[parts[1]]; !ok {
+			writeError(w, http.StatusNotFound, "backend not found")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"data": cfg.Backends[parts[1]]})
+		case http.MethodPut:
+			cfg.Backends[parts[1]] = body
+			writeJSON(w, http.StatusAccepted, body)
+		case http.MethodDelete:
+			delete(cfg.Backends, parts[1])
+			delete(cfg.Servers, parts[1])
+			w.WriteHeader(http.StatusAccepted)
+		}
+	case parts[0] == "servers":
+		servers, ok := cfg.Servers[backendname]
+		if !ok {
+			writeError(w, http.StatusNotFound, "backend not found")
+			return
+		}
+		if len(parts) == 1 {
+			switch r.Method {
+			case http.MethodGet:
+				data := []map[string]interface{}{}
+				for _, s := range servers {
+					data = append(data, s)
+				}
+				writeJSON(w, http.StatusOK, map[string]interface{}{"data": data})
+			case http.MethodPost:
+				name := body["name"].(string)
+				if _, ok := servers[name]; ok {
+					writeError(w, http.StatusConflict, "server exists")
+					return
+				}
+				servers[name] = body
+				writeJSON(w, http.StatusAccepted, body)
+			}
+			return
+		}
+		if _, ok := servers[parts[1]]; !ok {
+			writeError(w, http.StatusNotFound, "server not found")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"data": servers[parts[1]]})
+		case http.MethodPut:
+			servers[parts[1]] = body
+			writeJSON(w, http.StatusAccepted, body)
+		case http.MethodDelete:
+			delete(servers, parts[1])
+			w.WriteHeader(http.StatusAccepted)
+		}
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (f *fakeDataPlane) handleTransaction(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		if r.URL.Query().Get("version") != fmt.Sprintf("%d", f.version) {
+			writeError(w, http.StatusConflict, "version mismatch")
+			return
+		}
+		f.started++
+		id := fmt.Sprintf("tx-%d", f.started)
+		f.transactions[id] = f.running.copy()
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"id": id, "_version": f.version, "status": "in_progress"})
+	case http.MethodPut:
+		id := strings.TrimPrefix(r.URL.Path, transactionsPath+"/")
+		cfg, ok := f.transactions[id]
+		if !ok {
+			writeError(w, http.StatusNotFound, "transaction not found")
+			return
+		}
+		f.running = cfg
+		delete(f.transactions, id)
+		f.version++
+		f.commits++
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "status": "success"})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func newTestProvider(fake *fakeDataPlane, clusteralias string) *ProviderHAProxy {
+	h := NewProviderHAProxy()
+	h.url = fake.URL
+	h.username = "admin"
+	h.password = "secret"
+	h.clusteralias = clusteralias
+	h.partition = "ext"
+	h.memberAddress = "10.0.0.1"
+	return h
+}
+
+// addHost runs the calls of the controller for a new host in one transaction
+func addHost(t *testing.T, h *ProviderHAProxy, host string, settings controller.MemberSettings) {
+	err := h.PreUpdate()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, port := range controller.Ports {
+		for _, err := range []error{
+			h.CreatePool(host, port),
+			h.AddPoolMember(h.clusteralias, host, port),
+			h.ModifyPool(host, port, "least-connections-member", 1, true, 10, "standby", settings),
+			h.CreateMonitor(host, port, "/health", "GET", 5, 16),
+			h.AddMonitorToPool(host, port),
+		} {
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+	}
+	err = h.PostUpdate()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestHAProxy(t *testing.T) {
+	fake := newFakeDataPlane()
+	defer fake.Close()
+	h := newTestProvider(fake, "dc1")
+
+	slowRamp := 10
+	addHost(t, h, "test", controller.MemberSettings{Ratio: 5, ConnectionLimit: 100, SlowRampTime: &slowRamp, Backup: true})
+	if fake.backendCount() != 2 || fake.commits != 1 {
+		t.Fatalf("excepted two backends in one commit, got %d backends in %d commits", fake.backendCount(), fake.commits)
+	}
+	server := fake.server("test_443", "dc1")
+	if server["address"] != "10.0.0.1" || server["port"] != float64(443) || server["ssl"] != "enabled" || server["check"] != "enabled" {
+		t.Errorf("unexpected server %v", server)
+	}
+	if server["backup"] != "enabled" || server["maintenance"] != "enabled" {
+		t.Errorf("excepted backup server in maintenance, got %v", server)
+	}
+	if server["weight"] != float64(5) || server["maxconn"] != float64(100) || server["slowstart"] != float64(10000) {
+		t.Errorf("excepted weight 5, maxconn 100 and slowstart 10000, got %v", server)
+	}
+	b := fake.backend("test_443")
+	if balance := b["balance"].(map[string]interface{}); balance["algorithm"] != "leastconn" {
+		t.Errorf("excepted leastconn, got %v", balance)
+	}
+	params := b["httpchk_params"].(map[string]interface{})
+	if b["adv_check"] != "httpchk" || params["uri"] != "/health" || params["version"] != `HTTP/1.1\r\nHost:\ test` ||
+		b["check_timeout"] != float64(16000) || b["default_server"].(map[string]interface{})["inter"] != float64(5000) || b["mode"] != "http" {
+		t.Errorf("unexpected health check %v", b)
+	}
+	if server := fake.server("test_80", "dc1"); server["port"] != float64(80) || server["backup"] != "enabled" {
+		t.Errorf("unexpected server %v", server)
+	}
+
+	// same calls again do not fail and nothing changes
+	addHost(t, h, "test", controller.MemberSettings{Ratio: 5, ConnectionLimit: 100, SlowRampTime: &slowRamp, Backup: true})
+	if fake.backendCount() != 2 || fake.commits != 2 {
+		t.Errorf("excepted two backends, got %d", fake.backendCount())
+	}
+
+	routes := []v1.Route{{ObjectMeta: metav1.ObjectMeta{Name: "other"}, Spec: v1.RouteSpec{Host: "other.example.com"}}}
+	hosts, err := h.CheckPools(routes, ".example.com", "dc1")
+	if err != nil || !hosts["test"] || len(hosts) != 1 {
+		t.Errorf("excepted host test to be removed, got %v %v", hosts, err)
+	}
+	// lbenabled annotation of other partition does not keep the host
+	route := v1.Route{ObjectMeta: metav1.ObjectMeta{Name: "test", Annotations: map[string]string{controller.CustomHostAnnotation: "other"}}, Spec: v1.RouteSpec{Host: "test"}}
+	hosts, err = h.CheckPools(append(routes, route), ".example.com", "dc1")
+	if err != nil || !hosts["test"] {
+		t.Errorf("excepted host test of other partition to be removed, got %v %v", hosts, err)
+	}
+	route.Annotations[controller.CustomHostAnnotation] = "ext"
+	hosts, err = h.CheckPools(append(routes, route), ".example.com", "dc1")
+	if err != nil || len(hosts) != 0 {
+		t.Errorf("excepted host test to be kept, got %v %v", hosts, err)
+	}
+
+	// removal of the host in one transaction
+	err = h.PreUpdate()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = h.CheckAndClean("test", "443")
+	if err != nil {
+		t.Errorf("backend with servers should be kept, got %v", err)
+	}
+	for _, port := range controller.Ports {
+		if err := h.DeletePoolMember("dc1", "test", port); err != nil {
+			t.Errorf("%v", err)
+		}
+		if err := h.DeletePoolMember("dc1", "test", port); err != nil {
+			t.Errorf("deleting missing server should succeed, got %v", err)
+		}
+		if err := h.CheckAndClean("test", port); err != nil {
+			t.Errorf("%v", err)
+		}
+	}
+	if fake.backendCount() != 2 {
+		t.Errorf("changes should not be applied before commit, got %d backends", fake.backendCount())
+	}
+	err = h.PostUpdate()
+	if err != nil || fake.backendCount() != 0 || fake.commits != 3 {
+		t.Errorf("excepted backends to be deleted in one commit, got %d backends %v", fake.backendCount(), err)
+	}
+
+	// without transaction changes are applied with version
+	err = h.CreatePool("other", "80")
+	if err != nil || fake.backend("other_80") == nil {
+		t.Errorf("excepted backend without transaction, got %v", err)
+	}
+}
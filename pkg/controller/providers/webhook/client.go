@@ -0,0 +1,203 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+)
+
+const (
+	defaultTimeout = 30 * time.Second
+	// signatureHeader contains hex encoded HMAC-SHA256 of timestamp, dot and body
+	signatureHeader = "X-Webhook-Signature"
+	timestampHeader = "X-Webhook-Timestamp"
+	eventHeader     = "X-Webhook-Event"
+)
+
+// Event is the body of webhook request
+type Event struct {
+	// ID is unique id of the event, retries of the event have same id
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	Timestamp time.Time   `json:"timestamp"`
+	Params    interface{} `json:"params,omitempty"`
+}
+
+// Result is the body of webhook response, empty body means success
+type Result struct {
+	// Error fails the call even if status code is 2xx
+	Error string `json:"error,omitempty"`
+	// Hosts is the result of CheckPools and ListHosts
+	Hosts []string `json:"hosts,omitempty"`
+}
+
+// StatusError is returned when webhook responds with error
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("webhook responded %d: %s", e.Code, e.Message)
+}
+
+// retryable returns true for responses which may succeed when retried
+func (e *StatusError) retryable() bool {
+	return e.Code >= 500 || e.Code == http.StatusRequestTimeout || e.Code == http.StatusTooManyRequests
+}
+
+// retryable returns true for network errors and responses which may succeed when retried
+func retryable(err error) bool {
+	var status *StatusError
+	if errors.As(err, &status) {
+		return status.retryable()
+	}
+	return true
+}
+
+// client posts events to webhook
+type client struct {
+	url    string
+	secret []byte
+	http   *http.Client
+}
+
+func newClient() *client {
+	return &client{
+		http: &http.Client{Timeout: defaultTimeout},
+	}
+}
+
+// readConfig reads client settings from environment variables
+func (c *client) readConfig() error {
+	c.url = os.Getenv("WEBHOOK_URL")
+	if len(c.url) == 0 {
+		return errors.New("WEBHOOK_URL environment variable needed")
+	}
+	secret := os.Getenv("WEBHOOK_SECRET")
+	if file := os.Getenv("WEBHOOK_SECRET_FILE"); len(file) > 0 {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("error reading WEBHOOK_SECRET_FILE %v", err)
+		}
+		secret = strings.TrimSpace(string(data))
+	}
+	if len(secret) == 0 {
+		log.Printf("WEBHOOK_SECRET is not set, webhook requests are not signed")
+	}
+	c.secret = []byte(secret)
+	if value := os.Getenv("WEBHOOK_TIMEOUT"); len(value) > 0 {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid WEBHOOK_TIMEOUT %q: %v", value, err)
+		}
+		c.http.Timeout = timeout
+	}
+	return nil
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("error generating event id %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sign returns signature of the request
+func sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post sends event to webhook. Network errors, 5xx, 408 and 429 responses are retried by the controller
+// with same event id, other errors are permanent and not retried.
+func (c *client) post(ctx context.Context, event string, params interface{}) (*Result, error) {
+	id := controller.OperationID(ctx)
+	if len(id) == 0 {
+		var err error
+		id, err = newID()
+		if err != nil {
+			return nil, err
+		}
+	}
+	result, err := c.send(ctx, id, event, params)
+	if err != nil && !retryable(err) {
+		return nil, controller.Permanent(err)
+	}
+	return result, err
+}
+
+// send sends single request
+func (c *client) send(ctx context.Context, id string, event string, params interface{}) (*Result, error) {
+	body, err := json.Marshal(&Event{
+		ID:        id,
+		Event:     event,
+		Timestamp: time.Now().UTC(),
+		Params:    params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(eventHeader, event)
+	req.Header.Set(timestampHeader, timestamp)
+	if len(c.secret) > 0 {
+		req.Header.Set(signatureHeader, sign(c.secret, timestamp, body))
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{}
+	if len(bytes.TrimSpace(data)) > 0 && json.Unmarshal(data, result) != nil && resp.StatusCode < 300 {
+		return nil, fmt.Errorf("invalid webhook response %s", data)
+	}
+	if resp.StatusCode >= 300 {
+		message := result.Error
+		if len(message) == 0 {
+			message = strings.TrimSpace(string(data))
+		}
+		return nil, &StatusError{Code: resp.StatusCode, Message: message}
+	}
+	if len(result.Error) > 0 {
+		return nil, &StatusError{Code: resp.StatusCode, Message: result.Error}
+	}
+	return result, nil
+}
@@ -0,0 +1,234 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package webhook
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/common"
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller/providers/external"
+	v1 "github.com/openshift/api/route/v1"
+)
+
+const (
+	providerName      = "webhook"
+	stateProviderName = "webhook-state"
+)
+
+func init() {
+	controller.RegisterContextProvider(providerName, NewProviderWebhook())
+	controller.RegisterDeclarativeProvider(stateProviderName, NewStateWebhook())
+}
+
+// ProviderWebhook is an implementation of ContextProviderInterface which posts each call to a webhook.
+// Params of the events are same as in external provider protocol.
+type ProviderWebhook struct {
+	client   *client
+	reporter common.ErrorReporter
+}
+
+// NewProviderWebhook returns new webhook provider
+func NewProviderWebhook() *ProviderWebhook {
+	return &ProviderWebhook{
+		client:   newClient(),
+		reporter: common.NewLogReporter(),
+	}
+}
+
+func initialize(c *client, reporter common.ErrorReporter) {
+	err := c.readConfig()
+	if err != nil {
+		reporter.CaptureErrorAndWait(err, nil)
+		panic(err)
+	}
+}
+
+// Initialize initilizes new provider
+func (w *ProviderWebhook) Initialize() {
+	initialize(w.client, w.reporter)
+}
+
+// SetReporter sets error reporter
+func (w *ProviderWebhook) SetReporter(reporter common.ErrorReporter) {
+	w.reporter = reporter
+}
+
+func (w *ProviderWebhook) post(ctx context.Context, event string, params interface{}) error {
+	_, err := w.client.post(ctx, event, params)
+	return err
+}
+
+// ignoreNotFound returns nil if webhook responded 404, used when removing something
+func ignoreNotFound(err error) error {
+	var status *StatusError
+	if errors.As(err, &status) && status.Code == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// CreatePool creates new loadbalancer pool
+func (w *ProviderWebhook) CreatePool(ctx context.Context, name string, port string) error {
+	return w.post(ctx, "CreatePool", &external.PoolParams{Name: name, Port: port})
+}
+
+// AddPoolMember adds new member to pool
+func (w *ProviderWebhook) AddPoolMember(ctx context.Context, membername string, name string, port string) error {
+	return w.post(ctx, "AddPoolMember", &external.MemberParams{MemberName: membername, Name: name, Port: port})
+}
+
+// ModifyPool modifies loadbalancer pool
+func (w *ProviderWebhook) ModifyPool(ctx context.Context, name string, port string, loadBalancingMethod string, pga int, maintenance bool, prio int, role string, settings controller.MemberSettings) error {
+	return w.post(ctx, "ModifyPool", &external.ModifyPoolParams{
+		Name:                name,
+		Port:                port,
+		LoadBalancingMethod: loadBalancingMethod,
+		PGA:                 pga,
+		Maintenance:         maintenance,
+		Prio:                prio,
+		Role:                role,
+		MemberSettings:      settings,
+	})
+}
+
+// CreateMonitor creates new monitor
+func (w *ProviderWebhook) CreateMonitor(ctx context.Context, host string, port string, uri string, httpMethod string, interval int, timeout int) error {
+	return w.post(ctx, "CreateMonitor", &external.MonitorParams{Host: host, Port: port, URI: uri, HTTPMethod: httpMethod, Interval: interval, Timeout: timeout})
+}
+
+// ModifyMonitor modifies monitor
+func (w *ProviderWebhook) ModifyMonitor(ctx context.Context, host string, port string, uri string, httpMethod string, interval int, timeout int) error {
+	return w.post(ctx, "ModifyMonitor", &external.MonitorParams{Host: host, Port: port, URI: uri, HTTPMethod: httpMethod, Interval: interval, Timeout: timeout})
+}
+
+// AddMonitorToPool adds monitor to pool
+func (w *ProviderWebhook) AddMonitorToPool(ctx context.Context, name string, port string) error {
+	return w.post(ctx, "AddMonitorToPool", &external.PoolParams{Name: name, Port: port})
+}
+
+// DeletePoolMember deletes pool member, 404 response means that member does not exist
+func (w *ProviderWebhook) DeletePoolMember(ctx context.Context, membername string, name string, port string) error {
+	return ignoreNotFound(w.post(ctx, "DeletePoolMember", &external.MemberParams{MemberName: membername, Name: name, Port: port}))
+}
+
+// CheckAndClean deletes pool if it does not have members, 404 response means that pool does not exist
+func (w *ProviderWebhook) CheckAndClean(ctx context.Context, name string, port string) error {
+	return ignoreNotFound(w.post(ctx, "CheckAndClean", &external.PoolParams{Name: name, Port: port}))
+}
+
+// PreUpdate is executed before updating anything
+func (w *ProviderWebhook) PreUpdate(ctx context.Context) error {
+	return w.post(ctx, "PreUpdate", nil)
+}
+
+// PostUpdate is executed after updating
+func (w *ProviderWebhook) PostUpdate(ctx context.Context) error {
+	return w.post(ctx, "PostUpdate", nil)
+}
+
+// CheckPools returns hosts which should be removed
+func (w *ProviderWebhook) CheckPools(ctx context.Context, routes []v1.Route, hosttowatch string, membername string) (map[string]bool, error) {
+	hosts := map[string]bool{}
+	result, err := w.client.post(ctx, "CheckPools", external.NewCheckPoolsParams(routes, hosttowatch, membername))
+	if err != nil {
+		return hosts, err
+	}
+	for _, host := range result.Hosts {
+		hosts[host] = true
+	}
+	return hosts, nil
+}
+
+// Calls returns list of methodcalls, not in use in this provider
+func (w *ProviderWebhook) Calls() []string {
+	return nil
+}
+
+// CleanCalls cleans calls, not in use in this provider
+func (w *ProviderWebhook) CleanCalls() {
+}
+
+// StateWebhook is an implementation of DeclarativeProviderInterface which posts desired state of a
+// host to a webhook
+type StateWebhook struct {
+	client   *client
+	reporter common.ErrorReporter
+}
+
+// RemoveParams are params of Remove event
+type RemoveParams struct {
+	Host       string `json:"host"`
+	MemberName string `json:"membername"`
+}
+
+// ListHostsParams are params of ListHosts event
+type ListHostsParams struct {
+	MemberName string `json:"membername"`
+}
+
+// NewStateWebhook returns new declarative webhook provider
+func NewStateWebhook() *StateWebhook {
+	return &StateWebhook{
+		client:   newClient(),
+		reporter: common.NewLogReporter(),
+	}
+}
+
+// Initialize initilizes new provider
+func (w *StateWebhook) Initialize() {
+	initialize(w.client, w.reporter)
+}
+
+// SetReporter sets error reporter
+func (w *StateWebhook) SetReporter(reporter common.ErrorReporter) {
+	w.reporter = reporter
+}
+
+// Apply posts desired state of the host
+func (w *StateWebhook) Apply(ctx context.Context, state controller.HostState) error {
+	_, err := w.client.post(ctx, "Apply", state)
+	return err
+}
+
+// Remove posts removal of member from the host, 404 response means that the host does not exist
+func (w *StateWebhook) Remove(ctx context.Context, host string, membername string) error {
+	_, err := w.client.post(ctx, "Remove", &RemoveParams{Host: host, MemberName: membername})
+	return ignoreNotFound(err)
+}
+
+// ListHosts returns hosts which have membername as member
+func (w *StateWebhook) ListHosts(ctx context.Context, membername string) ([]string, error) {
+	result, err := w.client.post(ctx, "ListHosts", &ListHostsParams{MemberName: membername})
+	if err != nil {
+		return nil, err
+	}
+	return result.Hosts, nil
+}
+
+// PreUpdate is executed before updating anything
+func (w *StateWebhook) PreUpdate(ctx context.Context) error {
+	_, err := w.client.post(ctx, "PreUpdate", nil)
+	return err
+}
+
+// PostUpdate is executed after updating
+func (w *StateWebhook) PostUpdate(ctx context.Context) error {
+	_, err := w.client.post(ctx, "PostUpdate", nil)
+	return err
+}
+
+// Calls returns list of methodcalls, not in use in this provider
+func (w *StateWebhook) Calls() []string {
+	return nil
+}
+
+// CleanCalls cleans calls, not in use in this provider
+func (w *StateWebhook) CleanCalls() {
+}
@@ -0,0 +1,185 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/ElisaOyj/openshift-lb-controller/pkg/controller"
+	v1 "github.com/openshift/api/route/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeWebhook struct {
+	*httptest.Server
+	lock   sync.Mutex
+	events []map[string]interface{}
+	// responses are returned in order, after that 200 with empty body
+	responses []func(w http.ResponseWriter)
+}
+
+func newFakeWebhook(t *testing.T) *fakeWebhook {
+	fake := &fakeWebhook{}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.lock.Lock()
+		defer fake.lock.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(signatureHeader) != sign([]byte("secret"), r.Header.Get(timestampHeader), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		event := map[string]interface{}{}
+		if err := json.Unmarshal(body, &event); err != nil || event["event"] != r.Header.Get(eventHeader) {
+			t.Errorf("invalid event %s %v", body, err)
+		}
+		fake.events = append(fake.events, event)
+		if len(fake.responses) > 0 {
+			fake.responses[0](w)
+			fake.responses = fake.responses[1:]
+		}
+	}))
+	return fake
+}
+
+func (f *fakeWebhook) respond(code int, body string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.responses = append(f.responses, func(w http.ResponseWriter) {
+		w.WriteHeader(code)
+		w.Write([]byte(body))
+	})
+}
+
+func newTestClient(fake *fakeWebhook) *client {
+	c := newClient()
+	c.url = fake.URL
+	c.secret = []byte("secret")
+	return c
+}
+
+func TestWebhook(t *testing.T) {
+	fake := newFakeWebhook(t)
+	defer fake.Close()
+	w := NewProviderWebhook()
+	w.client = newTestClient(fake)
+	ctx := context.Background()
+
+	err := w.ModifyPool(ctx, "test", "80", "round-robin", 1, true, 10, "active", controller.MemberSettings{Ratio: 2})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	params := fake.events[0]["params"].(map[string]interface{})
+	if fake.events[0]["event"] != "ModifyPool" || params["name"] != "test" || params["maintenance"] != true || params["role"] != "active" ||
+		params["ratio"] != float64(2) || params["connectionLimit"] != nil {
+		t.Errorf("unexpected event %v", fake.events[0])
+	}
+
+	// temporary errors are retried by the controller with same event id
+	var status *StatusError
+	fake.respond(http.StatusServiceUnavailable, `{"error":"busy"}`)
+	fake.respond(http.StatusTooManyRequests, "")
+	operationCtx := controller.WithOperationID(ctx, "operation1")
+	for _, code := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		err = w.CreatePool(operationCtx, "test", "80")
+		if !errors.As(err, &status) || status.Code != code || controller.IsPermanent(err) {
+			t.Errorf("excepted temporary error %d, got %v", code, err)
+		}
+	}
+	err = w.CreatePool(operationCtx, "test", "80")
+	if err != nil || len(fake.events) != 4 || fake.events[1]["id"] != "operation1" || fake.events[3]["id"] != "operation1" {
+		t.Errorf("excepted retries with same id, got %v %v", err, fake.events)
+	}
+
+	// client errors are permanent
+	fake.respond(http.StatusBadRequest, `{"error":"invalid pool name"}`)
+	err = w.CreatePool(ctx, "test", "80")
+	if !errors.As(err, &status) || status.Code != http.StatusBadRequest || status.Message != "invalid pool name" || !controller.IsPermanent(err) {
+		t.Errorf("excepted permanent bad request, got %v", err)
+	}
+	fake.respond(http.StatusServiceUnavailable, "")
+	err = w.CreatePool(ctx, "test", "80")
+	if err == nil || controller.IsPermanent(err) || fake.events[4]["id"] == fake.events[5]["id"] {
+		t.Errorf("excepted temporary error with new id, got %v", err)
+	}
+
+	// error in successful response fails the call
+	fake.respond(http.StatusOK, `{"error":"pool limit reached"}`)
+	err = w.CreatePool(ctx, "test", "443")
+	if err == nil || !controller.IsPermanent(err) || len(fake.events) != 7 {
+		t.Errorf("excepted permanent error, got %v", err)
+	}
+
+	fake.respond(http.StatusNotFound, "")
+	err = w.DeletePoolMember(ctx, "dc1", "test", "80")
+	if err != nil {
+		t.Errorf("missing member should not be an error, got %v", err)
+	}
+
+	fake.respond(http.StatusOK, `{"hosts":["old"]}`)
+	routes := []v1.Route{{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Annotations: map[string]string{controller.CustomHostAnnotation: "ext"}},
+		Spec:       v1.RouteSpec{Host: "app.fooext.fi", TLS: &v1.TLSConfig{Key: "secret key"}},
+	}}
+	hosts, err := w.CheckPools(ctx, routes, ".example.com", "dc1")
+	if err != nil || !hosts["old"] || len(hosts) != 1 {
+		t.Errorf("excepted host old, got %v %v", hosts, err)
+	}
+	route := fake.events[len(fake.events)-1]["params"].(map[string]interface{})["routes"].([]interface{})[0].(map[string]interface{})
+	if spec := route["spec"].(map[string]interface{}); spec["host"] != "app.fooext.fi" || spec["tls"] != nil {
+		t.Errorf("excepted route without tls, got %v", route)
+	}
+
+	w.client.secret = []byte("wrong")
+	err = w.PostUpdate(ctx)
+	if !errors.As(err, &status) || status.Code != http.StatusUnauthorized {
+		t.Errorf("excepted unauthorized, got %v", err)
+	}
+}
+
+func TestStateWebhook(t *testing.T) {
+	fake := newFakeWebhook(t)
+	defer fake.Close()
+	w := NewStateWebhook()
+	w.client = newTestClient(fake)
+	ctx := context.Background()
+
+	state := controller.HostState{
+		Host:    "test",
+		Member:  "dc1",
+		Ports:   controller.Ports,
+		Role:    "standby",
+		Monitor: controller.MonitorState{Path: "/health", Method: "GET", Interval: 3, Timeout: 10},
+	}
+	err := w.Apply(ctx, state)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	params := fake.events[0]["params"].(map[string]interface{})
+	monitor := params["monitor"].(map[string]interface{})
+	if fake.events[0]["event"] != "Apply" || params["host"] != "test" || params["role"] != "standby" || monitor["path"] != "/health" {
+		t.Errorf("unexpected event %v", fake.events[0])
+	}
+
+	fake.respond(http.StatusOK, `{"hosts":["test","other"]}`)
+	hosts, err := w.ListHosts(ctx, "dc1")
+	if err != nil || len(hosts) != 2 {
+		t.Errorf("excepted two hosts, got %v %v", hosts, err)
+	}
+
+	fake.respond(http.StatusNotFound, "")
+	err = w.Remove(ctx, "test", "dc1")
+	if err != nil {
+		t.Errorf("missing host should not be an error, got %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Role contains pool settings of the clusters which have the role annotation
+type Role struct {
+	// Prio is the priority group of the pool member, greater priority is used first
+	Prio int `json:"prio"`
+	// PGA is the priority group activation of the pool
+	PGA int `json:"pga"`
+	// SlowRampTime is the slow ramp time of the pool in seconds
+	SlowRampTime int `json:"slowRampTime"`
+	// Persist false disables persistence to the members of the role, so that clients move back to
+	// members with greater priority when they are up again
+	Persist bool `json:"persist"`
+}
+
+// Roles contains roles by lowercase name
+type Roles map[string]Role
+
+// DefaultRoles returns active and standby roles
+func DefaultRoles() Roles {
+	return Roles{
+		"active":  {Prio: 20, PGA: 1, SlowRampTime: 0, Persist: true},
+		"standby": {Prio: 15, PGA: 1, SlowRampTime: 0, Persist: false},
+	}
+}
+
+// ParseRoles parses json object of roles by name and adds them to default roles, for instance
+// {"primary":{"prio":30},"disaster":{"prio":5,"persist":false}}. Omitted pga is 1, slowRampTime 0 and persist true.
+func ParseRoles(value string) (Roles, error) {
+	roles := DefaultRoles()
+	if len(strings.TrimSpace(value)) == 0 {
+		return roles, nil
+	}
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return nil, fmt.Errorf("invalid ROLES: %v", err)
+	}
+	for name, data := range raw {
+		role := Role{PGA: 1, Persist: true}
+		if err := json.Unmarshal(data, &role); err != nil {
+			return nil, fmt.Errorf("invalid role %q: %v", name, err)
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if len(name) == 0 || role.Prio < 0 || role.PGA < 0 || role.SlowRampTime < 0 {
+			return nil, fmt.Errorf("invalid role %q, expected name and non-negative prio, pga and slowRampTime", name)
+		}
+		roles[name] = role
+	}
+	return roles, nil
+}
+
+// Get returns role by name, false if the role is not defined
+func (r Roles) Get(name string) (Role, bool) {
+	role, ok := r[strings.ToLower(name)]
+	return role, ok
+}
+
+// Backup returns true if members of the role are used only when members with greatest role priority are down
+func (r Roles) Backup(role Role) bool {
+	for _, other := range r {
+		if other.Prio > role.Prio {
+			return true
+		}
+	}
+	return false
+}
+
+// NonPersistentPrios returns priorities of the roles without persistence in descending order
+func (r Roles) NonPersistentPrios() []int {
+	found := map[int]bool{}
+	prios := []int{}
+	for _, role := range r {
+		if !role.Persist && !found[role.Prio] {
+			found[role.Prio] = true
+			prios = append(prios, role.Prio)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(prios)))
+	return prios
+}
+
+// roles returns configured roles, default roles if ROLES is not set
+func (c *RouteController) roles() Roles {
+	if c.routeRoles == nil {
+		return DefaultRoles()
+	}
+	return c.routeRoles
+}
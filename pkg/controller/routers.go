@@ -0,0 +1,148 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/tools/cache"
+)
+
+// MemberHandler can be implemented by providers to manage the lb object which pool members of this
+// cluster refer to, for instance the node named after CLUSTERALIAS
+type MemberHandler interface {
+	// points membername to one of the router addresses, must be idempotent
+	SetMemberAddresses(ctx context.Context, membername string, addresses []string) error
+}
+
+// memberHandler returns MemberHandler of the provider, nil if the provider does not manage members
+func memberHandler(provider interface{}) MemberHandler {
+	handler, _ := unwrap(provider).(MemberHandler)
+	return handler
+}
+
+// routers contains router addresses which are set to the lb
+type routers struct {
+	lock      sync.Mutex
+	addresses string
+}
+
+// changed stores addresses, returns true if they are not same as before
+func (r *routers) changed(addresses []string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	joined := strings.Join(addresses, ",")
+	if r.addresses == joined {
+		return false
+	}
+	r.addresses = joined
+	return true
+}
+
+func (r *routers) forget() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.addresses = ""
+}
+
+// parseRouterAddresses parses comma separated list of router ip addresses
+func parseRouterAddresses(value string) ([]string, error) {
+	addresses := []string{}
+	for _, address := range strings.Split(value, ",") {
+		address = strings.TrimSpace(address)
+		if net.ParseIP(address) == nil {
+			return nil, fmt.Errorf("invalid ROUTER_ADDRESSES %q, expected comma separated ip addresses", value)
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// endpointAddresses returns ready addresses of the endpoints in sorted order
+func endpointAddresses(endpoints *v1.Endpoints) []string {
+	found := map[string]bool{}
+	addresses := []string{}
+	for _, subset := range endpoints.Subsets {
+		for _, address := range subset.Addresses {
+			if !found[address.IP] {
+				found[address.IP] = true
+				addresses = append(addresses, address.IP)
+			}
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// memberHandler returns MemberHandler of the current provider
+func (c *RouteController) memberHandler() MemberHandler {
+	if c.declarative != nil {
+		return memberHandler(c.declarative)
+	}
+	return memberHandler(c.provider)
+}
+
+// newRouterInformer returns informer which watches endpoints of the router service namespace/name
+func (c *RouteController) newRouterInformer(service string) (cache.SharedIndexInformer, error) {
+	s := strings.Split(service, "/")
+	if len(s) != 2 || len(s[0]) == 0 || len(s[1]) == 0 {
+		return nil, fmt.Errorf("invalid ROUTER_SERVICE %q, expected namespace/name", service)
+	}
+	informer := cache.NewSharedIndexInformer(
+		cache.NewListWatchFromClient(c.kclient.CoreV1().RESTClient(), "endpoints", s[0], fields.OneTermEqualSelector("metadata.name", s[1])),
+		&v1.Endpoints{},
+		3*time.Minute,
+		cache.Indexers{},
+	)
+	update := func(obj interface{}) {
+		if endpoints, ok := obj.(*v1.Endpoints); ok {
+			c.setRouterAddresses(endpointAddresses(endpoints))
+		}
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: update,
+		UpdateFunc: func(old interface{}, obj interface{}) {
+			update(obj)
+		},
+	})
+	return informer, nil
+}
+
+// setRouterAddresses points the member of this cluster to the router addresses if they have changed
+func (c *RouteController) setRouterAddresses(addresses []string) {
+	handler := c.memberHandler()
+	if handler == nil {
+		return
+	}
+	if len(addresses) == 0 {
+		log.Printf("no ready router addresses, member %s is not changed", c.clusteralias)
+		return
+	}
+	if !c.routers.changed(addresses) {
+		return
+	}
+	c.enqueue(c.clusteralias, func() {
+		err := c.call("SetMemberAddresses", c.clusteralias, func(ctx context.Context) error {
+			return handler.SetMemberAddresses(ctx, c.clusteralias, addresses)
+		})
+		if err != nil {
+			// set again when the addresses are updated next time
+			c.routers.forget()
+			return
+		}
+		log.Printf("set router addresses of member %s: %s", c.clusteralias, strings.Join(addresses, ","))
+	})
+}
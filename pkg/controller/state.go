@@ -0,0 +1,128 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package controller
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"strings"
+
+	v1r "github.com/openshift/api/route/v1"
+)
+
+// Ports contains ports which are balanced for each host, each port has own pool
+var Ports = []string{"80", "443"}
+
+// MonitorState is the desired health monitor of a host
+type MonitorState struct {
+	Path     string `json:"path"`
+	Method   string `json:"method"`
+	Interval int    `json:"interval"`
+	Timeout  int    `json:"timeout"`
+}
+
+// HostState is the complete desired lb configuration of a host in this cluster
+type HostState struct {
+	// Host is the route hostname
+	Host string `json:"host"`
+	// Member is the name of this cluster in lb, CLUSTERALIAS
+	Member string `json:"member"`
+	// Ports which are balanced
+	Ports               []string     `json:"ports"`
+	LoadBalancingMethod string       `json:"loadBalancingMethod"`
+	PGA                 int          `json:"pga"`
+	Maintenance         bool         `json:"maintenance"`
+	Prio                int          `json:"prio"`
+	Role                string       `json:"role"`
+	Monitor             MonitorState `json:"monitor"`
+	MemberSettings
+}
+
+// Equal returns true if states are identical
+func (s HostState) Equal(other HostState) bool {
+	return reflect.DeepEqual(s, other)
+}
+
+func (c *RouteController) newHostState(host string, uri string, httpMethod string, loadBalancingMethod string, pga int, maintenance bool, prio int, role string, settings MemberSettings) HostState {
+	return HostState{
+		Host:                host,
+		Member:              c.clusteralias,
+		Ports:               Ports,
+		LoadBalancingMethod: loadBalancingMethod,
+		PGA:                 pga,
+		Maintenance:         maintenance,
+		Prio:                prio,
+		Role:                role,
+		Monitor: MonitorState{
+			Path:     uri,
+			Method:   httpMethod,
+			Interval: 3,
+			Timeout:  10,
+		},
+		MemberSettings: settings,
+	}
+}
+
+// isManaged returns true if route should be in lb
+func (c *RouteController) isManaged(route *v1r.Route) bool {
+	return ManagedRoute(route, c.hosttowatch, c.partition)
+}
+
+// ManagedRoute returns true if host of the route has suffix hosttowatch or lbenabled annotation of the route is partition
+func ManagedRoute(route *v1r.Route, hosttowatch string, partition string) bool {
+	if strings.HasSuffix(route.Spec.Host, hosttowatch) {
+		return true
+	}
+	val, ok := route.Annotations[CustomHostAnnotation]
+	return ok && val == partition
+}
+
+func (c *RouteController) applyHost(state HostState) {
+	c.enqueue(state.Host, func() {
+		err := c.call("Apply", state.Host, func(ctx context.Context) error {
+			return c.declarative.Apply(ctx, state)
+		})
+		if err == nil {
+			log.Printf("apply external lb configuration host: %s to clusteralias: %s", state.Host, c.clusteralias)
+		}
+	})
+}
+
+func (c *RouteController) removeHost(host string) {
+	c.enqueue(host, func() {
+		err := c.call("Remove", host, func(ctx context.Context) error {
+			return c.declarative.Remove(ctx, host, c.clusteralias)
+		})
+		if err == nil {
+			log.Printf("delete external lb configuration host: %s from clusteralias: %s", host, c.clusteralias)
+		}
+	})
+}
+
+// declarativeHostsToBeRemoved returns hosts which are in lb but do not have route anymore
+func (c *RouteController) declarativeHostsToBeRemoved(routes []v1r.Route) (map[string]bool, error) {
+	ctx, cancel := c.operationContext("ListHosts")
+	defer cancel()
+	hosts, err := c.declarative.ListHosts(ctx, c.clusteralias)
+	if err != nil {
+		return nil, err
+	}
+	managed := map[string]bool{}
+	for i := range routes {
+		if c.isManaged(&routes[i]) {
+			managed[routes[i].Spec.Host] = true
+		}
+	}
+	remove := map[string]bool{}
+	for _, host := range hosts {
+		if !managed[host] {
+			remove[host] = true
+		}
+	}
+	return remove, nil
+}
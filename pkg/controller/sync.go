@@ -0,0 +1,62 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package controller
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+// SyncHandler can be implemented by providers which keep the configuration in memory, so that they
+// do not publish partial configuration before the routes which existed at startup are processed
+type SyncHandler interface {
+	// called once after the changes of the routes which existed at startup have been executed
+	Synced(ctx context.Context) error
+}
+
+// syncHandler returns SyncHandler of the provider, nil if the provider does not need it
+func syncHandler(provider interface{}) SyncHandler {
+	handler, _ := unwrap(provider).(SyncHandler)
+	return handler
+}
+
+// syncHandler returns SyncHandler of the current provider
+func (c *RouteController) syncHandler() SyncHandler {
+	if c.declarative != nil {
+		return syncHandler(c.declarative)
+	}
+	return syncHandler(c.provider)
+}
+
+// notifySynced waits until the initial routes have been delivered to the event handlers and queues
+// Synced after their changes
+func (c *RouteController) notifySynced(stopCh <-chan struct{}, handler SyncHandler) {
+	if !cache.WaitForCacheSync(stopCh, c.routeInformer.HasSynced) {
+		return
+	}
+	// the informer has synced when the routes are in the store, the handlers are called after that
+	initial := int64(len(c.routeInformer.GetStore().ListKeys()))
+	for atomic.LoadInt64(&c.routesAdded) < initial {
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	c.enqueueBarrier("initial sync", func() {
+		err := c.call("Synced", "initial sync", func(ctx context.Context) error {
+			return handler.Synced(ctx)
+		})
+		if err == nil {
+			log.Printf("initial %d routes synced", initial)
+		}
+	})
+}
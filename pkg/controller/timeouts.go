@@ -0,0 +1,78 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const defaultProviderTimeout = 60 * time.Second
+
+// Timeouts contains timeouts for provider operations
+type Timeouts struct {
+	// Default is used for operations which do not have own timeout, zero means no timeout
+	Default time.Duration
+	// Operations contains timeouts by provider method name, for instance PostUpdate
+	Operations map[string]time.Duration
+}
+
+// Get returns timeout for operation
+func (t Timeouts) Get(operation string) time.Duration {
+	if timeout, ok := t.Operations[operation]; ok {
+		return timeout
+	}
+	return t.Default
+}
+
+// ParseTimeouts parses default timeout and comma separated list of operation=duration overrides
+// for instance "PostUpdate=2m,CreatePool=10s"
+func ParseTimeouts(defaultTimeout string, operations string) (Timeouts, error) {
+	timeouts := Timeouts{
+		Default:    defaultProviderTimeout,
+		Operations: map[string]time.Duration{},
+	}
+	if len(defaultTimeout) > 0 {
+		timeout, err := time.ParseDuration(defaultTimeout)
+		if err != nil {
+			return timeouts, fmt.Errorf("invalid provider timeout %q: %v", defaultTimeout, err)
+		}
+		timeouts.Default = timeout
+	}
+	for _, item := range strings.Split(operations, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		s := strings.SplitN(item, "=", 2)
+		if len(s) != 2 {
+			return timeouts, fmt.Errorf("invalid operation timeout %q, expected operation=duration", item)
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(s[1]))
+		if err != nil {
+			return timeouts, fmt.Errorf("invalid operation timeout %q: %v", item, err)
+		}
+		timeouts.Operations[strings.TrimSpace(s[0])] = timeout
+	}
+	return timeouts, nil
+}
+
+// operationContext returns context for provider operation, it is cancelled after operation timeout
+// or when the controller is stopped
+func (c *RouteController) operationContext(operation string) (context.Context, context.CancelFunc) {
+	parent := c.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	timeout := c.timeouts.Get(operation)
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
@@ -0,0 +1,260 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dnsupdate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultTTL           = 300
+	defaultTsigAlgorithm = dns.HmacSHA256
+	// ownerPrefix is prefix of the TXT record which tells which clusters use the host
+	ownerPrefix = "_lbcontroller."
+	ownerValue  = "openshift-lb-controller cluster="
+	fudge       = 300
+)
+
+// Updater manages dns records of hosts using RFC 2136 dynamic updates. Each cluster adds its own
+// owner TXT record for the host and the address records are removed when the last owner is removed.
+type Updater struct {
+	server string
+	zones  []string
+	// target contains A/AAAA records or single CNAME record without name
+	target        []dns.RR
+	ttl           uint32
+	tsigKey       string
+	tsigAlgorithm string
+	client        *dns.Client
+}
+
+// NewFromEnv returns new updater configured with environment variables
+func NewFromEnv() (*Updater, error) {
+	server := os.Getenv("DNS_SERVER")
+	if len(server) == 0 {
+		return nil, errors.New("DNS_SERVER environment variable needed")
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	ttl := defaultTTL
+	if value := os.Getenv("DNS_TTL"); len(value) > 0 {
+		i, err := strconv.Atoi(value)
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("invalid DNS_TTL %q", value)
+		}
+		ttl = i
+	}
+	target, err := parseTarget(os.Getenv("DNS_TARGET"))
+	if err != nil {
+		return nil, err
+	}
+	u := &Updater{
+		server:        server,
+		target:        target,
+		ttl:           uint32(ttl),
+		tsigAlgorithm: defaultTsigAlgorithm,
+		client:        &dns.Client{Net: "udp"},
+	}
+	for _, zone := range strings.Split(os.Getenv("DNS_ZONES"), ",") {
+		if zone = strings.TrimSpace(zone); len(zone) > 0 {
+			u.zones = append(u.zones, strings.ToLower(dns.Fqdn(zone)))
+		}
+	}
+	if value := os.Getenv("DNS_TCP"); value == "true" {
+		u.client.Net = "tcp"
+	}
+	if value := os.Getenv("DNS_TIMEOUT"); len(value) > 0 {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS_TIMEOUT %q: %v", value, err)
+		}
+		u.client.Timeout = timeout
+	}
+	secret := os.Getenv("DNS_TSIG_SECRET")
+	if file := os.Getenv("DNS_TSIG_SECRET_FILE"); len(file) > 0 {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading DNS_TSIG_SECRET_FILE %v", err)
+		}
+		secret = strings.TrimSpace(string(data))
+	}
+	if key := os.Getenv("DNS_TSIG_KEY"); len(key) > 0 {
+		if len(secret) == 0 {
+			return nil, errors.New("DNS_TSIG_SECRET or DNS_TSIG_SECRET_FILE needed with DNS_TSIG_KEY")
+		}
+		if algorithm := os.Getenv("DNS_TSIG_ALGORITHM"); len(algorithm) > 0 {
+			u.tsigAlgorithm = dns.Fqdn(strings.ToLower(algorithm))
+		}
+		u.SetTsig(key, secret)
+	} else {
+		log.Printf("DNS_TSIG_KEY is not set, dns updates are not signed")
+	}
+	return u, nil
+}
+
+// parseTarget parses comma separated ip addresses or single hostname
+func parseTarget(value string) ([]dns.RR, error) {
+	target := []dns.RR{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		ip := net.ParseIP(item)
+		switch {
+		case ip == nil:
+			if _, ok := dns.IsDomainName(item); !ok {
+				return nil, fmt.Errorf("invalid DNS_TARGET %q", item)
+			}
+			target = append(target, &dns.CNAME{Hdr: dns.RR_Header{Rrtype: dns.TypeCNAME, Class: dns.ClassINET}, Target: dns.Fqdn(item)})
+		case ip.To4() != nil:
+			target = append(target, &dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA, Class: dns.ClassINET}, A: ip.To4()})
+		default:
+			target = append(target, &dns.AAAA{Hdr: dns.RR_Header{Rrtype: dns.TypeAAAA, Class: dns.ClassINET}, AAAA: ip})
+		}
+	}
+	if len(target) == 0 {
+		return nil, errors.New("DNS_TARGET environment variable needed")
+	}
+	for _, rr := range target {
+		if rr.Header().Rrtype == dns.TypeCNAME && len(target) > 1 {
+			return nil, errors.New("DNS_TARGET must be ip addresses or single hostname")
+		}
+	}
+	return target, nil
+}
+
+// SetTsig sets TSIG key used for signing the updates, secret is base64 encoded
+func (u *Updater) SetTsig(key string, secret string) {
+	u.tsigKey = dns.Fqdn(strings.ToLower(key))
+	u.client.TsigSecret = map[string]string{u.tsigKey: secret}
+}
+
+// records returns target records of the host
+func (u *Updater) records(name string) []dns.RR {
+	records := []dns.RR{}
+	for _, target := range u.target {
+		rr := dns.Copy(target)
+		rr.Header().Name = name
+		rr.Header().Ttl = u.ttl
+		records = append(records, rr)
+	}
+	return records
+}
+
+// addressRRsets returns rrsets of the host which are replaced by the target records
+func addressRRsets(name string) []dns.RR {
+	rrsets := []dns.RR{}
+	for _, rrtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeCNAME} {
+		rrsets = append(rrsets, &dns.ANY{Hdr: dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET}})
+	}
+	return rrsets
+}
+
+func (u *Updater) owner(name string, owner string) dns.RR {
+	return &dns.TXT{
+		Hdr: dns.RR_Header{Name: ownerPrefix + name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: u.ttl},
+		Txt: []string{ownerValue + owner},
+	}
+}
+
+// AddHost points the host to the target and adds owner record of the cluster
+func (u *Updater) AddHost(ctx context.Context, host string, owner string) error {
+	name := strings.ToLower(dns.Fqdn(host))
+	zone, err := u.zone(ctx, name)
+	if err != nil {
+		return err
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	m.Insert([]dns.RR{u.owner(name, owner)})
+	m.RemoveRRset(addressRRsets(name))
+	m.Insert(u.records(name))
+	_, err = u.exchange(ctx, m)
+	return err
+}
+
+// RemoveHost removes owner record of the cluster and the records of the host if no other
+// cluster uses the host
+func (u *Updater) RemoveHost(ctx context.Context, host string, owner string) error {
+	name := strings.ToLower(dns.Fqdn(host))
+	zone, err := u.zone(ctx, name)
+	if err != nil {
+		return err
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	m.Remove([]dns.RR{u.owner(name, owner)})
+	if _, err = u.exchange(ctx, m); err != nil {
+		return err
+	}
+	m = new(dns.Msg)
+	m.SetUpdate(zone)
+	m.RRsetNotUsed([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: ownerPrefix + name, Rrtype: dns.TypeTXT}}})
+	m.RemoveRRset(addressRRsets(name))
+	rcode, err := u.exchange(ctx, m)
+	if rcode == dns.RcodeYXRrset {
+		log.Printf("dns records of host %s are still used by other clusters", host)
+		return nil
+	}
+	return err
+}
+
+// zone returns zone of the name, longest matching zone of DNS_ZONES or zone of SOA record
+func (u *Updater) zone(ctx context.Context, name string) (string, error) {
+	zone := ""
+	for _, z := range u.zones {
+		if dns.IsSubDomain(z, name) && len(z) > len(zone) {
+			zone = z
+		}
+	}
+	if len(zone) > 0 {
+		return zone, nil
+	}
+	if len(u.zones) > 0 {
+		return "", fmt.Errorf("host %s is not in any of DNS_ZONES", name)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeSOA)
+	r, _, err := u.client.ExchangeContext(ctx, m, u.server)
+	if err != nil {
+		return "", err
+	}
+	for _, rr := range append(r.Answer, r.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return strings.ToLower(soa.Hdr.Name), nil
+		}
+	}
+	return "", fmt.Errorf("zone of host %s not found: %s", name, dns.RcodeToString[r.Rcode])
+}
+
+// exchange sends signed update and returns error if it is not successful
+func (u *Updater) exchange(ctx context.Context, m *dns.Msg) (int, error) {
+	if len(u.tsigKey) > 0 {
+		m.SetTsig(u.tsigKey, u.tsigAlgorithm, fudge, time.Now().Unix())
+	}
+	r, _, err := u.client.ExchangeContext(ctx, m, u.server)
+	if err != nil {
+		return 0, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return r.Rcode, fmt.Errorf("dns update of zone %s failed: %s", m.Question[0].Name, dns.RcodeToString[r.Rcode])
+	}
+	return r.Rcode, nil
+}
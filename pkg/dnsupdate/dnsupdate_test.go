@@ -0,0 +1,226 @@
+/*
+Copyright (C) 2018 Elisa Oyj
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package dnsupdate
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	testZone   = "fooext.fi."
+	testKey    = "lb-controller."
+	testSecret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+)
+
+// fakeServer is a dns server which applies dynamic updates of one zone in memory
+type fakeServer struct {
+	*dns.Server
+	// lock protects records, which are modified by the server goroutine
+	lock    sync.Mutex
+	records []dns.RR
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	f := &fakeServer{}
+	started := make(chan struct{})
+	f.Server = &dns.Server{
+		PacketConn:        pc,
+		TsigSecret:        map[string]string{testKey: testSecret},
+		NotifyStartedFunc: func() { close(started) },
+		Handler:           dns.HandlerFunc(f.serve),
+		// default accept function rejects updates
+		MsgAcceptFunc: func(dh dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go f.ActivateAndServe()
+	<-started
+	return f
+}
+
+func (f *fakeServer) serve(w dns.ResponseWriter, r *dns.Msg) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	m := new(dns.Msg)
+	m.SetReply(r)
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: testZone, Rrtype: dns.TypeSOA, Class: dns.ClassINET}, Ns: "ns." + testZone, Mbox: "hostmaster." + testZone}
+	switch {
+	case r.Opcode == dns.OpcodeQuery:
+		if !dns.IsSubDomain(testZone, r.Question[0].Name) {
+			m.Rcode = dns.RcodeRefused
+		} else if r.Question[0].Name == testZone {
+			m.Answer = []dns.RR{soa}
+		} else {
+			m.Ns = []dns.RR{soa}
+		}
+	case r.IsTsig() == nil || w.TsigStatus() != nil:
+		m.Rcode = dns.RcodeNotAuth
+	case r.Question[0].Name != testZone:
+		m.Rcode = dns.RcodeNotZone
+	default:
+		m.Rcode = f.update(r)
+	}
+	if r.IsTsig() != nil {
+		m.SetTsig(testKey, dns.HmacSHA256, 300, int64(r.IsTsig().TimeSigned))
+	}
+	w.WriteMsg(m)
+}
+
+func (f *fakeServer) update(r *dns.Msg) int {
+	for _, prereq := range r.Answer {
+		if prereq.Header().Class == dns.ClassNONE && len(f.find(prereq.Header().Name, prereq.Header().Rrtype)) > 0 {
+			return dns.RcodeYXRrset
+		}
+	}
+	for _, rr := range r.Ns {
+		h := rr.Header()
+		switch h.Class {
+		case dns.ClassANY:
+			f.remove(func(record dns.RR) bool {
+				return record.Header().Name == h.Name && record.Header().Rrtype == h.Rrtype
+			})
+		case dns.ClassNONE:
+			f.remove(func(record dns.RR) bool {
+				return dns.IsDuplicate(record, withClass(rr, dns.ClassINET))
+			})
+		default:
+			f.remove(func(record dns.RR) bool { return dns.IsDuplicate(record, rr) })
+			f.records = append(f.records, rr)
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+func withClass(rr dns.RR, class uint16) dns.RR {
+	rr = dns.Copy(rr)
+	rr.Header().Class = class
+	return rr
+}
+
+func (f *fakeServer) remove(match func(dns.RR) bool) {
+	records := []dns.RR{}
+	for _, record := range f.records {
+		if !match(record) {
+			records = append(records, record)
+		}
+	}
+	f.records = records
+}
+
+func (f *fakeServer) find(name string, rrtype uint16) []dns.RR {
+	found := []dns.RR{}
+	for _, record := range f.records {
+		if record.Header().Name == name && record.Header().Rrtype == rrtype {
+			found = append(found, record)
+		}
+	}
+	return found
+}
+
+func (f *fakeServer) lookup(name string, rrtype uint16) []dns.RR {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.find(name, rrtype)
+}
+
+// all returns copy of the records
+func (f *fakeServer) all() []dns.RR {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]dns.RR{}, f.records...)
+}
+
+// add adds records to the zone
+func (f *fakeServer) add(records ...dns.RR) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.records = append(f.records, records...)
+}
+
+func newTestUpdater(t *testing.T, f *fakeServer, target string) *Updater {
+	records, err := parseTarget(target)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	u := &Updater{
+		server:        f.PacketConn.LocalAddr().String(),
+		target:        records,
+		ttl:           defaultTTL,
+		tsigAlgorithm: defaultTsigAlgorithm,
+		client:        &dns.Client{},
+	}
+	u.SetTsig(testKey, testSecret)
+	return u
+}
+
+func TestUpdater(t *testing.T) {
+	f := newFakeServer(t)
+	defer f.Shutdown()
+	ctx := context.Background()
+	u := newTestUpdater(t, f, "192.0.2.10, 2001:db8::10")
+
+	err := u.AddHost(ctx, "www.FooExt.fi", "dc1")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	a := f.lookup("www.fooext.fi.", dns.TypeA)
+	if len(a) != 1 || a[0].(*dns.A).A.String() != "192.0.2.10" || len(f.lookup("www.fooext.fi.", dns.TypeAAAA)) != 1 {
+		t.Errorf("excepted A and AAAA records, got %v", f.all())
+	}
+	err = u.AddHost(ctx, "www.fooext.fi", "dc2")
+	if err != nil || len(f.lookup("_lbcontroller.www.fooext.fi.", dns.TypeTXT)) != 2 || len(f.lookup("www.fooext.fi.", dns.TypeA)) != 1 {
+		t.Errorf("excepted owner records of both clusters, got %v %v", f.all(), err)
+	}
+
+	// records are kept while other cluster uses the host
+	err = u.RemoveHost(ctx, "www.fooext.fi", "dc1")
+	if err != nil || len(f.lookup("www.fooext.fi.", dns.TypeA)) != 1 {
+		t.Errorf("excepted records to be kept, got %v %v", f.all(), err)
+	}
+	err = u.RemoveHost(ctx, "www.fooext.fi", "dc2")
+	if err != nil || len(f.all()) != 0 {
+		t.Errorf("excepted records to be removed, got %v %v", f.all(), err)
+	}
+
+	// cname replaces address records
+	f.add(u.records("api.fooext.fi.")...)
+	u = newTestUpdater(t, f, "vs.example.com")
+	err = u.AddHost(ctx, "api.fooext.fi", "dc1")
+	if err != nil || len(f.lookup("api.fooext.fi.", dns.TypeA)) != 0 || len(f.lookup("api.fooext.fi.", dns.TypeCNAME)) != 1 {
+		t.Errorf("excepted only cname record, got %v %v", f.all(), err)
+	}
+
+	err = u.AddHost(ctx, "www.other.fi", "dc1")
+	if err == nil {
+		t.Errorf("excepted error from host outside of the zone")
+	}
+	u.zones = []string{"other.fi."}
+	err = u.AddHost(ctx, "www.fooext.fi", "dc1")
+	if err == nil || !strings.Contains(err.Error(), "DNS_ZONES") {
+		t.Errorf("excepted error from host outside of DNS_ZONES, got %v", err)
+	}
+	u.zones = nil
+
+	u.SetTsig(testKey, "d3JvbmdzZWNyZXQ=")
+	err = u.AddHost(ctx, "www.fooext.fi", "dc1")
+	if err == nil {
+		t.Errorf("excepted error with wrong tsig secret")
+	}
+
+	_, err = parseTarget("vs.example.com,192.0.2.10")
+	if err == nil {
+		t.Errorf("excepted error from cname with addresses")
+	}
+}